@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr/eventstore/typesense30142"
+)
+
+// Circuit breaker states reported in BreakerStatus.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+// breakerProbeText is embedded to check whether the service has recovered.
+const breakerProbeText = "probe"
+
+var errBreakerOpen = errors.New("embedding service unavailable (circuit breaker open)")
+
+type BreakerStatus struct {
+	State               string `json:"state"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	Trips               int64  `json:"trips"`
+	OpenedAt            int64  `json:"opened_at,omitempty"`
+	LastError           string `json:"last_error,omitempty"`
+}
+
+// EmbeddingBreaker wraps an Embedder and opens after Threshold consecutive
+// failed calls. While open, calls fail immediately and OnStateChange lets the
+// relay fall back to keyword-only indexing and search. After Cooldown the
+// breaker probes the service itself and closes again once a probe succeeds.
+type EmbeddingBreaker struct {
+	Embedder  typesense30142.Embedder
+	Threshold int
+	Cooldown  time.Duration
+
+	// OnStateChange is called on its own goroutine whenever the breaker opens
+	// or closes, since the failing call may hold locks of the caller. Calls
+	// can arrive out of order, so it should act on IsOpen rather than open.
+	OnStateChange func(open bool)
+
+	mu        sync.Mutex
+	state     string
+	failures  int
+	trips     int64
+	openedAt  time.Time
+	lastError string
+	// timer schedules the next probe while the breaker is open
+	timer  *time.Timer
+	closed bool
+}
+
+var _ typesense30142.Embedder = (*EmbeddingBreaker)(nil)
+
+func NewEmbeddingBreaker(embedder typesense30142.Embedder, threshold int, cooldown time.Duration) *EmbeddingBreaker {
+	return &EmbeddingBreaker{
+		Embedder:  embedder,
+		Threshold: threshold,
+		Cooldown:  cooldown,
+		state:     breakerClosed,
+	}
+}
+
+// Embed forwards to the wrapped Embedder unless the breaker is open.
+func (b *EmbeddingBreaker) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	if b.IsOpen() {
+		return nil, errBreakerOpen
+	}
+	vectors, err := b.Embedder.Embed(ctx, texts)
+	if err != nil && ctx.Err() == nil {
+		b.recordFailure(err)
+	} else if err == nil {
+		b.recordSuccess()
+	}
+	return vectors, err
+}
+
+// IsOpen reports whether embedding is currently bypassed.
+func (b *EmbeddingBreaker) IsOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state != breakerClosed
+}
+
+func (b *EmbeddingBreaker) recordSuccess() {
+	b.mu.Lock()
+	b.failures = 0
+	b.mu.Unlock()
+}
+
+func (b *EmbeddingBreaker) recordFailure(err error) {
+	b.mu.Lock()
+	b.failures++
+	b.lastError = err.Error()
+	tripped := b.state == breakerClosed && b.failures >= b.Threshold
+	if tripped {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		b.trips++
+	}
+	b.mu.Unlock()
+
+	if tripped {
+		slog.Warn("circuit breaker opened", "component", "embedding", "failures", b.Threshold, "err", err)
+		b.notify(true)
+		b.scheduleProbe()
+	}
+}
+
+// scheduleProbe probes the service after Cooldown unless the breaker was stopped.
+func (b *EmbeddingBreaker) scheduleProbe() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.timer = time.AfterFunc(b.Cooldown, b.probe)
+	}
+}
+
+// Stop cancels the next probe and keeps the breaker from probing again, so a
+// closed relay no longer calls the embedding service.
+func (b *EmbeddingBreaker) Stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+}
+
+// probe checks whether the service has recovered and closes the breaker if so.
+func (b *EmbeddingBreaker) probe() {
+	b.mu.Lock()
+	b.state = breakerHalfOpen
+	b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), b.Cooldown)
+	defer cancel()
+	_, err := b.Embedder.Embed(ctx, []string{breakerProbeText})
+
+	b.mu.Lock()
+	if err != nil {
+		b.state = breakerOpen
+		b.lastError = err.Error()
+		b.mu.Unlock()
+		b.scheduleProbe()
+		return
+	}
+	b.state = breakerClosed
+	b.failures = 0
+	b.openedAt = time.Time{}
+	b.mu.Unlock()
+
+	slog.Info("circuit breaker closed, embedding service recovered", "component", "embedding")
+	b.notify(false)
+}
+
+func (b *EmbeddingBreaker) notify(open bool) {
+	if b.OnStateChange != nil {
+		go b.OnStateChange(open)
+	}
+}
+
+// GetStatus returns the breaker state.
+func (b *EmbeddingBreaker) GetStatus() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := BreakerStatus{
+		State:               b.state,
+		ConsecutiveFailures: b.failures,
+		Trips:               b.trips,
+		LastError:           b.lastError,
+	}
+	if !b.openedAt.IsZero() {
+		status.OpenedAt = b.openedAt.Unix()
+	}
+	return status
+}
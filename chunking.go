@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"fiatjaf.com/nostr/eventstore/typesense30142"
+)
+
+const (
+	// DefaultEmbedChunkTokens is the default token budget per chunk. It should
+	// not exceed the maximum sequence length of the embedding model (128 for
+	// MiniLM-L12-v2); text beyond that is cut off by the model itself.
+	DefaultEmbedChunkTokens = 128
+	// DefaultEmbedMaxChunks limits the number of chunks embedded per text.
+	// With the default chunk size it covers about 32k characters, well above
+	// the longest AMB descriptions.
+	DefaultEmbedMaxChunks = 64
+	// runesPerToken is the average number of characters per subword token
+	// used to estimate token counts without the model's tokenizer.
+	runesPerToken = 4
+)
+
+// ChunkingEmbedder wraps an Embedder and splits texts longer than ChunkTokens
+// into chunks at word boundaries. All chunks are embedded in one call and the
+// chunk vectors of each text are mean pooled into a single vector, so long
+// descriptions are represented fully instead of being truncated.
+type ChunkingEmbedder struct {
+	Embedder    typesense30142.Embedder
+	ChunkTokens int
+	MaxChunks   int
+
+	truncated atomic.Int64
+}
+
+var _ typesense30142.Embedder = (*ChunkingEmbedder)(nil)
+
+func NewChunkingEmbedder(embedder typesense30142.Embedder, chunkTokens, maxChunks int) *ChunkingEmbedder {
+	return &ChunkingEmbedder{
+		Embedder:    embedder,
+		ChunkTokens: chunkTokens,
+		MaxChunks:   maxChunks,
+	}
+}
+
+// Embed embeds every chunk of texts and returns one pooled vector per text.
+func (c *ChunkingEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	if len(texts) == 0 {
+		return nil, nil
+	}
+
+	var chunks []string
+	spans := make([][2]int, len(texts)) // chunk range of each text
+	for i, text := range texts {
+		start := len(chunks)
+		textChunks, truncated := chunkText(text, c.ChunkTokens, c.MaxChunks)
+		if truncated {
+			c.truncated.Add(1)
+			slog.Warn("text exceeds the chunk limit, its tail is not embedded", "component", "embedding",
+				"runes", utf8.RuneCountInString(text), "max_chunks", c.MaxChunks)
+		}
+		chunks = append(chunks, textChunks...)
+		spans[i] = [2]int{start, len(chunks)}
+	}
+	if len(chunks) == len(texts) {
+		return c.Embedder.Embed(ctx, texts)
+	}
+
+	vectors, err := c.Embedder.Embed(ctx, chunks)
+	if err != nil {
+		return nil, err
+	}
+	if len(vectors) != len(chunks) {
+		return nil, fmt.Errorf("embedding service returned %d vectors for %d chunks", len(vectors), len(chunks))
+	}
+
+	pooled := make([][]float32, len(texts))
+	for i, span := range spans {
+		pooled[i] = meanPool(vectors[span[0]:span[1]])
+	}
+	return pooled, nil
+}
+
+// Truncated returns the number of texts whose tail was not embedded since
+// startup because they exceeded MaxChunks.
+func (c *ChunkingEmbedder) Truncated() int64 {
+	return c.truncated.Load()
+}
+
+// chunkText splits text into at most maxChunks chunks of about maxTokens
+// estimated tokens each. Chunks end at whitespace; a single word longer than
+// the budget is split at rune boundaries. Text that does not fit into
+// maxChunks is dropped, and truncated reports whether that happened.
+func chunkText(text string, maxTokens, maxChunks int) (chunks []string, truncated bool) {
+	words := strings.Fields(text)
+	if len(words) == 0 {
+		return []string{text}, false
+	}
+
+	var current []string
+	tokens := 0
+	flush := func() {
+		if len(current) > 0 {
+			chunks = append(chunks, strings.Join(current, " "))
+			current = current[:0]
+			tokens = 0
+		}
+	}
+	for _, word := range words {
+		for _, piece := range splitRunes(word, maxTokens*runesPerToken) {
+			n := estimateTokens(piece)
+			if tokens+n > maxTokens {
+				flush()
+			}
+			current = append(current, piece)
+			tokens += n
+		}
+		if len(chunks) >= maxChunks {
+			break
+		}
+	}
+	flush()
+	if len(chunks) == 1 {
+		// Fits into one chunk: keep the original whitespace
+		return []string{text}, false
+	}
+	if len(chunks) > maxChunks {
+		return chunks[:maxChunks], true
+	}
+	return chunks, false
+}
+
+// estimateTokens approximates the subword token count of a single word.
+func estimateTokens(word string) int {
+	return max(1, (utf8.RuneCountInString(word)+runesPerToken-1)/runesPerToken)
+}
+
+// splitRunes splits s into pieces of at most size runes.
+func splitRunes(s string, size int) []string {
+	if utf8.RuneCountInString(s) <= size {
+		return []string{s}
+	}
+	var pieces []string
+	for len(s) > 0 {
+		end, n := 0, 0
+		for end < len(s) && n < size {
+			_, width := utf8.DecodeRuneInString(s[end:])
+			end += width
+			n++
+		}
+		pieces = append(pieces, s[:end])
+		s = s[end:]
+	}
+	return pieces
+}
+
+// meanPool averages vectors and normalizes the result to unit length.
+func meanPool(vectors [][]float32) []float32 {
+	if len(vectors) == 1 {
+		return vectors[0]
+	}
+	pooled := make([]float32, len(vectors[0]))
+	for _, v := range vectors {
+		for i := range min(len(v), len(pooled)) {
+			pooled[i] += v[i]
+		}
+	}
+	var norm float64
+	for _, x := range pooled {
+		norm += float64(x) * float64(x)
+	}
+	if norm == 0 {
+		return pooled
+	}
+	scale := float32(1 / math.Sqrt(norm))
+	for i := range pooled {
+		pooled[i] *= scale
+	}
+	return pooled
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// Config holds everything NewAMBRelay needs. LoadConfig fills it from the
+// environment; programs embedding the relay can build it directly, starting
+// from DefaultConfig.
+type Config struct {
+	// Relay metadata (NIP-11)
+	Name        string
+	Description string
+	Icon        string
+	// PubKey is the relay operator, who is always an admin. Zero if unset.
+	PubKey nostr.PubKey
+	// AdminPubKeys may call the NIP-86 management API in addition to PubKey.
+	AdminPubKeys []nostr.PubKey
+
+	// Port is the port the relay listens on.
+	Port string
+	// MetricsToken, if set, is required as bearer token to read /metrics.
+	MetricsToken string
+	// ShutdownTimeout bounds how long a shutdown waits for in-flight writes,
+	// background jobs and the index outbox before closing BoltDB.
+	ShutdownTimeout time.Duration
+	// DBPath is the BoltDB file holding events and relay state.
+	DBPath string
+
+	TSAPIKey     string
+	TSHost       string
+	TSCollection string
+
+	// EmbedProvider is used unless one was stored through setembeddingprovider.
+	EmbedProvider         EmbeddingProviderConfig
+	EmbedMaxRetries       int
+	EmbedRetryBackoff     time.Duration
+	EmbedBreakerThreshold int
+	EmbedBreakerCooldown  time.Duration
+	// EmbedCacheMaxEntries is the size of the BoltDB vector cache, 0 to disable it.
+	EmbedCacheMaxEntries int
+	EmbedChunkTokens     int
+	EmbedMaxChunks       int
+	// EmbedAutoReembed starts a reindex when the embedding model changed.
+	EmbedAutoReembed bool
+	// SemanticSearchEnabled enables semantic search on startup if an
+	// embedding service is configured.
+	SemanticSearchEnabled bool
+
+	// QueryCacheMaxEntries is the size of the query vector cache, 0 to disable it.
+	QueryCacheMaxEntries int
+	QueryCachePersist    bool
+	QueryBatchWindow     time.Duration
+	// SearchResultCacheTTL is how long search results are reused, 0 to disable caching.
+	SearchResultCacheTTL time.Duration
+	// StatsCacheTTL is how long the stats breakdowns are reused, 0 to
+	// recompute them in the background on every call.
+	StatsCacheTTL time.Duration
+
+	Reindex ReindexConfig
+	// BanPubKeyPurge is what banpubkey does with existing events: PurgeNone,
+	// PurgeHide or PurgeDelete.
+	BanPubKeyPurge string
+}
+
+// DefaultShutdownTimeout stays below the 10s docker stop waits before it
+// kills the container.
+const DefaultShutdownTimeout = 8 * time.Second
+
+// DefaultConfig returns the configuration used for unset environment variables.
+func DefaultConfig() Config {
+	return Config{
+		Port:                  "3334",
+		ShutdownTimeout:       DefaultShutdownTimeout,
+		DBPath:                "./data/relay.db",
+		EmbedProvider:         EmbeddingProviderConfig{Provider: EmbedProviderEdufeed},
+		EmbedMaxRetries:       3,
+		EmbedRetryBackoff:     500 * time.Millisecond,
+		EmbedBreakerThreshold: 5,
+		EmbedBreakerCooldown:  30 * time.Second,
+		EmbedCacheMaxEntries:  DefaultEmbeddingCacheEntries,
+		EmbedChunkTokens:      DefaultEmbedChunkTokens,
+		EmbedMaxChunks:        DefaultEmbedMaxChunks,
+		QueryCacheMaxEntries:  DefaultQueryCacheEntries,
+		QueryBatchWindow:      DefaultQueryBatchWindow,
+		SearchResultCacheTTL:  DefaultResultCacheTTL,
+		StatsCacheTTL:         DefaultStatsCacheTTL,
+		Reindex:               DefaultReindexConfig(),
+		BanPubKeyPurge:        PurgeNone,
+	}
+}
+
+// LoadConfig reads the configuration from the environment. Invalid values
+// are reported and replaced by their defaults.
+func LoadConfig() Config {
+	cfg := DefaultConfig()
+	cfg.Name = os.Getenv("NAME")
+	cfg.Description = os.Getenv("DESCRIPTION")
+	cfg.Icon = os.Getenv("ICON")
+
+	if pkHex := os.Getenv("PUBKEY"); pkHex != "" {
+		pk, err := nostr.PubKeyFromHex(pkHex)
+		if err != nil {
+			slog.Error("invalid PUBKEY", "value", pkHex, "err", err)
+		} else {
+			cfg.PubKey = pk
+		}
+	}
+	if adminList := os.Getenv("ADMIN_PUBKEYS"); adminList != "" {
+		for _, hex := range strings.Split(adminList, ",") {
+			hex = strings.TrimSpace(hex)
+			if pk, err := nostr.PubKeyFromHex(hex); err == nil {
+				cfg.AdminPubKeys = append(cfg.AdminPubKeys, pk)
+			} else {
+				slog.Error("invalid admin pubkey in ADMIN_PUBKEYS", "value", hex, "err", err)
+			}
+		}
+	}
+
+	if v := os.Getenv("PORT"); v != "" {
+		cfg.Port = v
+	}
+	if v := os.Getenv("DB_PATH"); v != "" {
+		cfg.DBPath = v
+	}
+	cfg.MetricsToken = os.Getenv("METRICS_TOKEN")
+	cfg.ShutdownTimeout = envDuration("SHUTDOWN_TIMEOUT", cfg.ShutdownTimeout, false)
+	cfg.TSAPIKey = os.Getenv("TS_APIKEY")
+	cfg.TSHost = os.Getenv("TS_HOST")
+	cfg.TSCollection = os.Getenv("TS_COLLECTION")
+
+	cfg.EmbedProvider = EmbeddingProviderConfig{
+		Provider: os.Getenv("EMBED_PROVIDER"),
+		Endpoint: os.Getenv("EMBED_ENDPOINT"),
+		Model:    os.Getenv("EMBED_MODEL"),
+		Token:    os.Getenv("EMBED_TOKEN"),
+	}
+	if v := os.Getenv("EMBED_DIMENSIONS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			cfg.EmbedProvider.Dimensions = n
+		} else {
+			slog.Warn("invalid EMBED_DIMENSIONS, using the default", "value", v, "default", DefaultHashDimensions)
+		}
+	}
+	if cfg.EmbedProvider.Provider == "" {
+		cfg.EmbedProvider.Provider = EmbedProviderEdufeed
+	}
+	cfg.EmbedMaxRetries = envInt("EMBED_MAX_RETRIES", cfg.EmbedMaxRetries, 0)
+	cfg.EmbedRetryBackoff = envDuration("EMBED_RETRY_BACKOFF", cfg.EmbedRetryBackoff, false)
+	cfg.EmbedBreakerThreshold = envInt("EMBED_BREAKER_THRESHOLD", cfg.EmbedBreakerThreshold, 1)
+	cfg.EmbedBreakerCooldown = envDuration("EMBED_BREAKER_COOLDOWN", cfg.EmbedBreakerCooldown, false)
+	cfg.EmbedCacheMaxEntries = envInt("EMBED_CACHE_MAX_ENTRIES", cfg.EmbedCacheMaxEntries, 0)
+	cfg.EmbedChunkTokens = envInt("EMBED_CHUNK_TOKENS", cfg.EmbedChunkTokens, 1)
+	cfg.EmbedMaxChunks = envInt("EMBED_MAX_CHUNKS", cfg.EmbedMaxChunks, 1)
+	cfg.EmbedAutoReembed = os.Getenv("EMBED_AUTO_REEMBED") == "true"
+	cfg.SemanticSearchEnabled = os.Getenv("SEMANTIC_SEARCH_ENABLED") == "true"
+
+	cfg.QueryCacheMaxEntries = envInt("QUERY_CACHE_MAX_ENTRIES", cfg.QueryCacheMaxEntries, 0)
+	cfg.QueryCachePersist = os.Getenv("QUERY_CACHE_PERSIST") == "true"
+	cfg.QueryBatchWindow = envDuration("QUERY_BATCH_WINDOW", cfg.QueryBatchWindow, true)
+	cfg.SearchResultCacheTTL = envDuration("SEARCH_RESULT_CACHE_TTL", cfg.SearchResultCacheTTL, true)
+	cfg.StatsCacheTTL = envDuration("STATS_CACHE_TTL", cfg.StatsCacheTTL, true)
+
+	cfg.Reindex.Workers = envInt("REINDEX_WORKERS", cfg.Reindex.Workers, 1)
+	if n := envInt("REINDEX_BATCH_SIZE", cfg.Reindex.BatchSize, 1); n != cfg.Reindex.BatchSize {
+		cfg.Reindex.BatchSize = n
+		cfg.Reindex.MinBatchSize = min(cfg.Reindex.MinBatchSize, n)
+		cfg.Reindex.MaxBatchSize = max(cfg.Reindex.MaxBatchSize, n)
+	}
+	if v := os.Getenv("BAN_PUBKEY_PURGE"); v != "" {
+		if ValidPurgeMode(v) {
+			cfg.BanPubKeyPurge = v
+		} else {
+			slog.Warn("invalid BAN_PUBKEY_PURGE, using the default", "value", v, "default", cfg.BanPubKeyPurge)
+		}
+	}
+	return cfg
+}
+
+// envInt returns the integer in the environment variable name, or def if it
+// is unset, not a number or below minimum.
+func envInt(name string, def, minimum int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < minimum {
+		slog.Warn("invalid "+name+", using the default", "value", v, "default", def)
+		return def
+	}
+	return n
+}
+
+// envDuration returns the duration in the environment variable name, or def
+// if it is unset, invalid, negative, or zero and allowZero is false.
+func envDuration(name string, def time.Duration, allowZero bool) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 || (d == 0 && !allowZero) {
+		slog.Warn("invalid "+name+", using the default", "value", v, "default", def)
+		return def
+	}
+	return d
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestLoadConfig(t *testing.T) {
+	admin := testPubKey("admin")
+	t.Setenv("NAME", "AMB")
+	t.Setenv("PUBKEY", testPubKey("operator").Hex())
+	t.Setenv("ADMIN_PUBKEYS", " "+admin.Hex()+", not-a-pubkey")
+	t.Setenv("TS_COLLECTION", "amb_events")
+	t.Setenv("EMBED_PROVIDER", "")
+	t.Setenv("EMBED_DIMENSIONS", "64")
+	t.Setenv("EMBED_MAX_RETRIES", "0")
+	t.Setenv("EMBED_RETRY_BACKOFF", "0s")
+	t.Setenv("QUERY_BATCH_WINDOW", "0s")
+	t.Setenv("EMBED_CACHE_MAX_ENTRIES", "-1")
+	t.Setenv("REINDEX_BATCH_SIZE", "5000")
+	t.Setenv("BAN_PUBKEY_PURGE", "burn")
+	t.Setenv("SHUTDOWN_TIMEOUT", "20s")
+
+	cfg := LoadConfig()
+	def := DefaultConfig()
+
+	if cfg.Name != "AMB" || cfg.TSCollection != "amb_events" || cfg.Port != "3334" {
+		t.Errorf("name=%q collection=%q port=%q", cfg.Name, cfg.TSCollection, cfg.Port)
+	}
+	if cfg.PubKey != testPubKey("operator") {
+		t.Error("PUBKEY not parsed")
+	}
+	if !slices.Equal(cfg.AdminPubKeys, []nostr.PubKey{admin}) {
+		t.Errorf("AdminPubKeys = %v, want only the valid one", cfg.AdminPubKeys)
+	}
+	if cfg.EmbedProvider.Provider != EmbedProviderEdufeed || cfg.EmbedProvider.Dimensions != 64 {
+		t.Errorf("EmbedProvider = %+v", cfg.EmbedProvider)
+	}
+	if cfg.EmbedMaxRetries != 0 {
+		t.Errorf("EmbedMaxRetries = %d, want 0", cfg.EmbedMaxRetries)
+	}
+	// A zero backoff is invalid, a zero batch window disables batching
+	if cfg.EmbedRetryBackoff != def.EmbedRetryBackoff || cfg.QueryBatchWindow != 0 {
+		t.Errorf("EmbedRetryBackoff = %s, QueryBatchWindow = %s", cfg.EmbedRetryBackoff, cfg.QueryBatchWindow)
+	}
+	if cfg.EmbedCacheMaxEntries != def.EmbedCacheMaxEntries {
+		t.Errorf("EmbedCacheMaxEntries = %d, want the default for a negative value", cfg.EmbedCacheMaxEntries)
+	}
+	if cfg.Reindex.BatchSize != 5000 || cfg.Reindex.MaxBatchSize != 5000 {
+		t.Errorf("Reindex = %+v, want batch size 5000 within the bounds", cfg.Reindex)
+	}
+	if cfg.BanPubKeyPurge != PurgeNone {
+		t.Errorf("BanPubKeyPurge = %q, want %q for an invalid mode", cfg.BanPubKeyPurge, PurgeNone)
+	}
+	if cfg.ShutdownTimeout != 20*time.Second {
+		t.Errorf("ShutdownTimeout = %s, want 20s", cfg.ShutdownTimeout)
+	}
+	if cfg.SearchResultCacheTTL != DefaultResultCacheTTL {
+		t.Errorf("SearchResultCacheTTL = %s, want the default", cfg.SearchResultCacheTTL)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"fiatjaf.com/nostr/eventstore/typesense30142"
+	"go.etcd.io/bbolt"
+)
+
+// bucketEmbeddingCache maps a cache key to an 8 byte LRU sequence followed by
+// the little-endian float32 vector. bucketEmbeddingCacheLRU maps the sequence
+// back to the cache key, oldest first.
+var (
+	bucketEmbeddingCache    = []byte("embedding_cache")
+	bucketEmbeddingCacheLRU = []byte("embedding_cache_lru")
+)
+
+// DefaultEmbeddingCacheEntries is the default maximum number of cached vectors.
+// At 768 dimensions a vector takes about 3 KB.
+const DefaultEmbeddingCacheEntries = 50000
+
+type EmbeddingCacheStats struct {
+	Model      string `json:"model"`
+	Entries    int64  `json:"entries"`
+	MaxEntries int    `json:"max_entries"`
+	Hits       int64  `json:"hits"`
+	Misses     int64  `json:"misses"`
+	Evictions  int64  `json:"evictions"`
+}
+
+// EmbeddingCache wraps an Embedder and keeps the vectors it returns in BoltDB,
+// keyed by model and the SHA-256 of the text, so unchanged texts are not sent
+// to the embedding service again. The least recently used vectors are evicted
+// once MaxEntries is exceeded.
+type EmbeddingCache struct {
+	Embedder   typesense30142.Embedder
+	MaxEntries int
+
+	db        *bbolt.DB
+	model     atomic.Value // stores string
+	mu        sync.Mutex   // serializes writes so entries stays exact
+	entries   atomic.Int64
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+var _ typesense30142.Embedder = (*EmbeddingCache)(nil)
+
+func NewEmbeddingCache(embedder typesense30142.Embedder, model string, maxEntries int) *EmbeddingCache {
+	c := &EmbeddingCache{
+		Embedder:   embedder,
+		MaxEntries: maxEntries,
+	}
+	c.SetModel(model)
+	return c
+}
+
+// SetModel changes the model part of the cache key. Vectors cached for other
+// models stay in the cache until they are evicted.
+func (c *EmbeddingCache) SetModel(model string) {
+	c.model.Store(model)
+}
+
+// Model returns the model part of the cache key.
+func (c *EmbeddingCache) Model() string {
+	return c.model.Load().(string)
+}
+
+// Init creates the cache buckets and counts the cached vectors.
+func (c *EmbeddingCache) Init(db *bbolt.DB) error {
+	c.db = db
+	return db.Update(func(tx *bbolt.Tx) error {
+		for _, bucket := range [][]byte{bucketEmbeddingCache, bucketEmbeddingCacheLRU} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		var n int64
+		cursor := tx.Bucket(bucketEmbeddingCacheLRU).Cursor()
+		for k, _ := cursor.First(); k != nil; k, _ = cursor.Next() {
+			n++
+		}
+		c.entries.Store(n)
+		return nil
+	})
+}
+
+// Embed returns cached vectors where available and embeds the remaining texts
+// in a single call to the wrapped Embedder.
+func (c *EmbeddingCache) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	if len(texts) == 0 {
+		return nil, nil
+	}
+
+	keys := make([][]byte, len(texts))
+	for i, text := range texts {
+		keys[i] = c.key(text)
+	}
+
+	vectors := make([][]float32, len(texts))
+	touch := make([]bool, len(texts)) // entries to write or move to the recent end
+	var hits int
+	var missIdx []int
+	var missTexts []string
+	c.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(bucketEmbeddingCache)
+		// Only hits in the older half are refreshed, so repeated lookups of
+		// popular texts do not each cost a write transaction
+		var refreshBelow uint64
+		if seq, half := tx.Bucket(bucketEmbeddingCacheLRU).Sequence(), uint64(c.MaxEntries/2); seq > half {
+			refreshBelow = seq - half
+		}
+		for i, key := range keys {
+			if val := bucket.Get(key); len(val) >= 8 {
+				vectors[i] = decodeVector(val[8:])
+				touch[i] = binary.BigEndian.Uint64(val[:8]) < refreshBelow
+				hits++
+			} else {
+				missIdx = append(missIdx, i)
+				missTexts = append(missTexts, texts[i])
+				touch[i] = true
+			}
+		}
+		return nil
+	})
+	c.hits.Add(int64(hits))
+	c.misses.Add(int64(len(missIdx)))
+
+	if len(missTexts) > 0 {
+		embedded, err := c.Embedder.Embed(ctx, missTexts)
+		if err != nil {
+			return nil, err
+		}
+		if len(embedded) != len(missTexts) {
+			return nil, fmt.Errorf("embedding service returned %d vectors for %d texts", len(embedded), len(missTexts))
+		}
+		for j, i := range missIdx {
+			vectors[i] = embedded[j]
+		}
+	}
+
+	// A failure to update the cache does not affect the result
+	c.store(keys, vectors, touch)
+	return vectors, nil
+}
+
+// store writes the touched vectors and moves them to the most recently used end.
+func (c *EmbeddingCache) store(keys [][]byte, vectors [][]float32, touch []bool) {
+	if !slices.Contains(touch, true) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var added, evicted int64
+	err := c.db.Update(func(tx *bbolt.Tx) error {
+		added, evicted = 0, 0
+		cache := tx.Bucket(bucketEmbeddingCache)
+		lru := tx.Bucket(bucketEmbeddingCacheLRU)
+		stored := map[string]bool{}
+		for i, key := range keys {
+			if !touch[i] || stored[string(key)] {
+				continue
+			}
+			stored[string(key)] = true
+
+			if old := cache.Get(key); len(old) >= 8 {
+				if err := lru.Delete(old[:8]); err != nil {
+					return err
+				}
+			} else {
+				added++
+			}
+			seq, err := lru.NextSequence()
+			if err != nil {
+				return err
+			}
+			val := make([]byte, 8, 8+4*len(vectors[i]))
+			binary.BigEndian.PutUint64(val, seq)
+			val = appendVector(val, vectors[i])
+			if err := cache.Put(key, val); err != nil {
+				return err
+			}
+			if err := lru.Put(val[:8], key); err != nil {
+				return err
+			}
+		}
+
+		// Evict the least recently used vectors
+		over := c.entries.Load() + added - int64(c.MaxEntries)
+		if over <= 0 {
+			return nil
+		}
+		var seqs, victims [][]byte
+		cursor := lru.Cursor()
+		for k, v := cursor.First(); k != nil && int64(len(seqs)) < over; k, v = cursor.Next() {
+			seqs = append(seqs, append([]byte(nil), k...))
+			victims = append(victims, append([]byte(nil), v...))
+		}
+		for i := range seqs {
+			if err := lru.Delete(seqs[i]); err != nil {
+				return err
+			}
+			if err := cache.Delete(victims[i]); err != nil {
+				return err
+			}
+			evicted++
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	c.entries.Add(added - evicted)
+	c.evictions.Add(evicted)
+}
+
+// Clear removes all cached vectors.
+func (c *EmbeddingCache) Clear() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.db.Update(func(tx *bbolt.Tx) error {
+		for _, bucket := range [][]byte{bucketEmbeddingCache, bucketEmbeddingCacheLRU} {
+			if err := tx.DeleteBucket(bucket); err != nil && err != bbolt.ErrBucketNotFound {
+				return err
+			}
+			if _, err := tx.CreateBucket(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		c.entries.Store(0)
+	}
+	return err
+}
+
+// GetStats returns the cache size and hit counters since startup.
+func (c *EmbeddingCache) GetStats() EmbeddingCacheStats {
+	return EmbeddingCacheStats{
+		Model:      c.Model(),
+		Entries:    c.entries.Load(),
+		MaxEntries: c.MaxEntries,
+		Hits:       c.hits.Load(),
+		Misses:     c.misses.Load(),
+		Evictions:  c.evictions.Load(),
+	}
+}
+
+func (c *EmbeddingCache) key(text string) []byte {
+	sum := sha256.Sum256([]byte(c.Model() + "\x00" + text))
+	return sum[:]
+}
+
+func appendVector(buf []byte, vector []float32) []byte {
+	for _, f := range vector {
+		buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(f))
+	}
+	return buf
+}
+
+func decodeVector(data []byte) []float32 {
+	vector := make([]float32, len(data)/4)
+	for i := range vector {
+		vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+	}
+	return vector
+}
@@ -3,149 +3,226 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"strings"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	typesense30142 "fiatjaf.com/nostr/eventstore/typesense30142"
 )
 
-const (
-	// EmbedFieldSeparator is used to join multiple text fields for embedding.
-	EmbedFieldSeparator = " | "
-	// EmbedMaxLength is the maximum character length before truncation.
-	EmbedMaxLength = 8192
-)
-
-// EmbeddingClient implements the typesense30142.Embedder interface
-// for the edufeed embedding service.
+// EmbeddingClient implements the typesense30142.Embedder interface on top of
+// one of the supported embedding providers. The provider can be switched at runtime.
 type EmbeddingClient struct {
-	Endpoint    string
-	BearerToken string
-	HTTPClient  *http.Client
+	HTTPClient *http.Client
+
+	// MaxRetries is the number of retries after a failed attempt. Timeouts,
+	// network errors, 5xx and 429 responses are retried with exponential
+	// backoff starting at RetryBackoff; a 429 waits for Retry-After instead.
+	MaxRetries    int
+	RetryBackoff  time.Duration
+	MaxRetryDelay time.Duration
+	// Metrics, if set, records the latency and errors of every attempt.
+	Metrics *Metrics
+
+	mu       sync.RWMutex
+	provider EmbeddingProviderConfig
+	retries  atomic.Int64
 }
 
 // Verify EmbeddingClient implements Embedder interface
 var _ typesense30142.Embedder = (*EmbeddingClient)(nil)
 
-type embedRequest struct {
-	Texts []string `json:"texts"`
+// embedError is a failed attempt. retry is false for errors that would fail
+// again, such as 4xx responses; after is the server's Retry-After, if any.
+type embedError struct {
+	err   error
+	retry bool
+	after time.Duration
 }
 
-type embedResponse struct {
-	Embeddings [][]float32 `json:"embeddings"`
-}
+func (e *embedError) Error() string { return e.err.Error() }
+func (e *embedError) Unwrap() error { return e.err }
 
-// NewEmbeddingClient creates a new embedding client.
-func NewEmbeddingClient(endpoint, token string) *EmbeddingClient {
+// NewEmbeddingClient creates a new embedding client. An empty provider
+// configuration leaves the client unconfigured until SetProvider is called.
+func NewEmbeddingClient(provider EmbeddingProviderConfig) *EmbeddingClient {
 	return &EmbeddingClient{
-		Endpoint:    endpoint,
-		BearerToken: token,
 		HTTPClient: &http.Client{
 			Timeout: 30 * time.Second,
 		},
+		MaxRetries:    3,
+		RetryBackoff:  500 * time.Millisecond,
+		MaxRetryDelay: time.Minute,
+		provider:      provider,
+	}
+}
+
+// SetProvider switches the embedding provider used for subsequent requests.
+func (c *EmbeddingClient) SetProvider(provider EmbeddingProviderConfig) error {
+	if err := provider.Validate(); err != nil {
+		return err
 	}
+	c.mu.Lock()
+	c.provider = provider
+	c.mu.Unlock()
+	return nil
+}
+
+// Provider returns the current provider configuration.
+func (c *EmbeddingClient) Provider() EmbeddingProviderConfig {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.provider
+}
+
+// Configured reports whether an embedding provider is set up.
+func (c *EmbeddingClient) Configured() bool {
+	return c.Provider().Configured()
 }
 
-// Embed computes embedding vectors for the given texts.
+// Embed computes embedding vectors for the given texts, retrying transient failures.
 func (c *EmbeddingClient) Embed(ctx context.Context, texts []string) ([][]float32, error) {
 	if len(texts) == 0 {
 		return nil, nil
 	}
 
-	reqBody, err := json.Marshal(embedRequest{Texts: texts})
+	cfg := c.Provider()
+	if cfg.Provider == EmbedProviderHash {
+		return hashEmbed(texts, cfg.HashDimensions()), nil
+	}
+	provider, ok := embedProviders[cfg.Provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown embedding provider %q", cfg.Provider)
+	}
+	reqBody, err := provider.encodeRequest(cfg.Model, texts)
 	if err != nil {
 		return nil, fmt.Errorf("marshal request: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Endpoint, bytes.NewReader(reqBody))
+	backoff := c.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		embeddings, err := c.embedOnce(ctx, cfg, provider, reqBody, len(texts))
+		if err == nil {
+			return embeddings, nil
+		}
+		var embedErr *embedError
+		if !errors.As(err, &embedErr) || !embedErr.retry || attempt >= c.MaxRetries || ctx.Err() != nil {
+			return nil, err
+		}
+
+		delay := backoff
+		if embedErr.after > 0 {
+			delay = embedErr.after
+		}
+		if delay > c.MaxRetryDelay {
+			return nil, fmt.Errorf("%w (retry delay %s exceeds limit)", err, delay)
+		}
+		c.retries.Add(1)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+func (c *EmbeddingClient) embedOnce(ctx context.Context, cfg EmbeddingProviderConfig, provider embedProvider, reqBody []byte, n int) (_ [][]float32, err error) {
+	start := time.Now()
+	defer func() { c.Metrics.ObserveEmbedding(start, err) }()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.Endpoint, bytes.NewReader(reqBody))
 	if err != nil {
 		return nil, fmt.Errorf("create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+c.BearerToken)
+	if cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.Token)
+	}
 
 	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("request failed: %w", err)
+		return nil, &embedError{err: fmt.Errorf("request failed: %w", err), retry: true}
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("embedding service error %d: %s", resp.StatusCode, string(body))
+		return nil, &embedError{
+			err:   fmt.Errorf("embedding service error %d: %s", resp.StatusCode, string(body)),
+			retry: resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests,
+			after: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
 	}
 
-	var result embedResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+	embeddings, err := provider.decodeResponse(resp.Body, n)
+	if err != nil {
 		return nil, fmt.Errorf("decode response: %w", err)
 	}
+	if len(embeddings) != n {
+		return nil, fmt.Errorf("embedding service returned %d vectors for %d texts", len(embeddings), n)
+	}
+	return embeddings, nil
+}
 
-	return result.Embeddings, nil
+// Retries returns the number of retried attempts since startup.
+func (c *EmbeddingClient) Retries() int64 {
+	return c.retries.Load()
 }
 
-// BuildEmbedText concatenates AMB metadata fields for embedding based on the configured field list.
-// Supported fields: "name", "description", "keywords", "about", "creator", "publisher", "learningResourceType"
-func BuildEmbedText(amb *typesense30142.AMBMetadata, fields []string) string {
-	var parts []string
-
-	for _, field := range fields {
-		switch field {
-		case "name":
-			if amb.Name != "" {
-				parts = append(parts, amb.Name)
-			}
-		case "description":
-			if amb.Description != "" {
-				parts = append(parts, amb.Description)
-			}
-		case "keywords":
-			if len(amb.Keywords) > 0 {
-				parts = append(parts, strings.Join(amb.Keywords, ", "))
-			}
-		case "about":
-			// Extract prefLabel values from about objects (all languages)
-			for _, about := range amb.About {
-				if about != nil && about.PrefLabel != nil {
-					for _, label := range about.PrefLabel {
-						if label != "" {
-							parts = append(parts, label)
-						}
-					}
-				}
-			}
-		case "creator":
-			for _, creator := range amb.Creator {
-				if creator != nil && creator.Name != "" {
-					parts = append(parts, creator.Name)
-				}
-			}
-		case "publisher":
-			for _, publisher := range amb.Publisher {
-				if publisher != nil && publisher.Name != "" {
-					parts = append(parts, publisher.Name)
-				}
-			}
-		case "learningResourceType":
-			for _, lrt := range amb.LearningResourceType {
-				if lrt != nil && lrt.PrefLabel != nil {
-					for _, label := range lrt.PrefLabel {
-						if label != "" {
-							parts = append(parts, label)
-						}
-					}
-				}
-			}
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
+
+// EmbedFieldNames are the AMB metadata fields that can be embedded.
+var EmbedFieldNames = []string{"name", "description", "keywords", "about", "creator", "publisher", "learningResourceType"}
+
+// MaxEmbedFieldWeight limits how often a field can be repeated in the embedded text.
+const MaxEmbedFieldWeight = 5
+
+// ValidateSemanticConfig checks the field names and weights of cfg.
+func ValidateSemanticConfig(cfg SemanticConfig) error {
+	for _, field := range cfg.EmbedFields {
+		if !slices.Contains(EmbedFieldNames, field) {
+			return fmt.Errorf("unknown embed field %q", field)
 		}
 	}
+	for field, weight := range cfg.FieldWeights {
+		if !slices.Contains(EmbedFieldNames, field) {
+			return fmt.Errorf("unknown embed field %q in field_weights", field)
+		}
+		if weight < 1 || weight > MaxEmbedFieldWeight {
+			return fmt.Errorf("weight of %q must be between 1 and %d", field, MaxEmbedFieldWeight)
+		}
+	}
+	return nil
+}
 
-	text := strings.Join(parts, EmbedFieldSeparator)
-	if len(text) > EmbedMaxLength {
-		text = text[:EmbedMaxLength]
+// WeightedEmbedFields returns the embed fields with each field repeated
+// according to its weight, which is how weights reach the search backend.
+func WeightedEmbedFields(cfg SemanticConfig) []string {
+	var fields []string
+	for _, field := range cfg.EmbedFields {
+		for range max(1, cfg.FieldWeights[field]) {
+			fields = append(fields, field)
+		}
 	}
-	return text
+	return fields
 }
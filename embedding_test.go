@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestEmbeddingClient returns a client for provider with a backoff short
+// enough for tests.
+func newTestEmbeddingClient(t *testing.T, provider EmbeddingProviderConfig) *EmbeddingClient {
+	t.Helper()
+	if err := provider.Validate(); err != nil {
+		t.Fatalf("invalid provider: %v", err)
+	}
+	client := NewEmbeddingClient(provider)
+	client.RetryBackoff = time.Millisecond
+	return client
+}
+
+func TestEmbeddingClientProviders(t *testing.T) {
+	tests := []struct {
+		provider string
+		model    string
+		// respond answers a request for texts
+		respond func(t *testing.T, body map[string]any) any
+	}{
+		{EmbedProviderEdufeed, "", func(t *testing.T, body map[string]any) any {
+			texts := body["texts"].([]any)
+			return map[string]any{"embeddings": testVectors(len(texts))}
+		}},
+		{EmbedProviderOpenAI, "text-embedding-3-small", func(t *testing.T, body map[string]any) any {
+			if body["model"] != "text-embedding-3-small" {
+				t.Errorf("model = %v", body["model"])
+			}
+			// Entries are returned out of order and placed by index
+			input := body["input"].([]any)
+			vectors := testVectors(len(input))
+			var data []map[string]any
+			for i := len(input) - 1; i >= 0; i-- {
+				data = append(data, map[string]any{"index": i, "embedding": vectors[i]})
+			}
+			return map[string]any{"data": data}
+		}},
+		{EmbedProviderOllama, "nomic-embed-text", func(t *testing.T, body map[string]any) any {
+			if body["model"] != "nomic-embed-text" {
+				t.Errorf("model = %v", body["model"])
+			}
+			return map[string]any{"embeddings": testVectors(len(body["input"].([]any)))}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.provider, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+					t.Errorf("Authorization = %q", got)
+				}
+				var body map[string]any
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					t.Errorf("decode request: %v", err)
+				}
+				writeJSON(w, http.StatusOK, tt.respond(t, body))
+			}))
+			defer srv.Close()
+
+			client := newTestEmbeddingClient(t, EmbeddingProviderConfig{Provider: tt.provider, Endpoint: srv.URL, Model: tt.model, Token: "secret"})
+			vectors, err := client.Embed(context.Background(), []string{"a", "b", "c"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(vectors) != 3 {
+				t.Fatalf("got %d vectors, want 3", len(vectors))
+			}
+			for i, v := range vectors {
+				if v[0] != float32(i) {
+					t.Errorf("vector %d = %v, want it to start with %d", i, v, i)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenAIProviderRejectsIncompleteResponse(t *testing.T) {
+	for name, body := range map[string]string{
+		"missing entry":   `{"data": [{"index": 0, "embedding": [1]}]}`,
+		"duplicate index": `{"data": [{"index": 0, "embedding": [1]}, {"index": 0, "embedding": [2]}]}`,
+		"null embedding":  `{"data": [{"index": 0, "embedding": [1]}, {"index": 1, "embedding": null}]}`,
+	} {
+		if _, err := (openAIProvider{}).decodeResponse(strings.NewReader(body), 2); err == nil {
+			t.Errorf("%s: decodeResponse succeeded, want an error", name)
+		}
+	}
+}
+
+// testVectors returns n two-dimensional vectors whose first component is their index.
+func testVectors(n int) [][]float32 {
+	vectors := make([][]float32, n)
+	for i := range vectors {
+		vectors[i] = []float32{float32(i), 1}
+	}
+	return vectors
+}
+
+func TestEmbeddingClientRetries(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			http.Error(w, "warming up", http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"embeddings": testVectors(1)})
+	}))
+	defer srv.Close()
+
+	client := newTestEmbeddingClient(t, EmbeddingProviderConfig{Provider: EmbedProviderEdufeed, Endpoint: srv.URL})
+	if _, err := client.Embed(context.Background(), []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 3 || client.Retries() != 2 {
+		t.Errorf("calls = %d, retries = %d, want 3 and 2", calls.Load(), client.Retries())
+	}
+}
+
+func TestEmbeddingClientNoRetryOnClientError(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "bad input", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	client := newTestEmbeddingClient(t, EmbeddingProviderConfig{Provider: EmbedProviderEdufeed, Endpoint: srv.URL})
+	_, err := client.Embed(context.Background(), []string{"a"})
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Fatalf("Embed error = %v, want a 400 error", err)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("calls = %d, want 1", calls.Load())
+	}
+}
+
+func TestEmbeddingClientRetryAfterLimit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "120")
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	client := newTestEmbeddingClient(t, EmbeddingProviderConfig{Provider: EmbedProviderEdufeed, Endpoint: srv.URL})
+	start := time.Now()
+	_, err := client.Embed(context.Background(), []string{"a"})
+	if err == nil || !strings.Contains(err.Error(), "exceeds limit") {
+		t.Fatalf("Embed error = %v, want the retry delay to exceed the limit", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("Embed waited for a Retry-After beyond MaxRetryDelay")
+	}
+}
+
+func TestEmbeddingClientVectorCountMismatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"embeddings": testVectors(1)})
+	}))
+	defer srv.Close()
+
+	client := newTestEmbeddingClient(t, EmbeddingProviderConfig{Provider: EmbedProviderEdufeed, Endpoint: srv.URL})
+	if _, err := client.Embed(context.Background(), []string{"a", "b"}); err == nil {
+		t.Fatal("Embed accepted 1 vector for 2 texts")
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if got := parseRetryAfter("3"); got != 3*time.Second {
+		t.Errorf("parseRetryAfter(3) = %s", got)
+	}
+	if got := parseRetryAfter(""); got != 0 {
+		t.Errorf("parseRetryAfter(\"\") = %s", got)
+	}
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(date); got < 58*time.Second || got > time.Minute {
+		t.Errorf("parseRetryAfter(%s) = %s, want about a minute", date, got)
+	}
+}
+
+func TestHashEmbed(t *testing.T) {
+	client := newTestEmbeddingClient(t, EmbeddingProviderConfig{Provider: EmbedProviderHash, Dimensions: 64})
+	texts := []string{"Quantum physics for beginners", "quantum PHYSICS, for beginners!", "Medieval history"}
+	vectors, err := client.Embed(context.Background(), texts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range vectors {
+		if len(v) != 64 {
+			t.Fatalf("vector %d has %d dimensions, want 64", i, len(v))
+		}
+		var norm float64
+		for _, x := range v {
+			norm += float64(x) * float64(x)
+		}
+		if math.Abs(norm-1) > 1e-5 {
+			t.Errorf("vector %d has norm %f, want 1", i, norm)
+		}
+	}
+	if cosineDistance(toFloat64(vectors[0]), toFloat64(vectors[1])) > 1e-6 {
+		t.Error("texts differing in case and punctuation got different vectors")
+	}
+	if cosineDistance(toFloat64(vectors[0]), toFloat64(vectors[2])) < 0.5 {
+		t.Error("unrelated texts got similar vectors")
+	}
+	if got := client.Provider().ModelID(); got != "hash:64" {
+		t.Errorf("ModelID = %q, want hash:64", got)
+	}
+}
+
+func toFloat64(v []float32) []float64 {
+	out := make([]float64, len(v))
+	for i, x := range v {
+		out[i] = float64(x)
+	}
+	return out
+}
+
+func TestWeightedEmbedFields(t *testing.T) {
+	cfg := SemanticConfig{EmbedFields: []string{"name", "creator"}, FieldWeights: map[string]int{"name": 2}}
+	if got, want := WeightedEmbedFields(cfg), []string{"name", "name", "creator"}; !slices.Equal(got, want) {
+		t.Errorf("WeightedEmbedFields = %v, want %v", got, want)
+	}
+}
+
+func TestValidateSemanticConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  SemanticConfig
+		ok   bool
+	}{
+		{"default", DefaultSemanticConfig(), true},
+		{"unknown field", SemanticConfig{EmbedFields: []string{"title"}}, false},
+		{"unknown weighted field", SemanticConfig{FieldWeights: map[string]int{"title": 2}}, false},
+		{"weight too high", SemanticConfig{FieldWeights: map[string]int{"name": MaxEmbedFieldWeight + 1}}, false},
+		{"weight zero", SemanticConfig{FieldWeights: map[string]int{"name": 0}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateSemanticConfig(tt.cfg); (err == nil) != tt.ok {
+				t.Errorf("ValidateSemanticConfig = %v, want ok=%v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestEmbeddingProviderValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  EmbeddingProviderConfig
+		ok   bool
+	}{
+		{"edufeed", EmbeddingProviderConfig{Provider: EmbedProviderEdufeed, Endpoint: "http://embed"}, true},
+		{"missing endpoint", EmbeddingProviderConfig{Provider: EmbedProviderEdufeed}, false},
+		{"openai without model", EmbeddingProviderConfig{Provider: EmbedProviderOpenAI, Endpoint: "http://embed"}, false},
+		{"unknown provider", EmbeddingProviderConfig{Provider: "cohere", Endpoint: "http://embed"}, false},
+		{"hash", EmbeddingProviderConfig{Provider: EmbedProviderHash}, true},
+		{"hash with negative dimensions", EmbeddingProviderConfig{Provider: EmbedProviderHash, Dimensions: -1}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.Validate(); (err == nil) != tt.ok {
+				t.Errorf("Validate = %v, want ok=%v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestChunkingEmbedderCountsTruncatedTexts(t *testing.T) {
+	var inputs int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Texts []string `json:"texts"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		inputs += len(body.Texts)
+		writeJSON(w, http.StatusOK, map[string]any{"embeddings": testVectors(len(body.Texts))})
+	}))
+	defer srv.Close()
+	client := newTestEmbeddingClient(t, EmbeddingProviderConfig{Provider: EmbedProviderEdufeed, Endpoint: srv.URL})
+	c := NewChunkingEmbedder(client, 2, 3)
+
+	// Each word is a chunk of two estimated tokens
+	fits := "aaaaaaaa bbbbbbbb cccccccc"
+	long := fits + " dddddddd eeeeeeee"
+	if _, err := c.Embed(context.Background(), []string{fits}); err != nil {
+		t.Fatal(err)
+	}
+	if c.Truncated() != 0 {
+		t.Errorf("truncated = %d after a text that fits, want 0", c.Truncated())
+	}
+	inputs = 0
+	if _, err := c.Embed(context.Background(), []string{long}); err != nil {
+		t.Fatal(err)
+	}
+	if inputs != 3 || c.Truncated() != 1 {
+		t.Errorf("embedded %d chunks, truncated = %d, want 3 chunks and 1 truncated text", inputs, c.Truncated())
+	}
+}
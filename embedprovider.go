@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// Embedding providers selectable with EMBED_PROVIDER or setembeddingprovider.
+const (
+	EmbedProviderEdufeed = "edufeed" // {"texts": [...]} -> {"embeddings": [...]}
+	EmbedProviderOpenAI  = "openai"  // OpenAI-compatible POST /v1/embeddings
+	EmbedProviderOllama  = "ollama"  // Ollama POST /api/embed
+	EmbedProviderHash    = "hash"    // local deterministic vectors, for testing only
+)
+
+// EmbeddingProviderConfig selects the embedding host and its wire format.
+type EmbeddingProviderConfig struct {
+	Provider string `json:"provider"`
+	Endpoint string `json:"endpoint"`
+	Model    string `json:"model,omitempty"`
+	Token    string `json:"token,omitempty"`
+	// Dimensions is the vector size of the hash provider, 0 for DefaultHashDimensions.
+	Dimensions int `json:"dimensions,omitempty"`
+}
+
+// Validate checks that the provider is known and has what it needs to make requests.
+func (p EmbeddingProviderConfig) Validate() error {
+	if p.Provider == EmbedProviderHash {
+		if p.Dimensions < 0 {
+			return fmt.Errorf("invalid dimensions %d", p.Dimensions)
+		}
+		return nil
+	}
+	if _, ok := embedProviders[p.Provider]; !ok {
+		return fmt.Errorf("unknown embedding provider %q", p.Provider)
+	}
+	if p.Endpoint == "" {
+		return fmt.Errorf("missing endpoint")
+	}
+	if p.Provider != EmbedProviderEdufeed && p.Model == "" {
+		return fmt.Errorf("provider %q requires a model", p.Provider)
+	}
+	return nil
+}
+
+// Configured reports whether the configuration can produce vectors. All
+// providers but hash need an endpoint.
+func (p EmbeddingProviderConfig) Configured() bool {
+	return p.Endpoint != "" || p.Provider == EmbedProviderHash
+}
+
+// HashDimensions returns the vector size of the hash provider.
+func (p EmbeddingProviderConfig) HashDimensions() int {
+	if p.Dimensions > 0 {
+		return p.Dimensions
+	}
+	return DefaultHashDimensions
+}
+
+// ModelID identifies the vectors this configuration produces. Vectors from
+// different model IDs are not comparable.
+func (p EmbeddingProviderConfig) ModelID() string {
+	if p.Provider == EmbedProviderHash {
+		return fmt.Sprintf("%s:%d", p.Provider, p.HashDimensions())
+	}
+	model := p.Model
+	if model == "" {
+		model = p.Endpoint
+	}
+	return p.Provider + ":" + model
+}
+
+// Redacted returns a copy safe to return over the management API.
+func (p EmbeddingProviderConfig) Redacted() EmbeddingProviderConfig {
+	if p.Token != "" {
+		p.Token = "***"
+	}
+	return p
+}
+
+// embedProvider encodes requests and decodes responses for one wire format.
+type embedProvider interface {
+	encodeRequest(model string, texts []string) ([]byte, error)
+	decodeResponse(body io.Reader, n int) ([][]float32, error)
+}
+
+var embedProviders = map[string]embedProvider{
+	EmbedProviderEdufeed: edufeedProvider{},
+	EmbedProviderOpenAI:  openAIProvider{},
+	EmbedProviderOllama:  ollamaProvider{},
+}
+
+// EmbedProviderNames returns the names of the supported providers.
+func EmbedProviderNames() []string {
+	names := []string{EmbedProviderHash}
+	for name := range embedProviders {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+type edufeedProvider struct{}
+
+func (edufeedProvider) encodeRequest(model string, texts []string) ([]byte, error) {
+	return json.Marshal(struct {
+		Texts []string `json:"texts"`
+	}{texts})
+}
+
+func (edufeedProvider) decodeResponse(body io.Reader, n int) ([][]float32, error) {
+	var result struct {
+		Embeddings [][]float32 `json:"embeddings"`
+	}
+	if err := json.NewDecoder(body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.Embeddings, nil
+}
+
+type openAIProvider struct{}
+
+func (openAIProvider) encodeRequest(model string, texts []string) ([]byte, error) {
+	return json.Marshal(struct {
+		Model string   `json:"model"`
+		Input []string `json:"input"`
+	}{model, texts})
+}
+
+func (openAIProvider) decodeResponse(body io.Reader, n int) ([][]float32, error) {
+	var result struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if len(result.Data) != n {
+		return nil, fmt.Errorf("embedding service returned %d vectors for %d texts", len(result.Data), n)
+	}
+	// Entries carry their input position and are not guaranteed to be in order
+	embeddings := make([][]float32, n)
+	for _, d := range result.Data {
+		if d.Index < 0 || d.Index >= n {
+			return nil, fmt.Errorf("embedding index %d out of range", d.Index)
+		}
+		embeddings[d.Index] = d.Embedding
+	}
+	for i, embedding := range embeddings {
+		if embedding == nil {
+			return nil, fmt.Errorf("no embedding for input %d", i)
+		}
+	}
+	return embeddings, nil
+}
+
+type ollamaProvider struct{}
+
+func (ollamaProvider) encodeRequest(model string, texts []string) ([]byte, error) {
+	return json.Marshal(struct {
+		Model string   `json:"model"`
+		Input []string `json:"input"`
+	}{model, texts})
+}
+
+func (ollamaProvider) decodeResponse(body io.Reader, n int) ([][]float32, error) {
+	var result struct {
+		Embeddings [][]float32 `json:"embeddings"`
+	}
+	if err := json.NewDecoder(body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.Embeddings, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// DefaultHashDimensions matches the vector size of the default collection schema.
+const DefaultHashDimensions = 384
+
+// hashEmbed returns deterministic vectors for texts without calling a
+// service: every lowercased word is hashed to one of dims positions with a
+// hashed sign, and the sums are normalized to unit length. Texts sharing words
+// get similar vectors, which is enough to exercise vector and hybrid search
+// in tests and offline development, but carries no semantic meaning.
+func hashEmbed(texts []string, dims int) [][]float32 {
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		vector := make([]float32, dims)
+		words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+		})
+		for _, word := range words {
+			h := fnv.New64a()
+			h.Write([]byte(word))
+			sum := h.Sum64()
+			if sum>>63 == 1 {
+				vector[sum%uint64(dims)]--
+			} else {
+				vector[sum%uint64(dims)]++
+			}
+		}
+		var norm float64
+		for _, x := range vector {
+			norm += float64(x) * float64(x)
+		}
+		if norm > 0 {
+			scale := float32(1 / math.Sqrt(norm))
+			for j := range vector {
+				vector[j] *= scale
+			}
+		}
+		vectors[i] = vector
+	}
+	return vectors
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	// readyTimeout bounds each readiness check, so a hanging dependency fails
+	// the probe instead of stalling it.
+	readyTimeout = 2 * time.Second
+	// readyEmbedInterval is how long the result of an embedding request made
+	// by /readyz is reused, so frequent probes do not call a paid service.
+	readyEmbedInterval = time.Minute
+	// readyEmbedRetryInterval is how long a failed embedding request is
+	// reused, shorter so a recovered service is noticed soon.
+	readyEmbedRetryInterval = 10 * time.Second
+)
+
+// ReadyCheck is the result of one readiness check.
+type ReadyCheck struct {
+	OK bool `json:"ok"`
+	// Skipped is set for checks that do not apply, e.g. the embedding
+	// service while semantic search is off.
+	Skipped bool `json:"skipped,omitempty"`
+	// Degraded is set for failures the relay works around, e.g. by falling
+	// back to keyword search. They do not fail readiness.
+	Degraded bool   `json:"degraded,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// degradedError marks a check error as degraded.
+type degradedError struct{ error }
+
+func (e degradedError) Unwrap() error { return e.error }
+
+// ReadyStatus is the body of /readyz.
+type ReadyStatus struct {
+	Ready  bool                  `json:"ready"`
+	Checks map[string]ReadyCheck `json:"checks"`
+}
+
+// embedProbe caches the last embedding request of /readyz for the provider
+// it was made with.
+type embedProbe struct {
+	mu       sync.Mutex
+	provider EmbeddingProviderConfig
+	checked  time.Time
+	err      error
+}
+
+// serveHealthz reports that the process is alive and serving HTTP.
+func (r *AMBRelay) serveHealthz(w http.ResponseWriter, req *http.Request) {
+	writeHealthJSON(w, http.StatusOK, map[string]any{
+		"status":  "ok",
+		"version": getVersion(),
+		"uptime":  int64(time.Since(r.started).Seconds()),
+	})
+}
+
+// serveReadyz reports whether the relay can serve reads and writes, with
+// the result of each check. It answers 503 if any check fails.
+func (r *AMBRelay) serveReadyz(w http.ResponseWriter, req *http.Request) {
+	status := r.Ready(req.Context())
+	code := http.StatusOK
+	if !status.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeHealthJSON(w, code, status)
+}
+
+// Ready runs the readiness checks concurrently: BoltDB takes writes and
+// the Typesense collection is reachable. The embedding service is checked if
+// semantic search is enabled, but only reported as degraded when it fails,
+// since indexing and search fall back to keywords. A reindex does not affect
+// readiness: its swap is a single alias update.
+func (r *AMBRelay) Ready(ctx context.Context) ReadyStatus {
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+
+	checks := map[string]func(context.Context) (skipped bool, err error){
+		"boltdb":    r.checkBoltWritable,
+		"typesense": r.checkTypesense,
+		"embedding": r.checkEmbedding,
+	}
+	status := ReadyStatus{Ready: true, Checks: map[string]ReadyCheck{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Go(func() {
+			skipped, err := check(ctx)
+			result := ReadyCheck{OK: err == nil, Skipped: skipped}
+			if err != nil {
+				result.Error = err.Error()
+				result.Degraded = errors.As(err, new(degradedError))
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			status.Checks[name] = result
+			if err != nil && !result.Degraded {
+				status.Ready = false
+			}
+		})
+	}
+	wg.Wait()
+	return status
+}
+
+// checkBoltWritable commits an empty write transaction, which needs the
+// writer lock and writes the meta page.
+func (r *AMBRelay) checkBoltWritable(ctx context.Context) (bool, error) {
+	r.writeMu.RLock()
+	closing := r.closing
+	r.writeMu.RUnlock()
+	if closing {
+		return false, errShuttingDown
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- r.boltDB.DB.Update(func(tx *bbolt.Tx) error { return nil })
+	}()
+	select {
+	case err := <-done:
+		return false, err
+	case <-ctx.Done():
+		return false, errors.New("timed out waiting for the write lock")
+	}
+}
+
+func (r *AMBRelay) checkTypesense(ctx context.Context) (bool, error) {
+	fields, err := r.readyAdmin.CollectionFields(r.tsDB.CollectionName)
+	if err != nil {
+		return false, err
+	}
+	if fields == nil {
+		return false, fmt.Errorf("collection %s not found", r.tsDB.CollectionName)
+	}
+	return false, nil
+}
+
+// checkEmbedding reports the embedding service as degraded while the circuit
+// breaker is open, and otherwise embeds a probe text through the breaker, so
+// failed probes count towards opening it.
+func (r *AMBRelay) checkEmbedding(ctx context.Context) (bool, error) {
+	cfg, err := r.mgmt.LoadSemanticConfig()
+	if err != nil {
+		return false, err
+	}
+	if !cfg.Enabled || !r.embedClient.Configured() {
+		return true, nil
+	}
+	if r.embedBreaker.IsOpen() {
+		return false, degradedError{errors.New("circuit breaker open after repeated failures, using keyword search")}
+	}
+
+	p := &r.embedProbe
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	provider := r.embedClient.Provider()
+	interval := readyEmbedInterval
+	if p.err != nil {
+		interval = readyEmbedRetryInterval
+	}
+	if provider != p.provider || time.Since(p.checked) >= interval {
+		_, err = r.embedBreaker.Embed(ctx, []string{"readiness probe"})
+		if err != nil {
+			err = degradedError{err}
+		}
+		p.provider, p.checked, p.err = provider, time.Now(), err
+	}
+	return false, p.err
+}
+
+func writeHealthJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
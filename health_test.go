@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// getReadyz serves /readyz through r and decodes the body.
+func getReadyz(t *testing.T, r *AMBRelay) (int, ReadyStatus) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var status ReadyStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("decode /readyz %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, status
+}
+
+func TestRelayHealthz(t *testing.T) {
+	r := newTestRelay(t, newFakeTypesense(t), "amb")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	var body map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode /healthz %q: %v", rec.Body.String(), err)
+	}
+	if rec.Code != http.StatusOK || body["status"] != "ok" {
+		t.Errorf("/healthz = %d %v, want 200 and status ok", rec.Code, body)
+	}
+}
+
+func TestRelayReadyz(t *testing.T) {
+	ts := newFakeTypesense(t)
+	r := newTestRelay(t, ts, "amb")
+
+	code, status := getReadyz(t, r)
+	if code != http.StatusOK || !status.Ready {
+		t.Fatalf("/readyz = %d %+v, want ready", code, status)
+	}
+	for _, name := range []string{"boltdb", "typesense"} {
+		if check := status.Checks[name]; !check.OK || check.Skipped {
+			t.Errorf("%s check = %+v, want ok", name, check)
+		}
+	}
+	if check := status.Checks["embedding"]; !check.OK || !check.Skipped {
+		t.Errorf("embedding check = %+v, want skipped while semantic search is off", check)
+	}
+
+	// The hash provider is always reachable
+	if err := r.mgmt.SaveSemanticConfig(SemanticConfig{Enabled: true, EmbedFields: DefaultSemanticConfig().EmbedFields}); err != nil {
+		t.Fatal(err)
+	}
+	if _, status := getReadyz(t, r); !status.Checks["embedding"].OK || status.Checks["embedding"].Skipped {
+		t.Errorf("embedding check = %+v, want ok", status.Checks["embedding"])
+	}
+
+	ts.Close()
+	code, status = getReadyz(t, r)
+	if code != http.StatusServiceUnavailable || status.Ready {
+		t.Errorf("/readyz without Typesense = %d, want 503", code)
+	}
+	if check := status.Checks["typesense"]; check.OK || check.Error == "" {
+		t.Errorf("typesense check = %+v, want an error", check)
+	}
+	if !status.Checks["boltdb"].OK {
+		t.Errorf("boltdb check = %+v, want ok", status.Checks["boltdb"])
+	}
+}
+
+func TestRelayReadyzEmbeddingDown(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "down", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	cfg := testRelayConfig(t, newFakeTypesense(t), "amb")
+	cfg.EmbedProvider = EmbeddingProviderConfig{Provider: EmbedProviderEdufeed, Endpoint: srv.URL}
+	cfg.EmbedMaxRetries = 0
+	cfg.EmbedBreakerThreshold = 2
+	cfg.SemanticSearchEnabled = true
+	r := newTestRelayWith(t, cfg)
+
+	// Search falls back to keywords, so the relay stays ready
+	code, status := getReadyz(t, r)
+	if check := status.Checks["embedding"]; code != http.StatusOK || !status.Ready || check.OK || !check.Degraded {
+		t.Fatalf("/readyz = %d %+v, want 200 with a degraded embedding check", code, status)
+	}
+	before := requests.Load()
+	getReadyz(t, r)
+	if n := requests.Load() - before; n != 0 {
+		t.Errorf("second probe made %d embedding requests, want the result reused", n)
+	}
+
+	// The probe goes through the breaker, which opens on the next failure
+	r.embedProbe.mu.Lock()
+	r.embedProbe.checked = time.Time{}
+	r.embedProbe.mu.Unlock()
+	getReadyz(t, r)
+	if !r.embedBreaker.IsOpen() {
+		t.Fatal("failed probes did not open the breaker")
+	}
+	code, status = getReadyz(t, r)
+	if check := status.Checks["embedding"]; code != http.StatusOK || !check.Degraded {
+		t.Errorf("/readyz with the breaker open = %d %+v, want 200 with a degraded embedding check", code, status)
+	}
+}
+
+func TestRelayReadyzDuringShutdown(t *testing.T) {
+	r := newTestRelay(t, newFakeTypesense(t), "amb")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r.writeMu.Lock()
+	r.closing = true
+	r.writeMu.Unlock()
+	if status := r.Ready(ctx); status.Ready || status.Checks["boltdb"].Error != errShuttingDown.Error() {
+		t.Errorf("Ready while shutting down = %+v, want a failed boltdb check", status)
+	}
+}
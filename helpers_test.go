@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore/boltdb"
+	"fiatjaf.com/nostr/eventstore/typesense30142"
+)
+
+// newTestBolt opens a BoltDB event store in a temporary directory, closed
+// when the test ends.
+func newTestBolt(t *testing.T) *boltdb.BoltBackend {
+	t.Helper()
+	db := &boltdb.BoltBackend{Path: filepath.Join(t.TempDir(), "events.db")}
+	if err := db.Init(); err != nil {
+		t.Fatalf("init boltdb: %v", err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
+
+// newTestManagement returns a ManagementStore on the BoltDB of db.
+func newTestManagement(t *testing.T, db *boltdb.BoltBackend) *ManagementStore {
+	t.Helper()
+	mgmt := &ManagementStore{}
+	if err := mgmt.Init(db.DB); err != nil {
+		t.Fatalf("init management store: %v", err)
+	}
+	return mgmt
+}
+
+// newTestTSBackend returns an initialized TSBackend on the fake Typesense.
+func newTestTSBackend(t *testing.T, ts *fakeTypesense, collection string) *typesense30142.TSBackend {
+	t.Helper()
+	tsDB := &typesense30142.TSBackend{
+		ApiKey:         fakeTypesenseAPIKey,
+		Host:           ts.URL,
+		CollectionName: collection,
+	}
+	if err := tsDB.Init(); err != nil {
+		t.Fatalf("init typesense backend: %v", err)
+	}
+	return tsDB
+}
+
+// testPubKey returns a fixed pubkey derived from seed.
+func testPubKey(seed string) nostr.PubKey {
+	return nostr.PubKey(sha256.Sum256([]byte("pubkey:" + seed)))
+}
+
+// makeEvent returns a kind 30142 event with the given d and name tags. The
+// ID is derived from the content so equal arguments give equal events;
+// events are not signed, which nothing under test checks.
+func makeEvent(pubkey nostr.PubKey, d, name string, createdAt nostr.Timestamp) nostr.Event {
+	event := nostr.Event{
+		PubKey:    pubkey,
+		CreatedAt: createdAt,
+		Kind:      30142,
+		Tags:      nostr.Tags{{"d", d}, {"name", name}},
+	}
+	event.ID = nostr.ID(sha256.Sum256(fmt.Appendf(nil, "%s:%s:%s:%d", pubkey.Hex(), d, name, createdAt)))
+	return event
+}
+
+// saveEvents stores events in db.
+func saveEvents(t *testing.T, db *boltdb.BoltBackend, events ...nostr.Event) {
+	t.Helper()
+	for _, event := range events {
+		if err := db.SaveEvent(event); err != nil {
+			t.Fatalf("save event: %v", err)
+		}
+	}
+}
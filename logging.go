@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"fiatjaf.com/nostr/khatru"
+)
+
+// Log formats selectable with LOG_FORMAT.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// redacted replaces secrets in log records.
+const redacted = "[REDACTED]"
+
+// NewLogger returns a logger writing to w at level (debug, info, warn or
+// error) in format (text or json). Empty values mean info and text; invalid
+// ones are reported through the returned logger and fall back the same way.
+// Secrets registered with addLogSecret are redacted from every record.
+func NewLogger(w io.Writer, level, format string) *slog.Logger {
+	var lvl slog.Level
+	var levelErr error
+	if level != "" {
+		levelErr = lvl.UnmarshalText([]byte(level))
+	}
+	opts := &slog.HandlerOptions{Level: lvl, ReplaceAttr: redactAttr}
+
+	var handler slog.Handler
+	validFormat := true
+	switch strings.ToLower(format) {
+	case "", LogFormatText:
+		handler = slog.NewTextHandler(w, opts)
+	case LogFormatJSON:
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		validFormat = false
+		handler = slog.NewTextHandler(w, opts)
+	}
+
+	logger := slog.New(handler)
+	if levelErr != nil {
+		logger.Warn("invalid LOG_LEVEL, using info", "value", level)
+	}
+	if !validFormat {
+		logger.Warn("invalid LOG_FORMAT, using text", "value", format)
+	}
+	return logger
+}
+
+// logSecrets holds the values redacted from log records: the Typesense API
+// key, bearer tokens of embedding providers and the metrics token. It is
+// shared by all relays of the process, since the default logger is.
+var logSecrets struct {
+	mu       sync.RWMutex
+	values   []string
+	replacer *strings.Replacer
+}
+
+// addLogSecret registers a value to redact from log records. Empty values are ignored.
+func addLogSecret(secret string) {
+	if secret == "" {
+		return
+	}
+	logSecrets.mu.Lock()
+	defer logSecrets.mu.Unlock()
+	if slices.Contains(logSecrets.values, secret) {
+		return
+	}
+	logSecrets.values = append(logSecrets.values, secret)
+	var pairs []string
+	for _, v := range logSecrets.values {
+		pairs = append(pairs, v, redacted)
+	}
+	logSecrets.replacer = strings.NewReplacer(pairs...)
+}
+
+func redactSecrets(s string) string {
+	logSecrets.mu.RLock()
+	defer logSecrets.mu.RUnlock()
+	if logSecrets.replacer == nil {
+		return s
+	}
+	return logSecrets.replacer.Replace(s)
+}
+
+// secretLogKeys are attribute keys whose values are always redacted.
+var secretLogKeys = map[string]bool{
+	"token":         true,
+	"api_key":       true,
+	"apikey":        true,
+	"authorization": true,
+}
+
+// redactAttr is the ReplaceAttr of the log handlers. It redacts registered
+// secrets from the message, string values and errors, and the whole value of
+// attributes named like a credential.
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if secretLogKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, redacted)
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		a.Value = slog.StringValue(redactSecrets(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			a.Value = slog.StringValue(redactSecrets(err.Error()))
+		}
+	}
+	return a
+}
+
+type connIDKey struct{}
+
+// ServeHTTP tags each request with a connection id before khatru handles it,
+// so the log lines of a websocket connection or a NIP-86 call can be told apart.
+func (r *AMBRelay) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx := context.WithValue(req.Context(), connIDKey{}, newConnID())
+	r.Relay.ServeHTTP(w, req.WithContext(ctx))
+}
+
+func newConnID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// connID returns the connection id of ctx, or "" outside of a request.
+func connID(ctx context.Context) string {
+	if id, ok := ctx.Value(connIDKey{}).(string); ok {
+		return id
+	}
+	// khatru runs websocket handlers on a context of its own, keeping the
+	// upgrade request on the connection
+	if ws := khatru.GetConnection(ctx); ws != nil && ws.Request != nil {
+		id, _ := ws.Request.Context().Value(connIDKey{}).(string)
+		return id
+	}
+	return ""
+}
+
+// ctxLogger returns the default logger with the connection and subscription
+// ids of ctx, if it has them.
+func ctxLogger(ctx context.Context) *slog.Logger {
+	logger := slog.Default()
+	if id := connID(ctx); id != "" {
+		logger = logger.With("conn", id)
+	}
+	if sub := khatru.GetSubscriptionID(ctx); sub != "" {
+		logger = logger.With("sub", sub)
+	}
+	return logger
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, "debug", "json")
+	logger.Debug("req", "conn", "c1", "events", 3)
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("LOG_FORMAT=json wrote %q: %v", buf.String(), err)
+	}
+	if record["msg"] != "req" || record["level"] != "DEBUG" || record["conn"] != "c1" || record["events"] != 3.0 {
+		t.Errorf("record = %v", record)
+	}
+
+	buf.Reset()
+	logger = NewLogger(&buf, "", "")
+	logger.Debug("hidden")
+	logger.Info("shown")
+	if out := buf.String(); strings.Contains(out, "hidden") || !strings.Contains(out, "level=INFO msg=shown") {
+		t.Errorf("default logger wrote %q, want info and above as text", out)
+	}
+
+	buf.Reset()
+	logger = NewLogger(&buf, "verbose", "xml")
+	logger.Debug("hidden")
+	out := buf.String()
+	if !strings.Contains(out, "invalid LOG_LEVEL") || !strings.Contains(out, "invalid LOG_FORMAT") || strings.Contains(out, "hidden") {
+		t.Errorf("invalid settings wrote %q, want both reported and info level", out)
+	}
+}
+
+func TestLoggerRedactsSecrets(t *testing.T) {
+	addLogSecret("ts-secret-key")
+	addLogSecret("embed-bearer-token")
+	addLogSecret("")
+
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, "info", "json")
+	logger.Info("connecting with ts-secret-key",
+		"url", "http://typesense/?x-typesense-api-key=ts-secret-key",
+		"err", errors.New("401 for Bearer embed-bearer-token"),
+		"token", "unregistered-token",
+	)
+	out := buf.String()
+	for _, secret := range []string{"ts-secret-key", "embed-bearer-token", "unregistered-token"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("log contains %q: %s", secret, out)
+		}
+	}
+	if n := strings.Count(out, redacted); n != 4 {
+		t.Errorf("log has %d redactions, want 4: %s", n, out)
+	}
+}
+
+func TestRelayConnectionIDs(t *testing.T) {
+	r := newTestRelay(t, newFakeTypesense(t), "amb")
+	var ids []string
+	r.Router().HandleFunc("GET /probe", func(w http.ResponseWriter, req *http.Request) {
+		ids = append(ids, connID(req.Context()))
+	})
+	for range 2 {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/probe", nil))
+	}
+	if len(ids) != 2 || ids[0] == "" || ids[0] == ids[1] {
+		t.Errorf("connection ids = %q, want two distinct ids", ids)
+	}
+}
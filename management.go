@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/binary"
 	"encoding/json"
+	"fmt"
 
 	"fiatjaf.com/nostr"
 	"fiatjaf.com/nostr/eventstore/typesense30142"
@@ -14,15 +16,38 @@ var (
 	bucketBannedEvents    = []byte("banned_events")
 	bucketTypesenseSchema = []byte("typesense_schema")
 	bucketSemanticConfig  = []byte("semantic_config")
+	bucketCollections     = []byte("typesense_collections")
+	bucketReindexState    = []byte("reindex_state")
+	bucketReindexHistory  = []byte("reindex_history")
+	bucketUnembedded      = []byte("unembedded_events")
 )
 
 const schemaKey = "current"
 const semanticConfigKey = "config"
+const embeddingProviderKey = "provider"
+const collectionsKey = "versions"
+const reindexCheckpointKey = "checkpoint"
+
+// reindexHistoryLimit is the number of finished reindex jobs kept in BoltDB.
+const reindexHistoryLimit = 50
+
+// CollectionVersions records which versioned Typesense collections the
+// TS_COLLECTION alias points to now and pointed to before the last swap.
+type CollectionVersions struct {
+	Current  string `json:"current,omitempty"`
+	Previous string `json:"previous,omitempty"`
+}
 
 // SemanticConfig stores the configuration for semantic search.
 type SemanticConfig struct {
 	Enabled     bool     `json:"enabled"`
 	EmbedFields []string `json:"embed_fields"`
+	// FieldWeights repeats a field in the embedded text (1 to 5, default 1).
+	FieldWeights map[string]int `json:"field_weights,omitempty"`
+	// Model and Dimensions identify the embedding model the indexed vectors
+	// were produced with. They are maintained by the relay.
+	Model      string `json:"model,omitempty"`
+	Dimensions int    `json:"dimensions,omitempty"`
 }
 
 // DefaultSemanticConfig returns the default semantic search configuration.
@@ -40,7 +65,7 @@ type ManagementStore struct {
 func (m *ManagementStore) Init(db *bbolt.DB) error {
 	m.DB = db
 	return db.Update(func(tx *bbolt.Tx) error {
-		for _, bucket := range [][]byte{bucketBannedPubKeys, bucketBannedEvents, bucketTypesenseSchema, bucketSemanticConfig} {
+		for _, bucket := range [][]byte{bucketBannedPubKeys, bucketBannedEvents, bucketTypesenseSchema, bucketSemanticConfig, bucketCollections, bucketReindexState, bucketReindexHistory, bucketUnembedded} {
 			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
 				return err
 			}
@@ -51,6 +76,8 @@ func (m *ManagementStore) Init(db *bbolt.DB) error {
 
 type reasonEntry struct {
 	Reason string `json:"reason,omitempty"`
+	// Purge records how the pubkey's existing events were purged ("hide" or "delete").
+	Purge string `json:"purge,omitempty"`
 }
 
 // BanPubKey adds a pubkey to the ban list.
@@ -61,13 +88,63 @@ func (m *ManagementStore) BanPubKey(pubkey nostr.PubKey, reason string) error {
 	})
 }
 
-// AllowPubKey removes a pubkey from the ban list.
-func (m *ManagementStore) AllowPubKey(pubkey nostr.PubKey) error {
+// AllowPubKey removes a pubkey from the ban list and returns the purge mode
+// that was applied to its events while banned, if any.
+func (m *ManagementStore) AllowPubKey(pubkey nostr.PubKey) (string, error) {
+	var purge string
+	err := m.DB.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucketBannedPubKeys)
+		if val := b.Get([]byte(pubkey.Hex())); val != nil {
+			var entry reasonEntry
+			if err := json.Unmarshal(val, &entry); err == nil {
+				purge = entry.Purge
+			}
+		}
+		return b.Delete([]byte(pubkey.Hex()))
+	})
+	return purge, err
+}
+
+// SetPubKeyPurge records the purge mode applied to a banned pubkey's events.
+func (m *ManagementStore) SetPubKeyPurge(pubkey nostr.PubKey, mode string) error {
 	return m.DB.Update(func(tx *bbolt.Tx) error {
-		return tx.Bucket(bucketBannedPubKeys).Delete([]byte(pubkey.Hex()))
+		b := tx.Bucket(bucketBannedPubKeys)
+		val := b.Get([]byte(pubkey.Hex()))
+		if val == nil {
+			return fmt.Errorf("pubkey %s is not banned", pubkey.Hex())
+		}
+		var entry reasonEntry
+		json.Unmarshal(val, &entry)
+		entry.Purge = mode
+		updated, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(pubkey.Hex()), updated)
 	})
 }
 
+// PurgedPubKeys returns the banned pubkeys whose events are hidden or
+// deleted. Their events may still be indexed while the purge runs.
+func (m *ManagementStore) PurgedPubKeys() ([]nostr.PubKey, error) {
+	var result []nostr.PubKey
+	err := m.DB.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketBannedPubKeys).ForEach(func(k, v []byte) error {
+			pk, err := nostr.PubKeyFromHex(string(k))
+			if err != nil {
+				return nil // skip invalid entries
+			}
+			var entry reasonEntry
+			json.Unmarshal(v, &entry)
+			if entry.Purge == PurgeHide || entry.Purge == PurgeDelete {
+				result = append(result, pk)
+			}
+			return nil
+		})
+	})
+	return result, err
+}
+
 // ListBannedPubKeys returns all banned pubkeys.
 func (m *ManagementStore) ListBannedPubKeys() ([]nip86.PubKeyReason, error) {
 	var result []nip86.PubKeyReason
@@ -98,19 +175,68 @@ func (m *ManagementStore) IsPubKeyBanned(pubkey nostr.PubKey) bool {
 	return banned
 }
 
-// BanEvent adds an event ID to the ban list.
-func (m *ManagementStore) BanEvent(id nostr.ID, reason string) error {
-	val, _ := json.Marshal(reasonEntry{Reason: reason})
+// bannedEventEntry is stored for each banned event ID. If the event was present
+// in the event store when it was banned, a copy is kept so it can be restored.
+type bannedEventEntry struct {
+	Reason string       `json:"reason,omitempty"`
+	Event  *nostr.Event `json:"event,omitempty"`
+}
+
+// PubKeyPurgeMode returns the purge mode recorded for a banned pubkey, or "" if
+// the pubkey is not banned or its events were left in place.
+func (m *ManagementStore) PubKeyPurgeMode(pubkey nostr.PubKey) string {
+	var mode string
+	m.DB.View(func(tx *bbolt.Tx) error {
+		if val := tx.Bucket(bucketBannedPubKeys).Get([]byte(pubkey.Hex())); val != nil {
+			var entry reasonEntry
+			if json.Unmarshal(val, &entry) == nil {
+				mode = entry.Purge
+			}
+		}
+		return nil
+	})
+	return mode
+}
+
+// BanEvent adds an event ID to the ban list. If kept is non-nil, the event is
+// stored alongside the ban so AllowEvent can restore it later.
+func (m *ManagementStore) BanEvent(id nostr.ID, reason string, kept *nostr.Event) error {
+	val, err := json.Marshal(bannedEventEntry{Reason: reason, Event: kept})
+	if err != nil {
+		return err
+	}
 	return m.DB.Update(func(tx *bbolt.Tx) error {
 		return tx.Bucket(bucketBannedEvents).Put([]byte(id.Hex()), val)
 	})
 }
 
-// AllowEvent removes an event ID from the ban list.
-func (m *ManagementStore) AllowEvent(id nostr.ID) error {
-	return m.DB.Update(func(tx *bbolt.Tx) error {
-		return tx.Bucket(bucketBannedEvents).Delete([]byte(id.Hex()))
+// AllowEvent removes an event ID from the ban list and returns the copy of the
+// event kept at ban time, or nil if none was kept.
+func (m *ManagementStore) AllowEvent(id nostr.ID) (*nostr.Event, error) {
+	var kept *nostr.Event
+	err := m.DB.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucketBannedEvents)
+		if val := b.Get([]byte(id.Hex())); val != nil {
+			var entry bannedEventEntry
+			if err := json.Unmarshal(val, &entry); err == nil {
+				kept = entry.Event
+			}
+		}
+		return b.Delete([]byte(id.Hex()))
 	})
+	return kept, err
+}
+
+// IsEventBanned checks if an event ID is banned.
+func (m *ManagementStore) IsEventBanned(id nostr.ID) bool {
+	var banned bool
+	m.DB.View(func(tx *bbolt.Tx) error {
+		if tx.Bucket(bucketBannedEvents).Get([]byte(id.Hex())) != nil {
+			banned = true
+		}
+		return nil
+	})
+	return banned
 }
 
 // ListBannedEvents returns all banned event IDs.
@@ -122,7 +248,7 @@ func (m *ManagementStore) ListBannedEvents() ([]nip86.IDReason, error) {
 			if err != nil {
 				return nil // skip invalid entries
 			}
-			var entry reasonEntry
+			var entry bannedEventEntry
 			json.Unmarshal(v, &entry)
 			result = append(result, nip86.IDReason{ID: id, Reason: entry.Reason})
 			return nil
@@ -188,3 +314,171 @@ func (m *ManagementStore) LoadSemanticConfig() (SemanticConfig, error) {
 	})
 	return cfg, err
 }
+
+// SaveEmbeddingProvider stores the embedding provider selected through the management API.
+func (m *ManagementStore) SaveEmbeddingProvider(p EmbeddingProviderConfig) error {
+	val, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return m.DB.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketSemanticConfig).Put([]byte(embeddingProviderKey), val)
+	})
+}
+
+// LoadEmbeddingProvider loads the stored embedding provider.
+// Returns nil if none was stored.
+func (m *ManagementStore) LoadEmbeddingProvider() (*EmbeddingProviderConfig, error) {
+	var p *EmbeddingProviderConfig
+	err := m.DB.View(func(tx *bbolt.Tx) error {
+		val := tx.Bucket(bucketSemanticConfig).Get([]byte(embeddingProviderKey))
+		if val == nil {
+			return nil
+		}
+		p = &EmbeddingProviderConfig{}
+		return json.Unmarshal(val, p)
+	})
+	return p, err
+}
+
+// DeleteEmbeddingProvider removes the stored embedding provider, so the
+// EMBED_* variables apply again.
+func (m *ManagementStore) DeleteEmbeddingProvider() error {
+	return m.DB.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketSemanticConfig).Delete([]byte(embeddingProviderKey))
+	})
+}
+
+// SaveCollectionVersions stores the current and previous collection behind the alias.
+func (m *ManagementStore) SaveCollectionVersions(v CollectionVersions) error {
+	val, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return m.DB.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketCollections).Put([]byte(collectionsKey), val)
+	})
+}
+
+// LoadCollectionVersions loads the collection versions. Returns zero values if none are stored.
+func (m *ManagementStore) LoadCollectionVersions() (CollectionVersions, error) {
+	var v CollectionVersions
+	err := m.DB.View(func(tx *bbolt.Tx) error {
+		val := tx.Bucket(bucketCollections).Get([]byte(collectionsKey))
+		if val == nil {
+			return nil
+		}
+		return json.Unmarshal(val, &v)
+	})
+	return v, err
+}
+
+// SaveReindexCheckpoint stores the progress of a running reindex.
+func (m *ManagementStore) SaveReindexCheckpoint(cp ReindexCheckpoint) error {
+	val, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	return m.DB.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketReindexState).Put([]byte(reindexCheckpointKey), val)
+	})
+}
+
+// LoadReindexCheckpoint loads the checkpoint of an interrupted reindex. Returns nil if none is stored.
+func (m *ManagementStore) LoadReindexCheckpoint() (*ReindexCheckpoint, error) {
+	var cp *ReindexCheckpoint
+	err := m.DB.View(func(tx *bbolt.Tx) error {
+		val := tx.Bucket(bucketReindexState).Get([]byte(reindexCheckpointKey))
+		if val == nil {
+			return nil
+		}
+		cp = &ReindexCheckpoint{}
+		return json.Unmarshal(val, cp)
+	})
+	return cp, err
+}
+
+// DeleteReindexCheckpoint removes the reindex checkpoint.
+func (m *ManagementStore) DeleteReindexCheckpoint() error {
+	return m.DB.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketReindexState).Delete([]byte(reindexCheckpointKey))
+	})
+}
+
+// AddReindexJob appends a finished job to the reindex history, dropping the
+// oldest entries beyond reindexHistoryLimit.
+func (m *ManagementStore) AddReindexJob(job ReindexJob) error {
+	val, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return m.DB.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucketReindexHistory)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		if err := b.Put(key, val); err != nil {
+			return err
+		}
+		var keys [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		for i := 0; i < len(keys)-reindexHistoryLimit; i++ {
+			if err := b.Delete(keys[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ListReindexJobs returns the reindex history, newest first.
+func (m *ManagementStore) ListReindexJobs() ([]ReindexJob, error) {
+	var jobs []ReindexJob
+	err := m.DB.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(bucketReindexHistory).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var job ReindexJob
+			if err := json.Unmarshal(v, &job); err != nil {
+				continue // skip invalid entries
+			}
+			jobs = append(jobs, job)
+		}
+		return nil
+	})
+	return jobs, err
+}
+
+// AddUnembedded records an event that was indexed without a vector because
+// the embedding service was failing.
+func (m *ManagementStore) AddUnembedded(id nostr.ID) error {
+	return m.DB.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketUnembedded).Put([]byte(id.Hex()), nil)
+	})
+}
+
+// ListUnembedded returns the events recorded by AddUnembedded.
+func (m *ManagementStore) ListUnembedded() ([]nostr.ID, error) {
+	var ids []nostr.ID
+	err := m.DB.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketUnembedded).ForEach(func(k, v []byte) error {
+			if id, err := nostr.IDFromHex(string(k)); err == nil {
+				ids = append(ids, id)
+			}
+			return nil
+		})
+	})
+	return ids, err
+}
+
+// RemoveUnembedded forgets an event once it is queued for embedding.
+func (m *ManagementStore) RemoveUnembedded(id nostr.ID) error {
+	return m.DB.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketUnembedded).Delete([]byte(id.Hex()))
+	})
+}
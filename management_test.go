@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"fiatjaf.com/nostr/eventstore/typesense30142"
+)
+
+func TestManagementPubKeyBans(t *testing.T) {
+	mgmt := newTestManagement(t, newTestBolt(t))
+	alice := testPubKey("alice")
+
+	if mgmt.IsPubKeyBanned(alice) {
+		t.Fatal("pubkey banned before BanPubKey")
+	}
+	if err := mgmt.BanPubKey(alice, "spam"); err != nil {
+		t.Fatal(err)
+	}
+	if !mgmt.IsPubKeyBanned(alice) {
+		t.Fatal("pubkey not banned after BanPubKey")
+	}
+	if err := mgmt.SetPubKeyPurge(alice, PurgeHide); err != nil {
+		t.Fatal(err)
+	}
+	if mode := mgmt.PubKeyPurgeMode(alice); mode != PurgeHide {
+		t.Errorf("PubKeyPurgeMode = %q, want %q", mode, PurgeHide)
+	}
+
+	list, err := mgmt.ListBannedPubKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].PubKey != alice || list[0].Reason != "spam" {
+		t.Errorf("ListBannedPubKeys = %+v, want alice with reason spam", list)
+	}
+
+	mode, err := mgmt.AllowPubKey(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode != PurgeHide {
+		t.Errorf("AllowPubKey returned purge mode %q, want %q", mode, PurgeHide)
+	}
+	if mgmt.IsPubKeyBanned(alice) || mgmt.PubKeyPurgeMode(alice) != "" {
+		t.Error("pubkey still banned after AllowPubKey")
+	}
+}
+
+func TestManagementEventBans(t *testing.T) {
+	mgmt := newTestManagement(t, newTestBolt(t))
+	event := makeEvent(testPubKey("alice"), "a", "A", 1000)
+
+	if err := mgmt.BanEvent(event.ID, "off-topic", &event); err != nil {
+		t.Fatal(err)
+	}
+	if !mgmt.IsEventBanned(event.ID) {
+		t.Fatal("event not banned after BanEvent")
+	}
+	list, err := mgmt.ListBannedEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != event.ID || list[0].Reason != "off-topic" {
+		t.Errorf("ListBannedEvents = %+v, want the event with reason off-topic", list)
+	}
+
+	kept, err := mgmt.AllowEvent(event.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kept == nil || kept.ID != event.ID || kept.Tags.GetD() != "a" {
+		t.Errorf("AllowEvent returned %v, want the kept event", kept)
+	}
+	if mgmt.IsEventBanned(event.ID) {
+		t.Error("event still banned after AllowEvent")
+	}
+
+	// Without a kept copy there is nothing to restore
+	mgmt.BanEvent(event.ID, "", nil)
+	if kept, _ := mgmt.AllowEvent(event.ID); kept != nil {
+		t.Errorf("AllowEvent returned %v, want nil", kept)
+	}
+}
+
+func TestManagementSchema(t *testing.T) {
+	mgmt := newTestManagement(t, newTestBolt(t))
+
+	schema, err := mgmt.LoadSchema()
+	if err != nil || schema != nil {
+		t.Fatalf("LoadSchema = (%v, %v), want (nil, nil) before SaveSchema", schema, err)
+	}
+
+	if err := mgmt.SaveSchema(typesense30142.DefaultSchema()); err != nil {
+		t.Fatal(err)
+	}
+	if schema, err = mgmt.LoadSchema(); err != nil || schema == nil {
+		t.Fatalf("LoadSchema = (%v, %v) after SaveSchema", schema, err)
+	}
+	if err := mgmt.DeleteSchema(); err != nil {
+		t.Fatal(err)
+	}
+	if schema, _ = mgmt.LoadSchema(); schema != nil {
+		t.Error("schema still stored after DeleteSchema")
+	}
+}
+
+func TestManagementSemanticConfig(t *testing.T) {
+	mgmt := newTestManagement(t, newTestBolt(t))
+
+	cfg, err := mgmt.LoadSemanticConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Enabled || fmt.Sprint(cfg.EmbedFields) != fmt.Sprint(DefaultSemanticConfig().EmbedFields) {
+		t.Errorf("LoadSemanticConfig = %+v, want the default config", cfg)
+	}
+
+	cfg = SemanticConfig{
+		Enabled:      true,
+		EmbedFields:  []string{"name", "keywords"},
+		FieldWeights: map[string]int{"name": 2},
+		Model:        "hash:384",
+		Dimensions:   384,
+	}
+	if err := mgmt.SaveSemanticConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	got, err := mgmt.LoadSemanticConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%+v", got) != fmt.Sprintf("%+v", cfg) {
+		t.Errorf("LoadSemanticConfig = %+v, want %+v", got, cfg)
+	}
+
+	// The provider shares the bucket but not the key
+	p, err := mgmt.LoadEmbeddingProvider()
+	if err != nil || p != nil {
+		t.Fatalf("LoadEmbeddingProvider = (%v, %v), want (nil, nil)", p, err)
+	}
+	provider := EmbeddingProviderConfig{Provider: EmbedProviderOpenAI, Endpoint: "http://embed/v1/embeddings", Model: "m", Token: "secret"}
+	if err := mgmt.SaveEmbeddingProvider(provider); err != nil {
+		t.Fatal(err)
+	}
+	if p, err = mgmt.LoadEmbeddingProvider(); err != nil || p == nil || *p != provider {
+		t.Errorf("LoadEmbeddingProvider = (%v, %v), want %+v", p, err, provider)
+	}
+	if got, _ := mgmt.LoadSemanticConfig(); !got.Enabled {
+		t.Error("SaveEmbeddingProvider overwrote the semantic config")
+	}
+	if err := mgmt.DeleteEmbeddingProvider(); err != nil {
+		t.Fatal(err)
+	}
+	if p, err = mgmt.LoadEmbeddingProvider(); err != nil || p != nil {
+		t.Errorf("LoadEmbeddingProvider after delete = (%v, %v), want (nil, nil)", p, err)
+	}
+}
+
+func TestManagementReindexState(t *testing.T) {
+	mgmt := newTestManagement(t, newTestBolt(t))
+
+	versions := CollectionVersions{Current: "amb_2", Previous: "amb_1"}
+	if err := mgmt.SaveCollectionVersions(versions); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := mgmt.LoadCollectionVersions(); err != nil || got != versions {
+		t.Errorf("LoadCollectionVersions = (%+v, %v), want %+v", got, err, versions)
+	}
+
+	cp := ReindexCheckpoint{Collection: "amb_3", StartedAt: 100, Until: 50, Total: 10, Indexed: 9, Errors: 1}
+	if err := mgmt.SaveReindexCheckpoint(cp); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := mgmt.LoadReindexCheckpoint(); err != nil || got == nil || *got != cp {
+		t.Errorf("LoadReindexCheckpoint = (%v, %v), want %+v", got, err, cp)
+	}
+	if err := mgmt.DeleteReindexCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := mgmt.LoadReindexCheckpoint(); got != nil {
+		t.Errorf("checkpoint %+v still stored after DeleteReindexCheckpoint", got)
+	}
+}
+
+func TestManagementReindexHistoryLimit(t *testing.T) {
+	mgmt := newTestManagement(t, newTestBolt(t))
+
+	for i := range reindexHistoryLimit + 5 {
+		if err := mgmt.AddReindexJob(ReindexJob{Collection: fmt.Sprintf("amb_%d", i), Status: reindexPhaseDone}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	jobs, err := mgmt.ListReindexJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != reindexHistoryLimit {
+		t.Fatalf("ListReindexJobs returned %d jobs, want %d", len(jobs), reindexHistoryLimit)
+	}
+	if newest := fmt.Sprintf("amb_%d", reindexHistoryLimit+4); jobs[0].Collection != newest {
+		t.Errorf("newest job is %s, want %s", jobs[0].Collection, newest)
+	}
+	if oldest := "amb_5"; jobs[len(jobs)-1].Collection != oldest {
+		t.Errorf("oldest job is %s, want %s", jobs[len(jobs)-1].Collection, oldest)
+	}
+}
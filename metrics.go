@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"iter"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"go.etcd.io/bbolt"
+)
+
+// metricsBuckets are the upper bounds in seconds of the latency histograms,
+// the default buckets of the Prometheus client libraries.
+var metricsBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics records the relay's counters and latency histograms and writes them
+// in the Prometheus text exposition format. All methods are safe on a nil
+// *Metrics and record nothing, so components built without metrics (e.g. in
+// tests) need no checks.
+type Metrics struct {
+	eventsAccepted    *counterVec
+	eventsRejected    *counterVec
+	queryDuration     *histogramVec
+	queryErrors       *counterVec
+	typesenseDuration *histogramVec
+	typesenseErrors   *counterVec
+	embedDuration     *histogramVec
+	embedErrors       *counterVec
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		eventsAccepted:    newCounterVec("amb_events_accepted_total", "Events accepted by the write policy."),
+		eventsRejected:    newCounterVec("amb_events_rejected_total", "Events rejected by the write policy, by reason.", "reason"),
+		queryDuration:     newHistogramVec("amb_query_duration_seconds", "Duration of REQ and COUNT queries.", "type"),
+		queryErrors:       newCounterVec("amb_query_errors_total", "Failed REQ and COUNT queries.", "type"),
+		typesenseDuration: newHistogramVec("amb_typesense_request_duration_seconds", "Duration of Typesense requests, by operation.", "op"),
+		typesenseErrors:   newCounterVec("amb_typesense_errors_total", "Failed Typesense requests, by operation.", "op"),
+		embedDuration:     newHistogramVec("amb_embedding_request_duration_seconds", "Duration of requests to the embedding service, including failed ones."),
+		embedErrors:       newCounterVec("amb_embedding_errors_total", "Failed requests to the embedding service, including retried ones."),
+	}
+}
+
+// ObserveEvent counts an event checked by the write policy. reason is empty
+// for accepted events.
+func (m *Metrics) ObserveEvent(reason string) {
+	if m == nil {
+		return
+	}
+	if reason == "" {
+		m.eventsAccepted.Inc()
+	} else {
+		m.eventsRejected.Inc(reason)
+	}
+}
+
+// ObserveQuery records a REQ or COUNT query that started at start.
+func (m *Metrics) ObserveQuery(queryType string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.queryDuration.Observe(time.Since(start).Seconds(), queryType)
+	if err != nil {
+		m.queryErrors.Inc(queryType)
+	}
+}
+
+// ObserveTypesense records a Typesense request that started at start.
+func (m *Metrics) ObserveTypesense(op string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.typesenseDuration.Observe(time.Since(start).Seconds(), op)
+	if err != nil {
+		m.typesenseErrors.Inc(op)
+	}
+}
+
+// ObserveEmbedding records a request to the embedding service that started at start.
+func (m *Metrics) ObserveEmbedding(start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.embedDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.embedErrors.Inc()
+	}
+}
+
+// TimeTypesenseQuery records op as taking until events yields its first
+// event or ends. The event stores fetch a page before yielding anything, so
+// this is the request latency without the time spent consuming the results.
+// Only the latency is recorded: the event stores log a failed search and
+// yield no events, so its error never reaches the relay.
+func (m *Metrics) TimeTypesenseQuery(op string, events iter.Seq[nostr.Event]) iter.Seq[nostr.Event] {
+	if m == nil {
+		return events
+	}
+	return func(yield func(nostr.Event) bool) {
+		start := time.Now()
+		observed := false
+		defer func() {
+			if !observed {
+				m.typesenseDuration.Observe(time.Since(start).Seconds(), op)
+			}
+		}()
+		for event := range events {
+			if !observed {
+				observed = true
+				m.typesenseDuration.Observe(time.Since(start).Seconds(), op)
+			}
+			if !yield(event) {
+				return
+			}
+		}
+	}
+}
+
+// Write writes all recorded metrics.
+func (m *Metrics) Write(w io.Writer) {
+	if m == nil {
+		return
+	}
+	m.eventsAccepted.write(w)
+	m.eventsRejected.write(w)
+	m.queryDuration.write(w)
+	m.queryErrors.write(w)
+	m.typesenseDuration.write(w)
+	m.typesenseErrors.write(w)
+	m.embedDuration.write(w)
+	m.embedErrors.write(w)
+}
+
+// writeGauge writes a single gauge sample, for values read at scrape time.
+func writeGauge(w io.Writer, name, help string, value float64) {
+	writeMetricHeader(w, name, help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", name, formatMetricValue(value))
+}
+
+// writeCounter writes a single counter sample kept elsewhere, e.g. in a
+// component's atomic counters.
+func writeCounter(w io.Writer, name, help string, value float64) {
+	writeMetricHeader(w, name, help, "counter")
+	fmt.Fprintf(w, "%s %s\n", name, formatMetricValue(value))
+}
+
+// counterVec is a counter with one series per combination of label values.
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	values []string
+	count  float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, series: map[string]*counterSeries{}}
+}
+
+func (c *counterVec) Inc(values ...string) {
+	key := strings.Join(values, "\xff")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.series[key]
+	if !ok {
+		s = &counterSeries{values: values}
+		c.series[key] = s
+	}
+	s.count++
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeMetricHeader(w, c.name, c.help, "counter")
+	if len(c.labels) == 0 && len(c.series) == 0 {
+		// An unlabelled counter exists from the start
+		fmt.Fprintf(w, "%s 0\n", c.name)
+		return
+	}
+	for _, key := range slices.Sorted(maps.Keys(c.series)) {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, s.values, "", ""), formatMetricValue(s.count))
+	}
+}
+
+// histogramVec is a histogram over metricsBuckets with one series per
+// combination of label values.
+type histogramVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	values []string
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, series: map[string]*histogramSeries{}}
+}
+
+func (h *histogramVec) Observe(value float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{values: values, counts: make([]uint64, len(metricsBuckets))}
+		h.series[key] = s
+	}
+	if i, _ := slices.BinarySearch(metricsBuckets, value); i < len(metricsBuckets) {
+		s.counts[i]++
+	}
+	s.sum += value
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeMetricHeader(w, h.name, h.help, "histogram")
+	for _, key := range slices.Sorted(maps.Keys(h.series)) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, bound := range metricsBuckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.values, "le", formatMetricValue(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.values, "", ""), formatMetricValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.values, "", ""), s.count)
+	}
+}
+
+func writeMetricHeader(w io.Writer, name, help, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// formatLabels renders {name="value",...}, with an extra label if extraName is set.
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+labelValueEscaper.Replace(values[i])+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// labelValueEscaper escapes what the exposition format requires in label values.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatMetricValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// serveMetrics serves the recorded metrics together with the state of the
+// outbox, reindex, embedding service and BoltDB read at scrape time.
+func (r *AMBRelay) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	if token := r.config.MetricsToken; token != "" {
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	var buf bytes.Buffer
+	r.metrics.Write(&buf)
+	writeGauge(&buf, "amb_uptime_seconds", "Seconds since the relay started.", time.Since(r.started).Seconds())
+
+	outbox := r.outbox.GetStatus()
+	writeGauge(&buf, "amb_index_outbox_pending", "Index operations waiting to be applied to Typesense.", float64(outbox.Pending))
+	writeGauge(&buf, "amb_index_outbox_failed", "Index operations that exhausted their retries.", float64(outbox.Failed))
+	writeCounter(&buf, "amb_index_outbox_applied_total", "Index operations applied to Typesense.", float64(outbox.Applied))
+	writeCounter(&buf, "amb_index_outbox_retries_total", "Failed attempts to apply an index operation.", float64(outbox.Retries))
+
+	reindex := r.reindexer.GetStatus()
+	writeGauge(&buf, "amb_reindex_running", "1 while a reindex is running.", boolGauge(reindex.Running))
+	writeGauge(&buf, "amb_reindex_expected_events", "Events the running or last reindex expects to process.", float64(reindex.Expected))
+	writeGauge(&buf, "amb_reindex_processed_events", "Events processed by the running or last reindex.", float64(reindex.Total))
+	writeGauge(&buf, "amb_reindex_indexed_events", "Events indexed by the running or last reindex.", float64(reindex.Indexed))
+	writeGauge(&buf, "amb_reindex_failed_events", "Events the running or last reindex failed to index.", float64(reindex.Errors))
+	writeGauge(&buf, "amb_reindex_rate", "Events per second indexed by the running reindex.", reindex.Rate)
+
+	writeGauge(&buf, "amb_embedding_breaker_open", "1 while the embedding service is bypassed after repeated failures.", boolGauge(r.embedBreaker.IsOpen()))
+	writeCounter(&buf, "amb_embedding_retries_total", "Retried requests to the embedding service.", float64(r.embedClient.Retries()))
+	writeCounter(&buf, "amb_embedding_truncated_texts_total", "Texts longer than EMBED_MAX_CHUNKS chunks whose tail was not embedded.", float64(r.embedder.Truncated()))
+
+	var size int64
+	r.boltDB.DB.View(func(tx *bbolt.Tx) error {
+		size = tx.Size()
+		return nil
+	})
+	writeGauge(&buf, "amb_bolt_size_bytes", "Size of the BoltDB file in use.", float64(size))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestMetricsWrite(t *testing.T) {
+	m := NewMetrics()
+	m.ObserveEvent("")
+	m.ObserveEvent(rejectKind)
+	m.ObserveEvent(rejectKind)
+	m.typesenseDuration.Observe(0.01, "save")
+	m.typesenseDuration.Observe(0.3, "save")
+	m.typesenseDuration.Observe(20, "save")
+	m.ObserveTypesense("delete", time.Now(), errors.New("unavailable"))
+
+	var buf bytes.Buffer
+	m.Write(&buf)
+	out := buf.String()
+	for _, line := range []string{
+		"# TYPE amb_events_accepted_total counter",
+		"amb_events_accepted_total 1",
+		`amb_events_rejected_total{reason="unsupported_kind"} 2`,
+		"# TYPE amb_typesense_request_duration_seconds histogram",
+		`amb_typesense_request_duration_seconds_bucket{op="save",le="0.005"} 0`,
+		`amb_typesense_request_duration_seconds_bucket{op="save",le="0.01"} 1`,
+		`amb_typesense_request_duration_seconds_bucket{op="save",le="0.25"} 1`,
+		`amb_typesense_request_duration_seconds_bucket{op="save",le="0.5"} 2`,
+		`amb_typesense_request_duration_seconds_bucket{op="save",le="10"} 2`,
+		`amb_typesense_request_duration_seconds_bucket{op="save",le="+Inf"} 3`,
+		`amb_typesense_request_duration_seconds_sum{op="save"} 20.31`,
+		`amb_typesense_request_duration_seconds_count{op="save"} 3`,
+		`amb_typesense_errors_total{op="delete"} 1`,
+		// Unlabelled counters are reported before anything was counted
+		"amb_embedding_errors_total 0",
+	} {
+		if !slices.Contains(strings.Split(out, "\n"), line) {
+			t.Errorf("output lacks %q", line)
+		}
+	}
+	if strings.Contains(out, `amb_typesense_errors_total{op="save"}`) {
+		t.Error("successful requests were counted as errors")
+	}
+}
+
+func TestMetricsLabelEscaping(t *testing.T) {
+	m := NewMetrics()
+	m.ObserveEvent("a \"quoted\"\\reason\n")
+	var buf bytes.Buffer
+	m.Write(&buf)
+	if want := `amb_events_rejected_total{reason="a \"quoted\"\\reason\n"} 1`; !strings.Contains(buf.String(), want) {
+		t.Errorf("output lacks %q:\n%s", want, buf.String())
+	}
+}
+
+func TestMetricsNil(t *testing.T) {
+	var m *Metrics
+	m.ObserveEvent(rejectKind)
+	m.ObserveQuery("req", time.Now(), nil)
+	m.ObserveTypesense("save", time.Now(), nil)
+	m.ObserveEmbedding(time.Now(), nil)
+	m.Write(&bytes.Buffer{})
+	events := []nostr.Event{makeEvent(testPubKey("alice"), "a", "A", 1000)}
+	if got := slices.Collect(m.TimeTypesenseQuery("search", slices.Values(events))); len(got) != 1 {
+		t.Errorf("TimeTypesenseQuery on nil Metrics yielded %d events, want 1", len(got))
+	}
+}
+
+func TestTimeTypesenseQuery(t *testing.T) {
+	m := NewMetrics()
+	events := []nostr.Event{
+		makeEvent(testPubKey("alice"), "a", "A", 1000),
+		makeEvent(testPubKey("alice"), "b", "B", 1001),
+	}
+	for range m.TimeTypesenseQuery("search", slices.Values(events)) {
+		break
+	}
+	for range m.TimeTypesenseQuery("search", slices.Values[[]nostr.Event](nil)) {
+	}
+	if n := m.typesenseDuration.series["search"].count; n != 2 {
+		t.Errorf("recorded %d searches, want one per query", n)
+	}
+}
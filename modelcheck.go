@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr/eventstore/typesense30142"
+)
+
+// modelProbeTimeout bounds the request that determines the vector dimension.
+const modelProbeTimeout = 30 * time.Second
+
+type EmbeddingModelStatus struct {
+	Model             string `json:"model"`
+	Dimensions        int    `json:"dimensions"`
+	IndexedModel      string `json:"indexed_model,omitempty"`
+	IndexedDimensions int    `json:"indexed_dimensions,omitempty"`
+	// CollectionDimensions is the vector size of the live collection,
+	// SchemaDimensions that of the schema the next reindex builds with.
+	CollectionDimensions int    `json:"collection_dimensions,omitempty"`
+	SchemaDimensions     int    `json:"schema_dimensions,omitempty"`
+	ReembedRequired      bool   `json:"reembed_required"`
+	DimensionMismatch    bool   `json:"dimension_mismatch"`
+	CheckedAt            int64  `json:"checked_at,omitempty"`
+	Error                string `json:"error,omitempty"`
+}
+
+// EmbeddingModelCheck compares the configured embedding model with the one
+// recorded in SemanticConfig for the stored vectors. It probes the service
+// for the vector dimension and validates it against the live collection and
+// the stored collection schema.
+type EmbeddingModelCheck struct {
+	client     *EmbeddingClient
+	mgmt       *ManagementStore
+	admin      *TypesenseAdmin
+	collection string
+
+	mu     sync.Mutex
+	status EmbeddingModelStatus
+}
+
+func NewEmbeddingModelCheck(client *EmbeddingClient, mgmt *ManagementStore, tsDB *typesense30142.TSBackend) *EmbeddingModelCheck {
+	return &EmbeddingModelCheck{
+		client:     client,
+		mgmt:       mgmt,
+		admin:      NewTypesenseAdmin(tsDB),
+		collection: tsDB.CollectionName,
+	}
+}
+
+// Run probes the embedding service and updates the status. On the first run
+// the current model is recorded as the one the stored vectors came from.
+func (m *EmbeddingModelCheck) Run() EmbeddingModelStatus {
+	status := EmbeddingModelStatus{
+		Model:     m.client.Provider().ModelID(),
+		CheckedAt: time.Now().Unix(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), modelProbeTimeout)
+	defer cancel()
+	vectors, err := m.client.Embed(ctx, []string{breakerProbeText})
+	if err != nil {
+		status.Error = fmt.Sprintf("probe failed: %v", err)
+	} else if len(vectors) == 1 {
+		status.Dimensions = len(vectors[0])
+	}
+
+	if schema, err := m.mgmt.LoadSchema(); err != nil {
+		status.Error = fmt.Sprintf("failed to load schema: %v", err)
+	} else {
+		status.SchemaDimensions = schemaEmbeddingDimensions(schema)
+	}
+	if dims, err := m.admin.CollectionDimensions(m.collection); err != nil {
+		status.Error = fmt.Sprintf("failed to read collection: %v", err)
+	} else {
+		status.CollectionDimensions = dims
+	}
+	status.DimensionMismatch = status.Dimensions > 0 && status.CollectionDimensions > 0 &&
+		status.Dimensions != status.CollectionDimensions
+
+	cfg, err := m.mgmt.LoadSemanticConfig()
+	if err != nil {
+		status.Error = fmt.Sprintf("failed to load semantic config: %v", err)
+	} else {
+		if cfg.Model == "" && status.Dimensions > 0 {
+			// Nothing recorded yet: assume the stored vectors match the current model
+			cfg.Model = status.Model
+			cfg.Dimensions = status.Dimensions
+			if err := m.mgmt.SaveSemanticConfig(cfg); err != nil {
+				slog.Error("failed to record model", "component", "embedding", "err", err)
+			}
+		}
+		status.IndexedModel = cfg.Model
+		status.IndexedDimensions = cfg.Dimensions
+		status.ReembedRequired = cfg.Model != "" && cfg.Model != status.Model
+	}
+
+	m.mu.Lock()
+	m.status = status
+	m.mu.Unlock()
+	return status
+}
+
+// Blocked reports whether the model's vectors do not fit the live
+// collection, in which case embedding must stay off for it: their dimension
+// differs, or the collection holds vectors of another model, which new query
+// and document vectors cannot be compared with. A reindex embeds the new
+// collection regardless.
+func (m *EmbeddingModelCheck) Blocked() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status.DimensionMismatch || m.status.ReembedRequired
+}
+
+// MarkIndexed records the current model as the one the stored vectors came
+// from, after a reindex has re-embedded everything.
+func (m *EmbeddingModelCheck) MarkIndexed() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cfg, err := m.mgmt.LoadSemanticConfig()
+	if err != nil {
+		return err
+	}
+	cfg.Model = m.status.Model
+	if m.status.Dimensions > 0 {
+		cfg.Dimensions = m.status.Dimensions
+	}
+	if err := m.mgmt.SaveSemanticConfig(cfg); err != nil {
+		return err
+	}
+	m.status.IndexedModel = cfg.Model
+	m.status.IndexedDimensions = cfg.Dimensions
+	m.status.ReembedRequired = false
+	return nil
+}
+
+// CanReembed reports whether a reindex with the stored schema can hold the
+// model's vectors.
+func (m *EmbeddingModelCheck) CanReembed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status.SchemaDimensions == 0 || m.status.Dimensions == 0 ||
+		m.status.SchemaDimensions == m.status.Dimensions
+}
+
+// GetStatus returns the result of the last check.
+func (m *EmbeddingModelCheck) GetStatus() EmbeddingModelStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+// schemaEmbeddingDimensions returns the num_dim of the first vector field in
+// schema, or 0 if the schema does not declare one. A nil schema means the
+// backend's default schema.
+func schemaEmbeddingDimensions(schema *typesense30142.CollectionSchema) int {
+	if schema == nil {
+		def := typesense30142.DefaultSchema()
+		schema = &def
+	}
+	data, err := json.Marshal(schema)
+	if err != nil {
+		return 0
+	}
+	var parsed struct {
+		Fields []struct {
+			NumDim int `json:"num_dim"`
+		} `json:"fields"`
+	}
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return 0
+	}
+	for _, field := range parsed.Fields {
+		if field.NumDim > 0 {
+			return field.NumDim
+		}
+	}
+	return 0
+}
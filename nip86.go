@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore/typesense30142"
+	"fiatjaf.com/nostr/khatru"
+	"fiatjaf.com/nostr/nip86"
+)
+
+// setManagementAPI wires the NIP-86 management API to the relay's stores and jobs.
+func (r *AMBRelay) setManagementAPI() {
+	r.ManagementAPI.OnAPICall = func(ctx context.Context, mp nip86.MethodParams) (reject bool, msg string) {
+		logger := ctxLogger(ctx).With("method", mp.MethodName(), "ip", khatru.GetIP(ctx))
+		authed, ok := khatru.GetAuthed(ctx)
+		if !ok {
+			logger.Info("management call rejected", "reason", "not authenticated")
+			return true, "not authenticated"
+		}
+		logger = logger.With("pubkey", authed.Hex())
+		if !r.admins[authed] {
+			logger.Warn("management call rejected", "reason", "not authorized")
+			return true, "not authorized"
+		}
+		logger.Info("management call")
+		return false, ""
+	}
+
+	r.ManagementAPI.BanPubKey = func(ctx context.Context, pubkey nostr.PubKey, reason string) error {
+		if err := r.mgmt.BanPubKey(pubkey, reason); err != nil {
+			return err
+		}
+		if r.config.BanPubKeyPurge == PurgeNone {
+			return nil
+		}
+		if err := r.startPurge(pubkey, r.config.BanPubKeyPurge); err != nil {
+			return fmt.Errorf("pubkey banned but purge not started: %w", err)
+		}
+		return nil
+	}
+	r.ManagementAPI.ListBannedPubKeys = func(ctx context.Context) ([]nip86.PubKeyReason, error) {
+		return r.mgmt.ListBannedPubKeys()
+	}
+	r.ManagementAPI.AllowPubKey = func(ctx context.Context, pubkey nostr.PubKey, reason string) error {
+		purged, err := r.mgmt.AllowPubKey(pubkey)
+		if err != nil {
+			return err
+		}
+		// Hidden events are still in BoltDB and can be re-indexed
+		if purged == PurgeHide {
+			if err := r.purger.Start(pubkey, PurgeRestore); err != nil {
+				return fmt.Errorf("pubkey allowed but re-index not started: %w", err)
+			}
+		}
+		return nil
+	}
+	r.ManagementAPI.BanEvent = func(ctx context.Context, id nostr.ID, reason string) error {
+		// Keep a copy of the event with the ban so allowevent can restore it
+		var kept *nostr.Event
+		for event := range r.boltDB.QueryEvents(nostr.Filter{IDs: []nostr.ID{id}}, 1) {
+			kept = &event
+		}
+		if err := r.mgmt.BanEvent(id, reason, kept); err != nil {
+			return err
+		}
+		// Through the outbox, so a save of the event queued earlier cannot
+		// re-index it; the event may only be in Typesense
+		defer r.invalidateResults()
+		return writeThroughOutbox(r.outbox, outboxOpDelete, nil, id, func() error {
+			if kept == nil {
+				return nil
+			}
+			if err := r.boltDB.DeleteEvent(id); err != nil {
+				return fmt.Errorf("failed to purge banned event from BoltDB: %w", err)
+			}
+			return nil
+		})
+	}
+	r.ManagementAPI.ListBannedEvents = func(ctx context.Context) ([]nip86.IDReason, error) {
+		return r.mgmt.ListBannedEvents()
+	}
+	r.ManagementAPI.AllowEvent = func(ctx context.Context, id nostr.ID, reason string) error {
+		kept, err := r.mgmt.AllowEvent(id)
+		if err != nil {
+			return err
+		}
+		if kept == nil {
+			return nil
+		}
+		// Restore through ReplaceEvent so a newer version of the same address wins
+		if err := r.replaceEvent(ctx, *kept); err != nil {
+			return fmt.Errorf("failed to restore event: %w", err)
+		}
+		return nil
+	}
+
+	r.ManagementAPI.ChangeRelayName = func(ctx context.Context, name string) error {
+		r.Info.Name = name
+		return nil
+	}
+	r.ManagementAPI.ChangeRelayDescription = func(ctx context.Context, desc string) error {
+		r.Info.Description = desc
+		return nil
+	}
+	r.ManagementAPI.ChangeRelayIcon = func(ctx context.Context, icon string) error {
+		r.Info.Icon = icon
+		return nil
+	}
+
+	r.ManagementAPI.Stats = func(ctx context.Context) (nip86.Response, error) {
+		count, err := r.tsDB.CountEvents(nostr.Filter{Kinds: []nostr.Kind{30142}})
+		if err != nil {
+			return nip86.Response{}, err
+		}
+		result := map[string]any{
+			"event_count": count,
+			"uptime":      time.Since(r.started).String(),
+		}
+		if r.embedClient.Configured() {
+			result["embedding_breaker"] = r.embedBreaker.GetStatus()
+			result["embedding_retries"] = r.embedClient.Retries()
+		}
+		if r.queryCache != nil {
+			result["query_vector_cache"] = r.queryCache.GetStats()
+		}
+		if r.resultCache != nil {
+			result["search_result_cache"] = r.resultCache.GetStats()
+		}
+		stats, err := r.stats.Get()
+		if stats != nil {
+			result["collection_stats"] = stats
+		}
+		if err != nil {
+			result["collection_stats_error"] = err.Error()
+		}
+		return nip86.Response{Result: result}, nil
+	}
+
+	// Custom Typesense management methods via Generic handler
+	r.ManagementAPI.Generic = func(ctx context.Context, request nip86.Request) (nip86.Response, error) {
+		resp, err := r.handleManagementMethod(ctx, request)
+		if err != nil {
+			ctxLogger(ctx).Warn("management call failed", "method", request.Method, "err", err)
+		}
+		return resp, err
+	}
+}
+
+// startPurge records the purge mode of a banned pubkey and starts the purge.
+// The mode is recorded first so reindex and repair skip hidden events while
+// the purge runs, and restored if the purge cannot start.
+func (r *AMBRelay) startPurge(pubkey nostr.PubKey, mode string) error {
+	previous := r.mgmt.PubKeyPurgeMode(pubkey)
+	if err := r.mgmt.SetPubKeyPurge(pubkey, mode); err != nil {
+		return err
+	}
+	if err := r.purger.Start(pubkey, mode); err != nil {
+		if restoreErr := r.mgmt.SetPubKeyPurge(pubkey, previous); restoreErr != nil {
+			slog.Warn("failed to restore purge mode", "component", "purge", "pubkey", pubkey.Hex(), "err", restoreErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// handleManagementMethod implements the custom NIP-86 methods.
+func (r *AMBRelay) handleManagementMethod(ctx context.Context, request nip86.Request) (nip86.Response, error) {
+	switch request.Method {
+	case "getcollectionschema":
+		schema, err := r.mgmt.LoadSchema()
+		if err != nil {
+			return nip86.Response{}, err
+		}
+		if schema == nil {
+			def := typesense30142.DefaultSchema()
+			schema = &def
+		}
+		return nip86.Response{Result: schema}, nil
+
+	case "updatecollectionschema":
+		if len(request.Params) == 0 {
+			return nip86.Response{Error: "missing schema parameter"}, nil
+		}
+		schemaJSON, err := json.Marshal(request.Params[0])
+		if err != nil {
+			return nip86.Response{Error: fmt.Sprintf("invalid schema: %v", err)}, nil
+		}
+		var schema typesense30142.CollectionSchema
+		if err := json.Unmarshal(schemaJSON, &schema); err != nil {
+			return nip86.Response{Error: fmt.Sprintf("invalid schema JSON: %v", err)}, nil
+		}
+		if err := r.mgmt.SaveSchema(schema); err != nil {
+			return nip86.Response{}, err
+		}
+		return nip86.Response{Result: true}, nil
+
+	case "resetcollectionschema":
+		if err := r.mgmt.DeleteSchema(); err != nil {
+			return nip86.Response{}, err
+		}
+		return nip86.Response{Result: true}, nil
+
+	case "reindex":
+		if len(request.Params) > 0 && request.Params[0] != nil {
+			filterJSON, err := json.Marshal(request.Params[0])
+			if err != nil {
+				return nip86.Response{Error: fmt.Sprintf("invalid filter: %v", err)}, nil
+			}
+			var filter nostr.Filter
+			if err := json.Unmarshal(filterJSON, &filter); err != nil {
+				return nip86.Response{Error: fmt.Sprintf("invalid filter JSON: %v", err)}, nil
+			}
+			if err := r.reindexer.StartSelective(filter); err != nil {
+				return nip86.Response{Error: err.Error()}, nil
+			}
+			return nip86.Response{Result: "selective reindex started"}, nil
+		}
+		if err := r.reindexer.Start(); err != nil {
+			return nip86.Response{Error: err.Error()}, nil
+		}
+		return nip86.Response{Result: "reindex started"}, nil
+
+	case "getreindexstatus":
+		return nip86.Response{Result: r.reindexer.GetStatus()}, nil
+
+	case "cancelreindex":
+		if err := r.reindexer.Cancel(); err != nil {
+			return nip86.Response{Error: err.Error()}, nil
+		}
+		return nip86.Response{Result: "reindex cancelled"}, nil
+
+	case "getreindexhistory":
+		jobs, err := r.mgmt.ListReindexJobs()
+		if err != nil {
+			return nip86.Response{}, err
+		}
+		return nip86.Response{Result: jobs}, nil
+
+	case "rollbackreindex":
+		versions, err := r.reindexer.Rollback()
+		if err != nil {
+			return nip86.Response{Error: err.Error()}, nil
+		}
+		return nip86.Response{Result: versions}, nil
+
+	case "purgepubkey":
+		if len(request.Params) < 2 {
+			return nip86.Response{Error: "expected params [pubkey, mode]"}, nil
+		}
+		pkHex, _ := request.Params[0].(string)
+		pubkey, err := nostr.PubKeyFromHex(pkHex)
+		if err != nil {
+			return nip86.Response{Error: fmt.Sprintf("invalid pubkey: %v", err)}, nil
+		}
+		mode, _ := request.Params[1].(string)
+		if mode != PurgeHide && mode != PurgeDelete {
+			return nip86.Response{Error: fmt.Sprintf("invalid mode %q (expected %q or %q)", mode, PurgeHide, PurgeDelete)}, nil
+		}
+		if !r.mgmt.IsPubKeyBanned(pubkey) {
+			return nip86.Response{Error: "pubkey is not banned"}, nil
+		}
+		if err := r.startPurge(pubkey, mode); err != nil {
+			return nip86.Response{Error: err.Error()}, nil
+		}
+		return nip86.Response{Result: "purge started"}, nil
+
+	case "getpurgestatus":
+		return nip86.Response{Result: r.purger.GetStatus()}, nil
+
+	case "getindexoutboxstatus":
+		return nip86.Response{Result: r.outbox.GetStatus()}, nil
+
+	case "retryindexoutbox":
+		moved, err := r.outbox.RetryFailed()
+		if err != nil {
+			return nip86.Response{}, err
+		}
+		return nip86.Response{Result: moved}, nil
+
+	case "verifyindex", "repairindex":
+		if r.reindexer.GetStatus().Running {
+			return nip86.Response{Error: "reindex in progress"}, nil
+		}
+		if err := r.verifier.Start(request.Method == "repairindex"); err != nil {
+			return nip86.Response{Error: err.Error()}, nil
+		}
+		return nip86.Response{Result: request.Method + " started"}, nil
+
+	case "getverifyindexstatus":
+		return nip86.Response{Result: r.verifier.GetStatus()}, nil
+
+	case "refreshstats":
+		stats, err := r.stats.Refresh()
+		if err != nil {
+			return nip86.Response{Error: err.Error()}, nil
+		}
+		return nip86.Response{Result: stats}, nil
+
+	case "getembeddingcachestats":
+		if r.embedCache == nil {
+			return nip86.Response{Error: "embedding cache not enabled"}, nil
+		}
+		return nip86.Response{Result: r.embedCache.GetStats()}, nil
+
+	case "clearembeddingcache":
+		if r.embedCache == nil {
+			return nip86.Response{Error: "embedding cache not enabled"}, nil
+		}
+		if err := r.embedCache.Clear(); err != nil {
+			return nip86.Response{}, err
+		}
+		return nip86.Response{Result: true}, nil
+
+	case "getembeddingprovider":
+		return nip86.Response{Result: map[string]any{
+			"config":    r.embedClient.Provider().Redacted(),
+			"providers": EmbedProviderNames(),
+		}}, nil
+
+	case "setembeddingprovider":
+		if len(request.Params) == 0 {
+			return nip86.Response{Error: "missing provider parameter"}, nil
+		}
+		providerJSON, err := json.Marshal(request.Params[0])
+		if err != nil {
+			return nip86.Response{Error: fmt.Sprintf("invalid provider: %v", err)}, nil
+		}
+		var provider EmbeddingProviderConfig
+		if err := json.Unmarshal(providerJSON, &provider); err != nil {
+			return nip86.Response{Error: fmt.Sprintf("invalid provider JSON: %v", err)}, nil
+		}
+		// Keep the current token unless a new one is given
+		current := r.embedClient.Provider()
+		if provider.Token == "" || provider.Token == "***" {
+			provider.Token = current.Token
+		}
+		if err := provider.Validate(); err != nil {
+			return nip86.Response{Error: err.Error()}, nil
+		}
+		if err := r.mgmt.SaveEmbeddingProvider(provider); err != nil {
+			return nip86.Response{}, err
+		}
+		addLogSecret(provider.Token)
+		r.switchEmbeddingProvider(provider)
+		return nip86.Response{Result: r.modelCheck.GetStatus()}, nil
+
+	case "resetembeddingprovider":
+		if err := r.mgmt.DeleteEmbeddingProvider(); err != nil {
+			return nip86.Response{}, err
+		}
+		r.switchEmbeddingProvider(validEmbeddingProvider(r.config.EmbedProvider))
+		return nip86.Response{Result: r.modelCheck.GetStatus()}, nil
+
+	case "getembeddingmodelstatus":
+		return nip86.Response{Result: r.modelCheck.GetStatus()}, nil
+
+	case "checkembeddingmodel":
+		if !r.embedClient.Configured() {
+			return nip86.Response{Error: "embedding service not configured (set EMBED_ENDPOINT or call setembeddingprovider)"}, nil
+		}
+		status := r.modelCheck.Run()
+		cfg, _ := r.mgmt.LoadSemanticConfig()
+		r.applySemanticConfig(cfg)
+		return nip86.Response{Result: status}, nil
+
+	case "getsemanticsearchconfig":
+		cfg, err := r.mgmt.LoadSemanticConfig()
+		if err != nil {
+			return nip86.Response{}, err
+		}
+		return nip86.Response{Result: cfg}, nil
+
+	case "updatesemanticsearchconfig":
+		if len(request.Params) == 0 {
+			return nip86.Response{Error: "missing config parameter"}, nil
+		}
+		cfgJSON, err := json.Marshal(request.Params[0])
+		if err != nil {
+			return nip86.Response{Error: fmt.Sprintf("invalid config: %v", err)}, nil
+		}
+		// Unknown keys are rejected rather than stored without effect
+		var cfg SemanticConfig
+		decoder := json.NewDecoder(bytes.NewReader(cfgJSON))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&cfg); err != nil {
+			return nip86.Response{Error: fmt.Sprintf("invalid config JSON: %v", err)}, nil
+		}
+		if err := ValidateSemanticConfig(cfg); err != nil {
+			return nip86.Response{Error: err.Error()}, nil
+		}
+		// The recorded model is maintained by the relay, not the caller
+		if current, err := r.mgmt.LoadSemanticConfig(); err == nil {
+			cfg.Model, cfg.Dimensions = current.Model, current.Dimensions
+		}
+		if err := r.mgmt.SaveSemanticConfig(cfg); err != nil {
+			return nip86.Response{}, err
+		}
+		// Update TSBackend config at runtime
+		r.applySemanticConfig(cfg)
+		return nip86.Response{Result: true}, nil
+
+	case "enablesemanticsearch":
+		if !r.embedClient.Configured() {
+			return nip86.Response{Error: "embedding service not configured (set EMBED_ENDPOINT or call setembeddingprovider)"}, nil
+		}
+		cfg, _ := r.mgmt.LoadSemanticConfig()
+		cfg.Enabled = true
+		if err := r.mgmt.SaveSemanticConfig(cfg); err != nil {
+			return nip86.Response{}, err
+		}
+		r.applySemanticConfig(cfg)
+		return nip86.Response{Result: true}, nil
+
+	case "disablesemanticsearch":
+		cfg, _ := r.mgmt.LoadSemanticConfig()
+		cfg.Enabled = false
+		if err := r.mgmt.SaveSemanticConfig(cfg); err != nil {
+			return nip86.Response{}, err
+		}
+		r.applySemanticConfig(cfg)
+		return nip86.Response{Result: true}, nil
+
+	default:
+		return nip86.Response{Error: fmt.Sprintf("unknown method '%s'", request.Method)}, nil
+	}
+}
@@ -0,0 +1,836 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore/boltdb"
+	"fiatjaf.com/nostr/eventstore/typesense30142"
+	"go.etcd.io/bbolt"
+)
+
+var (
+	bucketIndexOutbox         = []byte("index_outbox")
+	bucketIndexOutboxFailed   = []byte("index_outbox_failed")
+	bucketIndexOutboxMirrored = []byte("index_outbox_mirrored")
+)
+
+const (
+	outboxOpSave    = "save"
+	outboxOpReplace = "replace"
+	outboxOpDelete  = "delete"
+
+	// outboxMaxAttempts is how often an operation is retried before it is
+	// moved to the failed bucket. With the backoff cap this is roughly 1.5h.
+	// A failing operation only holds back later operations on the same event
+	// or address.
+	outboxMaxAttempts = 25
+	outboxMinBackoff  = time.Second
+	outboxMaxBackoff  = 5 * time.Minute
+	// outboxWaitTimeout bounds how long Wait blocks for an index operation
+	// before giving up on it (the operation stays queued).
+	outboxWaitTimeout = 5 * time.Second
+	// outboxConfirmTimeout is how long an unconfirmed entry may block the
+	// outbox before it is reconciled against BoltDB.
+	outboxConfirmTimeout = 30 * time.Second
+	// outboxDrainInterval is how often Drain checks whether the outbox is empty.
+	outboxDrainInterval = 50 * time.Millisecond
+)
+
+// outboxEntry is a pending index operation. Entries are written before the
+// BoltDB write and only become Ready once it succeeded, so a crash in between
+// never indexes an event that was not persisted.
+type outboxEntry struct {
+	Op         string       `json:"op"`
+	Event      *nostr.Event `json:"event,omitempty"`
+	ID         string       `json:"id"`
+	Ready      bool         `json:"ready"`
+	Attempts   int          `json:"attempts"`
+	LastError  string       `json:"last_error,omitempty"`
+	EnqueuedAt int64        `json:"enqueued_at"`
+}
+
+// outboxItem is what the worker needs to know about a queued entry to pick
+// the next one; the entry itself is only read from the bucket once picked.
+type outboxItem struct {
+	seq        uint64
+	keys       []string
+	ready      bool
+	attempts   int
+	enqueuedAt int64
+}
+
+func newOutboxItem(seq uint64, entry outboxEntry) outboxItem {
+	return outboxItem{
+		seq:        seq,
+		keys:       entry.keys(),
+		ready:      entry.Ready,
+		attempts:   entry.Attempts,
+		enqueuedAt: entry.EnqueuedAt,
+	}
+}
+
+type OutboxStatus struct {
+	Pending       int    `json:"pending"`
+	Failed        int    `json:"failed"`
+	Applied       int64  `json:"applied"`
+	Retries       int64  `json:"retries"`
+	OldestPending string `json:"oldest_pending,omitempty"`
+	HeadAttempts  int    `json:"head_attempts"`
+	LastError     string `json:"last_error,omitempty"`
+}
+
+// IndexOutbox keeps Typesense in sync with BoltDB. Every write to BoltDB is
+// paired with an entry in a bbolt bucket that a background worker drains into
+// the TSBackend, retrying with exponential backoff while Typesense is down.
+type IndexOutbox struct {
+	DB     *bbolt.DB
+	tsDB   *typesense30142.TSBackend
+	boltDB *boltdb.BoltBackend
+
+	wake    chan struct{}
+	mu      sync.Mutex
+	waiters map[uint64]chan error
+	applied atomic.Int64
+	retries atomic.Int64
+	lastErr atomic.Value // stores string
+
+	// queue mirrors the outbox bucket in seq order. It is changed under
+	// queueMu together with the bucket, so it never shows an entry that is
+	// not committed or misses one that is.
+	queueMu sync.Mutex
+	queue   []outboxItem
+
+	// Metrics, if set, records the latency and errors of index operations.
+	Metrics *Metrics
+	// OnApplied, if set, is called after an operation reached the index.
+	OnApplied func(entry outboxEntry)
+
+	// applyMu serializes index operations with mirror changes, so a reindex
+	// can swap collections without an operation landing in between.
+	applyMu sync.Mutex
+	mirror  *typesense30142.TSBackend
+	// mirroring is set while applied operations are recorded in the mirrored
+	// bucket for the reindex to replay. The bucket outlives a restart, so a
+	// resumed reindex also replays the writes applied before it resumed.
+	mirroring bool
+	// taken is the last recorded operation returned by TakeMirrored.
+	taken uint64
+}
+
+func NewIndexOutbox(tsDB *typesense30142.TSBackend, boltDB *boltdb.BoltBackend) *IndexOutbox {
+	return &IndexOutbox{
+		tsDB:    tsDB,
+		boltDB:  boltDB,
+		wake:    make(chan struct{}, 1),
+		waiters: map[uint64]chan error{},
+	}
+}
+
+// Init creates the outbox buckets and resolves entries left unconfirmed by a
+// crash between enqueueing and the BoltDB write.
+func (o *IndexOutbox) Init(db *bbolt.DB) error {
+	o.DB = db
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		for _, bucket := range [][]byte{bucketIndexOutbox, bucketIndexOutboxFailed} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		// A reindex was interrupted; keep recording until it resumes
+		o.mirroring = tx.Bucket(bucketIndexOutboxMirrored) != nil
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// Collect first so no read transaction is open while querying BoltDB
+	unconfirmed := map[uint64]outboxEntry{}
+	o.queueMu.Lock()
+	o.queue = nil
+	db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketIndexOutbox).ForEach(func(k, v []byte) error {
+			var entry outboxEntry
+			if json.Unmarshal(v, &entry) != nil {
+				return nil
+			}
+			seq := binary.BigEndian.Uint64(k)
+			o.queue = append(o.queue, newOutboxItem(seq, entry))
+			if !entry.Ready {
+				unconfirmed[seq] = entry
+			}
+			return nil
+		})
+	})
+	o.queueMu.Unlock()
+	for seq, entry := range unconfirmed {
+		o.reconcile(seq, entry)
+	}
+	return nil
+}
+
+// reconcile confirms or drops an unconfirmed entry by checking whether its
+// BoltDB write actually happened.
+func (o *IndexOutbox) reconcile(seq uint64, entry outboxEntry) {
+	stored := false
+	for range o.boltDB.QueryEvents(nostr.Filter{IDs: []nostr.ID{entry.eventID()}}, 1) {
+		stored = true
+	}
+	// A save must have reached BoltDB, a delete must have removed the event
+	if stored == (entry.Op != outboxOpDelete) {
+		o.Commit(seq)
+	} else {
+		o.Discard(seq)
+	}
+}
+
+// Enqueue records a pending index operation. It is not processed until Commit is called.
+func (o *IndexOutbox) Enqueue(op string, event *nostr.Event, id nostr.ID) (uint64, error) {
+	return o.enqueue(outboxEntry{Op: op, Event: event, ID: id.Hex()})
+}
+
+// Queue records an index operation without a BoltDB write of its own, e.g.
+// hiding the events of a banned pubkey, so it is applied in order with the
+// writes queued before it.
+func (o *IndexOutbox) Queue(op string, event *nostr.Event, id nostr.ID) (uint64, error) {
+	seq, err := o.enqueue(outboxEntry{Op: op, Event: event, ID: id.Hex(), Ready: true})
+	o.notify()
+	return seq, err
+}
+
+func (o *IndexOutbox) enqueue(entry outboxEntry) (uint64, error) {
+	var seq uint64
+	entry.EnqueuedAt = time.Now().Unix()
+	err := o.updateQueue(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucketIndexOutbox)
+		var err error
+		if seq, err = b.NextSequence(); err != nil {
+			return err
+		}
+		val, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return b.Put(outboxKey(seq), val)
+	}, func() {
+		o.setItem(newOutboxItem(seq, entry))
+	})
+	return seq, err
+}
+
+// Commit marks an operation as ready once the BoltDB write succeeded.
+func (o *IndexOutbox) Commit(seq uint64) error {
+	var entry outboxEntry
+	found := false
+	err := o.updateQueue(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucketIndexOutbox)
+		val := b.Get(outboxKey(seq))
+		if val == nil {
+			return nil
+		}
+		if err := json.Unmarshal(val, &entry); err != nil {
+			return err
+		}
+		entry.Ready, found = true, true
+		updated, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return b.Put(outboxKey(seq), updated)
+	}, func() {
+		if found {
+			o.setItem(newOutboxItem(seq, entry))
+		}
+	})
+	o.notify()
+	return err
+}
+
+// Discard drops an operation whose BoltDB write failed.
+func (o *IndexOutbox) Discard(seq uint64) error {
+	err := o.remove(seq)
+	o.notify()
+	return err
+}
+
+// remove deletes an operation from the outbox.
+func (o *IndexOutbox) remove(seq uint64) error {
+	return o.updateQueue(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketIndexOutbox).Delete(outboxKey(seq))
+	}, func() {
+		o.removeItem(seq)
+	})
+}
+
+// Wait blocks until the first attempt to apply operation seq finished and
+// returns its result, or returns nil after outboxWaitTimeout. Writes do not
+// wait; the reindex uses it to pace its batches.
+func (o *IndexOutbox) Wait(ctx context.Context, seq uint64) error {
+	ch := make(chan error, 1)
+	o.mu.Lock()
+	o.waiters[seq] = ch
+	o.mu.Unlock()
+	defer func() {
+		o.mu.Lock()
+		delete(o.waiters, seq)
+		o.mu.Unlock()
+	}()
+
+	// The worker may have finished before we registered
+	if !o.isPending(seq) {
+		return nil
+	}
+
+	select {
+	case err := <-ch:
+		return err
+	case <-time.After(outboxWaitTimeout):
+		return nil
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// Run drains the outbox into Typesense until ctx is cancelled. Operations
+// on the same event or address are applied in order; a failing one is
+// retried with backoff without holding back the others. While Typesense
+// cannot be reached at all, the whole outbox pauses instead.
+func (o *IndexOutbox) Run(ctx context.Context) {
+	var unreachable int // consecutive failures to reach Typesense
+	var pausedUntil time.Time
+	// retryAt holds when failed operations are due again; after a restart
+	// they are retried right away
+	retryAt := map[uint64]time.Time{}
+	for {
+		wait := time.Until(pausedUntil)
+		if wait <= 0 {
+			seq, entry, ok, retryIn := o.next(retryAt)
+			if ok && !entry.Ready {
+				// The writer never confirmed or discarded the entry
+				o.reconcile(seq, entry)
+				continue
+			}
+			if ok {
+				err := o.apply(entry)
+				o.resolve(seq, err)
+				delete(retryAt, seq)
+				if err == nil {
+					unreachable = 0
+					o.applied.Add(1)
+					o.remove(seq)
+					if o.OnApplied != nil {
+						o.OnApplied(entry)
+					}
+					continue
+				}
+				if o.fail(seq, entry, err) {
+					retryAt[seq] = time.Now().Add(outboxBackoff(entry.Attempts + 1))
+				}
+				var netErr net.Error
+				if errors.As(err, &netErr) {
+					unreachable++
+					pausedUntil = time.Now().Add(outboxBackoff(unreachable))
+				}
+				continue
+			}
+			wait = retryIn
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-o.wake:
+			if time.Until(pausedUntil) > 0 {
+				// Only new operations woke us, keep waiting for Typesense
+				continue
+			}
+		case <-time.After(min(wait, time.Second)):
+		}
+	}
+}
+
+// next returns the oldest operation to apply now: one that is not waiting
+// for a retry, with no earlier operation on its event or address still
+// queued. Unconfirmed entries are returned once they exceed
+// outboxConfirmTimeout. If there is none, retryIn is how long until the next
+// retry is due. Only the picked entry is read from the bucket.
+func (o *IndexOutbox) next(retryAt map[uint64]time.Time) (seq uint64, entry outboxEntry, ok bool, retryIn time.Duration) {
+	retryIn = outboxMaxBackoff
+	now := time.Now()
+	o.queueMu.Lock()
+	blocked := map[string]bool{}
+	for _, item := range o.queue {
+		isBlocked := false
+		for _, key := range item.keys {
+			isBlocked = isBlocked || blocked[key]
+		}
+		wait := time.Duration(0)
+		if !item.ready {
+			wait = time.Until(time.Unix(item.enqueuedAt, 0).Add(outboxConfirmTimeout))
+		} else if at, ok := retryAt[item.seq]; ok {
+			wait = at.Sub(now)
+		}
+		if !isBlocked && wait <= 0 {
+			seq, ok = item.seq, true
+			break
+		}
+		if !isBlocked {
+			retryIn = min(retryIn, wait)
+		}
+		for _, key := range item.keys {
+			blocked[key] = true
+		}
+	}
+	o.queueMu.Unlock()
+	if !ok {
+		return 0, entry, false, retryIn
+	}
+
+	err := o.DB.View(func(tx *bbolt.Tx) error {
+		val := tx.Bucket(bucketIndexOutbox).Get(outboxKey(seq))
+		if val == nil {
+			// Discarded since it was picked
+			return errOutboxEntryGone
+		}
+		return json.Unmarshal(val, &entry)
+	})
+	if err != nil {
+		return 0, entry, false, outboxDrainInterval
+	}
+	return seq, entry, true, 0
+}
+
+// errOutboxEntryGone is returned when a picked entry was removed meanwhile.
+var errOutboxEntryGone = errors.New("outbox entry removed")
+
+// QueueIf queues an operation that is only valid while keep reports true,
+// e.g. re-upserting an event read from BoltDB a while ago. The entry is
+// enqueued unconfirmed, which holds back later operations on its event and
+// address, and dropped if an earlier operation on them is still queued or
+// keep returns false: a write queued before it either is still pending or
+// already changed what keep checks. The returned seq is 0 if it was dropped.
+func (o *IndexOutbox) QueueIf(op string, event *nostr.Event, id nostr.ID, keep func() bool) (uint64, error) {
+	entry := outboxEntry{Op: op, Event: event, ID: id.Hex()}
+	seq, err := o.enqueue(entry)
+	if err != nil {
+		return 0, err
+	}
+	if o.pendingBefore(seq, entry.keys()) || !keep() {
+		return 0, o.Discard(seq)
+	}
+	return seq, o.Commit(seq)
+}
+
+// pendingBefore reports whether an operation queued before seq is ordered
+// by any of keys.
+func (o *IndexOutbox) pendingBefore(seq uint64, keys []string) bool {
+	o.queueMu.Lock()
+	defer o.queueMu.Unlock()
+	for _, item := range o.queue {
+		if item.seq >= seq {
+			break
+		}
+		for _, key := range item.keys {
+			if slices.Contains(keys, key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fail records a failed attempt, or moves the operation to the failed bucket
+// once it exhausted its attempts. It reports whether the operation stays queued.
+func (o *IndexOutbox) fail(seq uint64, entry outboxEntry, err error) bool {
+	entry.Attempts++
+	entry.LastError = err.Error()
+	o.retries.Add(1)
+	o.lastErr.Store(fmt.Sprintf("%s %s: %v", entry.Op, entry.ID, err))
+	slog.Warn("index operation failed", "component", "outbox", "op", entry.Op, "id", entry.ID, "attempt", entry.Attempts, "err", err)
+
+	giveUp := entry.Attempts >= outboxMaxAttempts
+	o.updateQueue(func(tx *bbolt.Tx) error {
+		val, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if giveUp {
+			if err := tx.Bucket(bucketIndexOutboxFailed).Put(outboxKey(seq), val); err != nil {
+				return err
+			}
+			return tx.Bucket(bucketIndexOutbox).Delete(outboxKey(seq))
+		}
+		return tx.Bucket(bucketIndexOutbox).Put(outboxKey(seq), val)
+	}, func() {
+		if giveUp {
+			o.removeItem(seq)
+		} else {
+			o.setItem(newOutboxItem(seq, entry))
+		}
+	})
+	if giveUp {
+		slog.Error("giving up on index operation", "component", "outbox", "op", entry.Op, "id", entry.ID, "attempts", entry.Attempts)
+	}
+	return !giveUp
+}
+
+// errOutboxFailing is returned by Drain when only failing operations are left.
+var errOutboxFailing = errors.New("remaining index operations are failing")
+
+// Drain waits until the worker applied every queued operation, or returns
+// ctx.Err() once ctx is done. It gives up early with errOutboxFailing when
+// every operation left has failed and waits for its retry. Operations still
+// queued stay in the bucket and are applied after the next start.
+func (o *IndexOutbox) Drain(ctx context.Context) error {
+	for {
+		o.queueMu.Lock()
+		empty := len(o.queue) == 0
+		o.queueMu.Unlock()
+		if empty {
+			return nil
+		}
+		if o.onlyFailing() {
+			return errOutboxFailing
+		}
+		o.notify()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(outboxDrainInterval):
+		}
+	}
+}
+
+// onlyFailing reports whether every queued operation failed at least once
+// or waits behind one that did.
+func (o *IndexOutbox) onlyFailing() bool {
+	o.queueMu.Lock()
+	defer o.queueMu.Unlock()
+	stuck := map[string]bool{}
+	for _, item := range o.queue {
+		blocked := item.attempts > 0
+		for _, key := range item.keys {
+			blocked = blocked || stuck[key]
+		}
+		if !blocked {
+			return false
+		}
+		for _, key := range item.keys {
+			stuck[key] = true
+		}
+	}
+	return true
+}
+
+// RetryFailed moves operations that exhausted their attempts back into the outbox.
+func (o *IndexOutbox) RetryFailed() (int, error) {
+	var moved int
+	var items []outboxItem
+	err := o.updateQueue(func(tx *bbolt.Tx) error {
+		failed := tx.Bucket(bucketIndexOutboxFailed)
+		outbox := tx.Bucket(bucketIndexOutbox)
+		var keys [][]byte
+		err := failed.ForEach(func(k, v []byte) error {
+			var entry outboxEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			entry.Attempts = 0
+			val, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			seq, err := outbox.NextSequence()
+			if err != nil {
+				return err
+			}
+			keys = append(keys, append([]byte(nil), k...))
+			items = append(items, newOutboxItem(seq, entry))
+			moved++
+			return outbox.Put(outboxKey(seq), val)
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := failed.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func() {
+		for _, item := range items {
+			o.setItem(item)
+		}
+	})
+	o.notify()
+	return moved, err
+}
+
+// GetStatus returns the current outbox status.
+func (o *IndexOutbox) GetStatus() OutboxStatus {
+	status := OutboxStatus{
+		Applied: o.applied.Load(),
+		Retries: o.retries.Load(),
+	}
+	o.DB.View(func(tx *bbolt.Tx) error {
+		status.Pending = tx.Bucket(bucketIndexOutbox).Stats().KeyN
+		status.Failed = tx.Bucket(bucketIndexOutboxFailed).Stats().KeyN
+		if _, v := tx.Bucket(bucketIndexOutbox).Cursor().First(); v != nil {
+			var entry outboxEntry
+			if json.Unmarshal(v, &entry) == nil {
+				status.OldestPending = time.Since(time.Unix(entry.EnqueuedAt, 0)).Round(time.Second).String()
+				status.HeadAttempts = entry.Attempts
+			}
+		}
+		return nil
+	})
+	if v := o.lastErr.Load(); v != nil {
+		if s, ok := v.(string); ok {
+			status.LastError = s
+		}
+	}
+	return status
+}
+
+// StartMirror makes every applied operation also go to ts, e.g. a collection
+// being rebuilt by a reindex, and records it for TakeMirrored. A resumed
+// reindex keeps the operations recorded before it was interrupted.
+func (o *IndexOutbox) StartMirror(ts *typesense30142.TSBackend, resume bool) error {
+	o.applyMu.Lock()
+	defer o.applyMu.Unlock()
+	err := o.DB.Update(func(tx *bbolt.Tx) error {
+		if !resume && tx.Bucket(bucketIndexOutboxMirrored) != nil {
+			if err := tx.DeleteBucket(bucketIndexOutboxMirrored); err != nil {
+				return err
+			}
+		}
+		_, err := tx.CreateBucketIfNotExists(bucketIndexOutboxMirrored)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	o.mirror, o.mirroring, o.taken = ts, true, 0
+	return nil
+}
+
+// TakeMirrored returns the operations recorded since the last call, in order.
+// After a restart, the first call also returns those recorded before it.
+func (o *IndexOutbox) TakeMirrored() []outboxEntry {
+	o.applyMu.Lock()
+	defer o.applyMu.Unlock()
+	return o.takeMirrored()
+}
+
+func (o *IndexOutbox) takeMirrored() []outboxEntry {
+	var entries []outboxEntry
+	o.DB.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucketIndexOutboxMirrored)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Seek(outboxKey(o.taken + 1)); k != nil; k, v = c.Next() {
+			var entry outboxEntry
+			if err := json.Unmarshal(v, &entry); err == nil {
+				entries = append(entries, entry)
+			}
+			o.taken = binary.BigEndian.Uint64(k)
+		}
+		return nil
+	})
+	return entries
+}
+
+// DetachMirror stops applying operations to the mirror but keeps recording
+// them, so a reindex interrupted by a shutdown replays them once it resumed.
+func (o *IndexOutbox) DetachMirror() {
+	o.applyMu.Lock()
+	o.mirror = nil
+	o.applyMu.Unlock()
+}
+
+// StopMirror runs fn while no operation is being applied, then stops mirroring
+// and drops the recorded operations. Operations recorded but not yet taken are
+// passed to fn.
+func (o *IndexOutbox) StopMirror(fn func(pending []outboxEntry)) {
+	o.applyMu.Lock()
+	defer o.applyMu.Unlock()
+	if fn != nil {
+		fn(o.takeMirrored())
+	}
+	o.DB.Update(func(tx *bbolt.Tx) error {
+		if tx.Bucket(bucketIndexOutboxMirrored) == nil {
+			return nil
+		}
+		return tx.DeleteBucket(bucketIndexOutboxMirrored)
+	})
+	o.mirror, o.mirroring, o.taken = nil, false, 0
+}
+
+func (o *IndexOutbox) apply(entry outboxEntry) error {
+	o.applyMu.Lock()
+	defer o.applyMu.Unlock()
+	start := time.Now()
+	err := applyOutboxEntry(o.tsDB, entry)
+	o.Metrics.ObserveTypesense(entry.Op, start, err)
+	if err != nil {
+		return err
+	}
+	if o.mirroring {
+		// Recorded so the reindex can replay it after its bulk copy
+		if err := o.recordMirrored(entry); err != nil {
+			slog.Warn("failed to record mirrored operation", "component", "outbox", "op", entry.Op, "id", entry.ID, "err", err)
+		}
+	}
+	if o.mirror != nil {
+		if err := applyOutboxEntry(o.mirror, entry); err != nil {
+			slog.Warn("mirror operation failed", "component", "outbox", "op", entry.Op, "id", entry.ID, "err", err)
+		}
+	}
+	return nil
+}
+
+// recordMirrored appends an applied operation to the mirrored bucket.
+func (o *IndexOutbox) recordMirrored(entry outboxEntry) error {
+	return o.DB.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucketIndexOutboxMirrored)
+		if b == nil {
+			return nil
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		val, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return b.Put(outboxKey(seq), val)
+	})
+}
+
+// SetEmbedding changes the embedder and fields of the TSBackend between two
+// index operations, since building a document reads them.
+func (o *IndexOutbox) SetEmbedding(embedder typesense30142.Embedder, fields []string) {
+	o.applyMu.Lock()
+	defer o.applyMu.Unlock()
+	o.tsDB.Embedder, o.tsDB.EmbedFields = embedder, fields
+}
+
+func applyOutboxEntry(ts *typesense30142.TSBackend, entry outboxEntry) error {
+	switch entry.Op {
+	case outboxOpSave:
+		return ts.SaveEvent(*entry.Event)
+	case outboxOpReplace:
+		return ts.ReplaceEvent(*entry.Event)
+	case outboxOpDelete:
+		return ts.DeleteEvent(entry.eventID())
+	default:
+		return fmt.Errorf("unknown outbox operation %q", entry.Op)
+	}
+}
+
+// keys are what the operation is ordered by: its event ID and, for saves
+// and replaces, the address, whose older versions a replace removes.
+func (e outboxEntry) keys() []string {
+	keys := []string{e.ID}
+	if e.Event != nil {
+		keys = append(keys, eventAddress(*e.Event))
+	}
+	return keys
+}
+
+func (e outboxEntry) eventID() nostr.ID {
+	id, _ := nostr.IDFromHex(e.ID)
+	return id
+}
+
+// updateQueue runs fn in a write transaction and applies change to the
+// in-memory queue once it committed. Holding queueMu across both keeps a
+// concurrent QueueIf from missing an entry that is already in the bucket.
+func (o *IndexOutbox) updateQueue(fn func(tx *bbolt.Tx) error, change func()) error {
+	o.queueMu.Lock()
+	defer o.queueMu.Unlock()
+	if err := o.DB.Update(fn); err != nil {
+		return err
+	}
+	change()
+	return nil
+}
+
+// setItem adds or replaces an item of the queue; queueMu must be held.
+func (o *IndexOutbox) setItem(item outboxItem) {
+	i, found := slices.BinarySearchFunc(o.queue, item.seq, compareOutboxItem)
+	if found {
+		o.queue[i] = item
+	} else {
+		o.queue = slices.Insert(o.queue, i, item)
+	}
+}
+
+// removeItem drops an item from the queue; queueMu must be held.
+func (o *IndexOutbox) removeItem(seq uint64) {
+	i, found := slices.BinarySearchFunc(o.queue, seq, compareOutboxItem)
+	switch {
+	case !found:
+	case i == 0:
+		// The common case while draining; avoids moving the rest of the queue
+		o.queue = o.queue[1:]
+	default:
+		o.queue = slices.Delete(o.queue, i, i+1)
+	}
+}
+
+func compareOutboxItem(item outboxItem, seq uint64) int {
+	return cmp.Compare(item.seq, seq)
+}
+
+func (o *IndexOutbox) isPending(seq uint64) bool {
+	o.queueMu.Lock()
+	defer o.queueMu.Unlock()
+	_, found := slices.BinarySearchFunc(o.queue, seq, compareOutboxItem)
+	return found
+}
+
+func (o *IndexOutbox) resolve(seq uint64, err error) {
+	o.mu.Lock()
+	if ch, ok := o.waiters[seq]; ok {
+		ch <- err
+		delete(o.waiters, seq)
+	}
+	o.mu.Unlock()
+}
+
+func (o *IndexOutbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+func outboxKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+func outboxBackoff(attempts int) time.Duration {
+	backoff := outboxMinBackoff
+	for i := 1; i < attempts && backoff < outboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, outboxMaxBackoff)
+}
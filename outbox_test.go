@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// newRejectingOutbox runs an outbox on a collection of ts behind a proxy that
+// answers 400 to every document write containing reject.
+func newRejectingOutbox(t *testing.T, ts *fakeTypesense, reject string) *IndexOutbox {
+	t.Helper()
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if bytes.Contains(body, []byte(reject)) {
+			http.Error(w, `{"message": "Field name has an invalid value."}`, http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		ts.Config.Handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(proxy.Close)
+
+	tsDB := newTestTSBackend(t, ts, "amb")
+	tsDB.Host = proxy.URL
+	db := newTestBolt(t)
+	o := NewIndexOutbox(tsDB, db)
+	if err := o.Init(db.DB); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		o.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return o
+}
+
+// waitIndexed waits until the collection has a document for id.
+func waitIndexed(t *testing.T, ts *fakeTypesense, id nostr.ID) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := ts.collectionDocs("amb")[id.Hex()]; ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("event %s was not indexed", id.Hex())
+}
+
+func TestOutboxRejectedOperationDoesNotBlockOthers(t *testing.T) {
+	ts := newFakeTypesense(t)
+	o := newRejectingOutbox(t, ts, "Rejected")
+	alice, bob := testPubKey("alice"), testPubKey("bob")
+
+	rejected := makeEvent(alice, "broken", "Rejected", 1000)
+	newer := makeEvent(alice, "broken", "Fixed", 2000)
+	other := makeEvent(bob, "physics-101", "Physics 101", 1000)
+	for _, op := range []struct {
+		op    string
+		event nostr.Event
+	}{{outboxOpSave, rejected}, {outboxOpReplace, newer}, {outboxOpSave, other}} {
+		if _, err := o.Queue(op.op, &op.event, op.event.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitIndexed(t, ts, other.ID)
+	if _, ok := ts.collectionDocs("amb")[newer.ID.Hex()]; ok {
+		t.Error("replace of the same address was applied before the rejected save")
+	}
+	if status := o.GetStatus(); status.Pending != 2 || status.HeadAttempts == 0 {
+		t.Errorf("status = %+v, want the rejected save and the replace queued", status)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := o.Drain(ctx); !errors.Is(err, errOutboxFailing) {
+		t.Errorf("Drain = %v, want %v without waiting for retries", err, errOutboxFailing)
+	}
+}
+
+func TestOutboxQueueIf(t *testing.T) {
+	db := newTestBolt(t)
+	o := NewIndexOutbox(newTestTSBackend(t, newFakeTypesense(t), "amb"), db)
+	if err := o.Init(db.DB); err != nil {
+		t.Fatal(err)
+	}
+	alice := testPubKey("alice")
+	event := makeEvent(alice, "physics-101", "Physics 101", 1000)
+
+	if seq, err := o.QueueIf(outboxOpSave, &event, event.ID, func() bool { return false }); err != nil || seq != 0 {
+		t.Errorf("QueueIf with keep false = %d, %v, want dropped", seq, err)
+	}
+	if seq, err := o.QueueIf(outboxOpSave, &event, event.ID, func() bool { return true }); err != nil || seq == 0 {
+		t.Errorf("QueueIf = %d, %v, want queued", seq, err)
+	}
+	// A newer version of the address queued before the re-upsert wins
+	older := makeEvent(alice, "physics-101", "Physics", 500)
+	if seq, err := o.QueueIf(outboxOpSave, &older, older.ID, func() bool { return true }); err != nil || seq != 0 {
+		t.Errorf("QueueIf behind a queued write = %d, %v, want dropped", seq, err)
+	}
+	if status := o.GetStatus(); status.Pending != 1 {
+		t.Errorf("pending = %d, want 1", status.Pending)
+	}
+}
+
+func TestOutboxAppliesQueueAfterRestart(t *testing.T) {
+	ts := newFakeTypesense(t)
+	tsDB := newTestTSBackend(t, ts, "amb")
+	db := newTestBolt(t)
+	o := NewIndexOutbox(tsDB, db)
+	if err := o.Init(db.DB); err != nil {
+		t.Fatal(err)
+	}
+	alice := testPubKey("alice")
+	first := makeEvent(alice, "physics-101", "Physics 101", 1000)
+	second := makeEvent(alice, "chemistry-101", "Chemistry 101", 1000)
+	if _, err := o.Queue(outboxOpSave, &first, first.ID); err != nil {
+		t.Fatal(err)
+	}
+	// Confirmed after the restart, since its BoltDB write happened
+	if _, err := o.Enqueue(outboxOpSave, &second, second.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveEvent(second); err != nil {
+		t.Fatal(err)
+	}
+
+	// The worker of a new outbox picks up what the old one left queued
+	restarted := NewIndexOutbox(tsDB, db)
+	if err := restarted.Init(db.DB); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		restarted.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer drainCancel()
+	if err := restarted.Drain(drainCtx); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	for _, event := range []nostr.Event{first, second} {
+		if _, ok := ts.collectionDocs("amb")[event.ID.Hex()]; !ok {
+			t.Errorf("event %s queued before the restart was not indexed", event.ID.Hex())
+		}
+	}
+}
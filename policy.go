@@ -0,0 +1,38 @@
+package main
+
+import "fiatjaf.com/nostr"
+
+// Reasons checkEvent rejects an event for, used as metric labels.
+const (
+	rejectBannedPubKey = "banned_pubkey"
+	rejectBannedEvent  = "banned_event"
+	rejectKind         = "unsupported_kind"
+	rejectMissingD     = "missing_d_tag"
+	rejectMissingName  = "missing_name_tag"
+)
+
+// checkEvent is the write policy of the relay: events of banned pubkeys and
+// banned events are rejected, deletions are accepted, and everything else must
+// be a kind 30142 event with a d and a name tag. reason is one of the reject
+// constants, or "" if the event is accepted.
+func checkEvent(mgmt *ManagementStore, event nostr.Event) (reason, msg string) {
+	if mgmt.IsPubKeyBanned(event.PubKey) {
+		return rejectBannedPubKey, "pubkey is banned"
+	}
+	if mgmt.IsEventBanned(event.ID) {
+		return rejectBannedEvent, "event is banned"
+	}
+	if event.Kind == nostr.KindDeletion {
+		return "", ""
+	}
+	if event.Kind != 30142 {
+		return rejectKind, "only kind 30142 events are accepted"
+	}
+	if event.Tags.GetD() == "" {
+		return rejectMissingD, "missing required 'd' tag"
+	}
+	if !event.Tags.Has("name") {
+		return rejectMissingName, "missing required 'name' tag"
+	}
+	return "", ""
+}
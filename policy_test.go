@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestCheckEvent(t *testing.T) {
+	mgmt := newTestManagement(t, newTestBolt(t))
+
+	alice, mallory := testPubKey("alice"), testPubKey("mallory")
+	if err := mgmt.BanPubKey(mallory, "spam"); err != nil {
+		t.Fatal(err)
+	}
+	banned := makeEvent(alice, "banned", "Banned", 1000)
+	if err := mgmt.BanEvent(banned.ID, "off-topic", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	valid := makeEvent(alice, "valid", "Valid", 1000)
+	noD := makeEvent(alice, "", "No d", 1000)
+	noD.Tags = nostr.Tags{{"name", "No d"}}
+	noName := makeEvent(alice, "no-name", "", 1000)
+	noName.Tags = nostr.Tags{{"d", "no-name"}}
+	note := makeEvent(alice, "note", "Note", 1000)
+	note.Kind = 1
+	deletion := makeEvent(alice, "", "", 1000)
+	deletion.Kind = nostr.KindDeletion
+	deletion.Tags = nostr.Tags{{"e", valid.ID.Hex()}}
+	bannedDeletion := deletion
+	bannedDeletion.PubKey = mallory
+
+	tests := []struct {
+		name   string
+		event  nostr.Event
+		reason string
+		msg    string
+	}{
+		{"valid", valid, "", ""},
+		{"banned pubkey", makeEvent(mallory, "x", "X", 1000), rejectBannedPubKey, "pubkey is banned"},
+		{"banned event", banned, rejectBannedEvent, "event is banned"},
+		{"deletion", deletion, "", ""},
+		{"deletion by banned pubkey", bannedDeletion, rejectBannedPubKey, "pubkey is banned"},
+		{"other kind", note, rejectKind, "only kind 30142 events are accepted"},
+		{"missing d", noD, rejectMissingD, "missing required 'd' tag"},
+		{"missing name", noName, rejectMissingName, "missing required 'name' tag"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, msg := checkEvent(mgmt, tt.event)
+			if reason != tt.reason || msg != tt.msg {
+				t.Errorf("checkEvent = (%q, %q), want (%q, %q)", reason, msg, tt.reason, tt.msg)
+			}
+		})
+	}
+}
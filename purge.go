@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore/boltdb"
+	"fiatjaf.com/nostr/eventstore/typesense30142"
+)
+
+// Purge modes for events of a banned pubkey.
+const (
+	PurgeNone    = "none"    // leave existing events in place
+	PurgeHide    = "hide"    // remove from Typesense, keep in BoltDB
+	PurgeDelete  = "delete"  // remove from Typesense and BoltDB
+	PurgeRestore = "restore" // re-index events kept in BoltDB
+)
+
+// ValidPurgeMode reports whether mode is a purge mode that can be applied to a banned pubkey.
+func ValidPurgeMode(mode string) bool {
+	return mode == PurgeNone || mode == PurgeHide || mode == PurgeDelete
+}
+
+type PurgeStatus struct {
+	Running   bool   `json:"running"`
+	PubKey    string `json:"pubkey,omitempty"`
+	Mode      string `json:"mode,omitempty"`
+	Total     int64  `json:"total"`
+	Processed int64  `json:"processed"`
+	Errors    int64  `json:"errors"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Purger hides, deletes or restores all events of a single pubkey in the
+// background. Index changes go through the outbox, so they are applied in
+// order with writes queued before them.
+type Purger struct {
+	tsDB   *typesense30142.TSBackend
+	boltDB *boltdb.BoltBackend
+	mgmt   *ManagementStore
+	outbox *IndexOutbox
+
+	mu        sync.Mutex
+	pubkey    nostr.PubKey
+	mode      string
+	running   atomic.Bool
+	total     atomic.Int64
+	processed atomic.Int64
+	errors    atomic.Int64
+	lastErr   atomic.Value // stores string
+}
+
+func NewPurger(tsDB *typesense30142.TSBackend, boltDB *boltdb.BoltBackend, mgmt *ManagementStore, outbox *IndexOutbox) *Purger {
+	return &Purger{
+		tsDB:   tsDB,
+		boltDB: boltDB,
+		mgmt:   mgmt,
+		outbox: outbox,
+	}
+}
+
+// Start begins processing the events of pubkey with the given mode in the background.
+// Returns an error if a purge is already running.
+func (p *Purger) Start(pubkey nostr.PubKey, mode string) error {
+	if mode != PurgeHide && mode != PurgeDelete && mode != PurgeRestore {
+		return fmt.Errorf("invalid purge mode %q", mode)
+	}
+	if !p.running.CompareAndSwap(false, true) {
+		return fmt.Errorf("purge already in progress")
+	}
+
+	p.mu.Lock()
+	p.pubkey = pubkey
+	p.mode = mode
+	p.mu.Unlock()
+
+	p.total.Store(0)
+	p.processed.Store(0)
+	p.errors.Store(0)
+	p.lastErr.Store("")
+
+	go p.run(pubkey, mode)
+	return nil
+}
+
+func (p *Purger) run(pubkey nostr.PubKey, mode string) {
+	defer p.running.Store(false)
+
+	if mode == PurgeRestore {
+		p.restore(pubkey)
+		return
+	}
+
+	// Collect IDs first so the BoltDB read transaction is closed before deleting
+	seen := map[nostr.ID]bool{}
+	var ids []nostr.ID
+	collect := func(id nostr.ID) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	boltFilter := nostr.Filter{Authors: []nostr.PubKey{pubkey}}
+	if mode == PurgeHide {
+		boltFilter.Kinds = []nostr.Kind{30142}
+	}
+	for event := range p.boltDB.QueryEvents(boltFilter, reindexMaxEvents) {
+		collect(event.ID)
+	}
+	// Also catch documents that only exist in Typesense
+	for event := range p.tsDB.QueryEvents(nostr.Filter{Authors: []nostr.PubKey{pubkey}, Kinds: []nostr.Kind{30142}}, reindexMaxEvents) {
+		collect(event.ID)
+	}
+	p.total.Store(int64(len(ids)))
+
+	slog.Info("purge started", "component", "purge", "mode", mode, "pubkey", pubkey.Hex(), "found", len(ids))
+
+	for _, id := range ids {
+		var err error
+		if mode == PurgeDelete {
+			err = writeThroughOutbox(p.outbox, outboxOpDelete, nil, id, func() error {
+				return p.boltDB.DeleteEvent(id)
+			})
+		} else {
+			_, err = p.outbox.Queue(outboxOpDelete, nil, id)
+		}
+		if err != nil {
+			p.errors.Add(1)
+			p.lastErr.Store(fmt.Sprintf("delete %s: %v", id.Hex(), err))
+		}
+		p.processed.Add(1)
+	}
+
+	slog.Info("purge completed", "component", "purge",
+		"total", p.total.Load(), "processed", p.processed.Load(), "errors", p.errors.Load())
+}
+
+// restore queues the pubkey's events in BoltDB for re-indexing.
+func (p *Purger) restore(pubkey nostr.PubKey) {
+	// Collect first so the BoltDB read transaction is closed before queueing
+	var events []nostr.Event
+	for event := range p.boltDB.QueryEvents(nostr.Filter{Authors: []nostr.PubKey{pubkey}, Kinds: []nostr.Kind{30142}}, reindexMaxEvents) {
+		if !p.mgmt.IsEventBanned(event.ID) {
+			events = append(events, event)
+		}
+	}
+	p.total.Store(int64(len(events)))
+	for _, event := range events {
+		if _, err := p.outbox.Queue(outboxOpSave, &event, event.ID); err != nil {
+			p.errors.Add(1)
+			slog.Warn("restore failed", "component", "purge", "id", event.ID.Hex(), "err", err)
+			p.lastErr.Store(err.Error())
+			continue
+		}
+		p.processed.Add(1)
+	}
+
+	slog.Info("restore completed", "component", "purge", "pubkey", pubkey.Hex(), "restored", p.processed.Load(), "total", p.total.Load())
+}
+
+// GetStatus returns the status of the current or last purge.
+func (p *Purger) GetStatus() PurgeStatus {
+	p.mu.Lock()
+	status := PurgeStatus{
+		Running:   p.running.Load(),
+		Mode:      p.mode,
+		Total:     p.total.Load(),
+		Processed: p.processed.Load(),
+		Errors:    p.errors.Load(),
+	}
+	if p.pubkey != (nostr.PubKey{}) {
+		status.PubKey = p.pubkey.Hex()
+	}
+	p.mu.Unlock()
+	if v := p.lastErr.Load(); v != nil {
+		if s, ok := v.(string); ok {
+			status.Error = s
+		}
+	}
+	return status
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"cmp"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore/typesense30142"
+	"go.etcd.io/bbolt"
+)
+
+// bucketQueryVectorCache maps a query cache key to an 8 byte insertion time
+// followed by the little-endian float32 vector.
+var bucketQueryVectorCache = []byte("query_vector_cache")
+
+const (
+	DefaultQueryCacheEntries  = 1000
+	DefaultQueryBatchWindow   = 5 * time.Millisecond
+	DefaultResultCacheEntries = 1000
+	DefaultResultCacheTTL     = 10 * time.Second
+	// queryBatchMaxTexts flushes a batch early once it holds this many queries.
+	queryBatchMaxTexts = 32
+	// queryBatchTimeout bounds the embedding call of a batch, which is not
+	// tied to any one caller's context.
+	queryBatchTimeout = 30 * time.Second
+)
+
+// QueryCacheStats reports the size and hit counters of a query cache since startup.
+type QueryCacheStats struct {
+	Entries    int     `json:"entries"`
+	MaxEntries int     `json:"max_entries"`
+	Hits       int64   `json:"hits"`
+	Misses     int64   `json:"misses"`
+	HitRatio   float64 `json:"hit_ratio"`
+	Batches    int64   `json:"batches,omitempty"`
+	Persistent bool    `json:"persistent,omitempty"`
+}
+
+func newQueryCacheStats(entries, maxEntries int, hits, misses int64) QueryCacheStats {
+	stats := QueryCacheStats{Entries: entries, MaxEntries: maxEntries, Hits: hits, Misses: misses}
+	if total := hits + misses; total > 0 {
+		stats.HitRatio = float64(hits) / float64(total)
+	}
+	return stats
+}
+
+// lruCache is a size-bounded map that evicts the least recently used entry.
+// It is not safe for concurrent use.
+type lruCache[K comparable, V any] struct {
+	max   int
+	order *list.List // front is the most recently used
+	items map[K]*list.Element
+}
+
+type lruEntry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+func newLRUCache[K comparable, V any](max int) *lruCache[K, V] {
+	return &lruCache[K, V]{max: max, order: list.New(), items: map[K]*list.Element{}}
+}
+
+func (c *lruCache[K, V]) get(key K) (V, bool) {
+	if elem, ok := c.items[key]; ok {
+		c.order.MoveToFront(elem)
+		return elem.Value.(*lruEntry[K, V]).value, true
+	}
+	var zero V
+	return zero, false
+}
+
+// add inserts or replaces key and returns the keys evicted to make room.
+func (c *lruCache[K, V]) add(key K, value V) []K {
+	if elem, ok := c.items[key]; ok {
+		elem.Value.(*lruEntry[K, V]).value = value
+		c.order.MoveToFront(elem)
+		return nil
+	}
+	c.items[key] = c.order.PushFront(&lruEntry[K, V]{key, value})
+	var evicted []K
+	for c.order.Len() > c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		k := oldest.Value.(*lruEntry[K, V]).key
+		delete(c.items, k)
+		evicted = append(evicted, k)
+	}
+	return evicted
+}
+
+func (c *lruCache[K, V]) len() int {
+	return c.order.Len()
+}
+
+func (c *lruCache[K, V]) clear() {
+	c.order.Init()
+	clear(c.items)
+}
+
+// QueryVectorCache keeps the vectors of recent search queries in memory, keyed
+// by model and normalized query text, so popular queries are embedded once.
+// Queries missing the cache within BatchWindow of each other are embedded in a
+// single call. With Init the cache is also written to BoltDB and survives
+// restarts.
+type QueryVectorCache struct {
+	MaxEntries  int
+	BatchWindow time.Duration
+
+	model   func() string
+	db      *bbolt.DB
+	mu      sync.Mutex
+	entries *lruCache[[32]byte, []float32]
+	pending *queryBatch
+	hits    atomic.Int64
+	misses  atomic.Int64
+	batches atomic.Int64
+}
+
+// queryBatch collects the distinct query texts embedded in one call.
+type queryBatch struct {
+	embedder typesense30142.Embedder
+	keys     [][32]byte
+	texts    []string
+	index    map[[32]byte]int
+	once     sync.Once
+	done     chan struct{}
+	vectors  [][]float32
+	err      error
+}
+
+// NewQueryVectorCache creates an in-memory cache; model returns the current
+// embedding model ID.
+func NewQueryVectorCache(maxEntries int, batchWindow time.Duration, model func() string) *QueryVectorCache {
+	return &QueryVectorCache{
+		MaxEntries:  maxEntries,
+		BatchWindow: batchWindow,
+		model:       model,
+		entries:     newLRUCache[[32]byte, []float32](maxEntries),
+	}
+}
+
+// Init makes the cache persistent: it creates the bucket and loads the most
+// recently added vectors, dropping the rest.
+func (c *QueryVectorCache) Init(db *bbolt.DB) error {
+	type stored struct {
+		key    [32]byte
+		added  uint64
+		vector []float32
+	}
+	var all []stored
+	err := db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(bucketQueryVectorCache)
+		if err != nil {
+			return err
+		}
+		var stale [][]byte
+		err = bucket.ForEach(func(k, v []byte) error {
+			if len(k) != 32 || len(v) < 8 {
+				stale = append(stale, append([]byte(nil), k...))
+				return nil
+			}
+			all = append(all, stored{[32]byte(k), binary.BigEndian.Uint64(v[:8]), decodeVector(v[8:])})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		slices.SortFunc(all, func(a, b stored) int { return cmp.Compare(b.added, a.added) })
+		if len(all) > c.MaxEntries {
+			for _, s := range all[c.MaxEntries:] {
+				stale = append(stale, s.key[:])
+			}
+			all = all[:c.MaxEntries]
+		}
+		for _, k := range stale {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.db = db
+	// Oldest first, so the most recent entries end up most recently used
+	for _, s := range slices.Backward(all) {
+		c.entries.add(s.key, s.vector)
+	}
+	return nil
+}
+
+// Vector returns the vector of query, embedding it with embedder on a miss.
+func (c *QueryVectorCache) Vector(ctx context.Context, embedder typesense30142.Embedder, query string) ([]float32, error) {
+	key := c.key(query)
+
+	c.mu.Lock()
+	if vector, ok := c.entries.get(key); ok {
+		c.mu.Unlock()
+		c.hits.Add(1)
+		return vector, nil
+	}
+	c.misses.Add(1)
+
+	b := c.pending
+	if b == nil || b.embedder != embedder {
+		b = &queryBatch{embedder: embedder, index: map[[32]byte]int{}, done: make(chan struct{})}
+		c.pending = b
+		time.AfterFunc(c.BatchWindow, func() { c.flush(b) })
+	}
+	i, ok := b.index[key]
+	if !ok {
+		i = len(b.texts)
+		b.index[key] = i
+		b.keys = append(b.keys, key)
+		b.texts = append(b.texts, normalizeQuery(query))
+	}
+	if len(b.texts) >= queryBatchMaxTexts {
+		c.pending = nil
+		go c.flush(b)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-b.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if b.err != nil {
+		return nil, b.err
+	}
+	return b.vectors[i], nil
+}
+
+// flush embeds the texts of b once and caches the vectors.
+func (c *QueryVectorCache) flush(b *queryBatch) {
+	b.once.Do(func() {
+		c.mu.Lock()
+		if c.pending == b {
+			c.pending = nil
+		}
+		c.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), queryBatchTimeout)
+		defer cancel()
+		c.batches.Add(1)
+		vectors, err := b.embedder.Embed(ctx, b.texts)
+		if err == nil && len(vectors) != len(b.texts) {
+			err = fmt.Errorf("embedding service returned %d vectors for %d texts", len(vectors), len(b.texts))
+		}
+		b.vectors, b.err = vectors, err
+		close(b.done)
+		if err != nil {
+			return
+		}
+
+		c.mu.Lock()
+		var evicted [][32]byte
+		for i, key := range b.keys {
+			evicted = append(evicted, c.entries.add(key, vectors[i])...)
+		}
+		db := c.db
+		c.mu.Unlock()
+		if db != nil {
+			c.persist(db, b.keys, vectors, evicted)
+		}
+	})
+}
+
+// persist writes added vectors and removes evicted ones. A failure only costs
+// the entries after a restart.
+func (c *QueryVectorCache) persist(db *bbolt.DB, keys [][32]byte, vectors [][]float32, evicted [][32]byte) {
+	now := uint64(time.Now().UnixNano())
+	err := db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(bucketQueryVectorCache)
+		for i, key := range keys {
+			val := binary.BigEndian.AppendUint64(make([]byte, 0, 8+4*len(vectors[i])), now)
+			if err := bucket.Put(key[:], appendVector(val, vectors[i])); err != nil {
+				return err
+			}
+		}
+		for _, key := range evicted {
+			if err := bucket.Delete(key[:]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("failed to persist vectors", "component", "query_cache", "err", err)
+	}
+}
+
+// GetStats returns the cache size and hit counters since startup.
+func (c *QueryVectorCache) GetStats() QueryCacheStats {
+	c.mu.Lock()
+	entries, persistent := c.entries.len(), c.db != nil
+	c.mu.Unlock()
+	stats := newQueryCacheStats(entries, c.MaxEntries, c.hits.Load(), c.misses.Load())
+	stats.Batches = c.batches.Load()
+	stats.Persistent = persistent
+	return stats
+}
+
+func (c *QueryVectorCache) key(query string) [32]byte {
+	return sha256.Sum256([]byte(c.model() + "\x00" + normalizeQuery(query)))
+}
+
+// normalizeQuery collapses whitespace, so queries differing only in spacing
+// share a vector.
+func normalizeQuery(query string) string {
+	return strings.Join(strings.Fields(query), " ")
+}
+
+// SearchResultCache keeps the results of search queries for TTL, keyed by
+// the normalized filter. Invalidate drops all results after a write.
+type SearchResultCache struct {
+	TTL        time.Duration
+	MaxEntries int
+
+	mu         sync.Mutex
+	entries    *lruCache[string, cachedResult]
+	generation uint64
+	hits       atomic.Int64
+	misses     atomic.Int64
+}
+
+type cachedResult struct {
+	events  []nostr.Event
+	expires time.Time
+}
+
+func NewSearchResultCache(ttl time.Duration, maxEntries int) *SearchResultCache {
+	return &SearchResultCache{
+		TTL:        ttl,
+		MaxEntries: maxEntries,
+		entries:    newLRUCache[string, cachedResult](maxEntries),
+	}
+}
+
+// Get returns the cached events for key. On a miss it returns the current
+// generation, to be passed to Put with the results.
+func (c *SearchResultCache) Get(key string) ([]nostr.Event, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if result, ok := c.entries.get(key); ok && time.Now().Before(result.expires) {
+		c.hits.Add(1)
+		return result.events, c.generation, true
+	}
+	c.misses.Add(1)
+	return nil, c.generation, false
+}
+
+// Put caches events for key unless the cache was invalidated since the
+// generation returned by Get.
+func (c *SearchResultCache) Put(key string, generation uint64, events []nostr.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	c.entries.add(key, cachedResult{events, time.Now().Add(c.TTL)})
+}
+
+// Invalidate drops all cached results.
+func (c *SearchResultCache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.entries.clear()
+}
+
+// GetStats returns the cache size and hit counters since startup.
+func (c *SearchResultCache) GetStats() QueryCacheStats {
+	c.mu.Lock()
+	entries := c.entries.len()
+	c.mu.Unlock()
+	return newQueryCacheStats(entries, c.MaxEntries, c.hits.Load(), c.misses.Load())
+}
+
+// searchCacheKey identifies a search by filter and result limit. Filter
+// values are sorted and the query normalized, so equivalent filters share
+// cached results.
+func searchCacheKey(filter nostr.Filter, limit int) string {
+	var b strings.Builder
+	b.WriteString("ids=")
+	ids := make([]string, len(filter.IDs))
+	for i, id := range filter.IDs {
+		ids[i] = id.Hex()
+	}
+	writeSorted(&b, ids)
+	b.WriteString("authors=")
+	authors := make([]string, len(filter.Authors))
+	for i, pk := range filter.Authors {
+		authors[i] = pk.Hex()
+	}
+	writeSorted(&b, authors)
+	b.WriteString("kinds=")
+	kinds := make([]string, len(filter.Kinds))
+	for i, kind := range filter.Kinds {
+		kinds[i] = strconv.Itoa(int(kind))
+	}
+	writeSorted(&b, kinds)
+	tagNames := make([]string, 0, len(filter.Tags))
+	for name := range filter.Tags {
+		tagNames = append(tagNames, name)
+	}
+	slices.Sort(tagNames)
+	for _, name := range tagNames {
+		b.WriteString("#" + name + "=")
+		writeSorted(&b, slices.Clone(filter.Tags[name]))
+	}
+	fmt.Fprintf(&b, "since=%d|until=%d|limit=%d|max=%d|search=%s",
+		filter.Since, filter.Until, filter.Limit, limit, normalizeQuery(filter.Search))
+	return b.String()
+}
+
+func writeSorted(b *strings.Builder, values []string) {
+	slices.Sort(values)
+	b.WriteString(strings.Join(values, ","))
+	b.WriteByte('|')
+}
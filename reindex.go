@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"iter"
+	"log/slog"
+	"slices"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"fiatjaf.com/nostr"
 	"fiatjaf.com/nostr/eventstore/boltdb"
@@ -12,119 +16,816 @@ import (
 )
 
 const (
-	reindexMaxEvents  = 10_000_000
-	reindexBatchSize  = 100
+	reindexMaxEvents = 10_000_000
+	reindexBatchSize = 100
+	// reindexPageSize is the number of events read from BoltDB per read
+	// transaction. Batches are upserted and checkpointed between pages.
+	reindexPageSize = 1000
 )
 
+// ReindexConfig controls the parallelism and batch sizing of a reindex.
+type ReindexConfig struct {
+	Workers       int           // concurrent BatchUpsertEvents calls
+	BatchSize     int           // initial batch size
+	MinBatchSize  int           // lower bound for adaptive batch sizing
+	MaxBatchSize  int           // upper bound for adaptive batch sizing
+	TargetLatency time.Duration // batch latency the sizing aims for
+}
+
+// DefaultReindexConfig returns the default reindex configuration.
+func DefaultReindexConfig() ReindexConfig {
+	return ReindexConfig{
+		Workers:       4,
+		BatchSize:     reindexBatchSize,
+		MinBatchSize:  10,
+		MaxBatchSize:  1000,
+		TargetLatency: 2 * time.Second,
+	}
+}
+
+// adaptiveBatcher grows the batch size while batches finish well within the
+// target latency and shrinks it when they are slow or fail, so a reindex
+// backs off when Typesense or the embedding service is under pressure.
+type adaptiveBatcher struct {
+	mu     sync.Mutex
+	size   int
+	config ReindexConfig
+}
+
+func (b *adaptiveBatcher) Size() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size
+}
+
+func (b *adaptiveBatcher) Reset() {
+	b.mu.Lock()
+	b.size = b.config.BatchSize
+	b.mu.Unlock()
+}
+
+func (b *adaptiveBatcher) Observe(latency time.Duration, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case failed || latency > b.config.TargetLatency:
+		b.size = max(b.size/2, b.config.MinBatchSize)
+	case latency < b.config.TargetLatency/2:
+		b.size = min(b.size+b.size/2, b.config.MaxBatchSize)
+	}
+}
+
+// Reindex phases reported in ReindexStatus.
+const (
+	reindexPhaseBuilding   = "building"
+	reindexPhaseCatchingUp = "catching_up"
+	reindexPhaseSwapping   = "swapping"
+	reindexPhaseDone       = "done"
+	reindexPhaseFailed     = "failed"
+	reindexPhaseCancelled  = "cancelled"
+	// reindexPhaseInterrupted is a full reindex stopped by a shutdown. It keeps
+	// its collection and checkpoint and continues on the next start.
+	reindexPhaseInterrupted = "interrupted"
+)
+
+// ReindexCheckpoint is persisted after every batch so a reindex interrupted by
+// a crash or restart can continue where it stopped.
+type ReindexCheckpoint struct {
+	Collection string          `json:"collection"`
+	StartedAt  int64           `json:"started_at"`
+	Until      nostr.Timestamp `json:"until"` // created_at of the last processed event
+	Total      int64           `json:"total"`
+	Indexed    int64           `json:"indexed"`
+	Errors     int64           `json:"errors"`
+	Resumed    bool            `json:"resumed,omitempty"`
+}
+
+// ReindexJob is a finished reindex as recorded in the history.
+type ReindexJob struct {
+	Collection string `json:"collection"`
+	Selective  bool   `json:"selective,omitempty"`
+	Status     string `json:"status"`
+	StartedAt  int64  `json:"started_at"`
+	FinishedAt int64  `json:"finished_at"`
+	Resumed    bool   `json:"resumed,omitempty"`
+	Total      int64  `json:"total"`
+	Indexed    int64  `json:"indexed"`
+	Errors     int64  `json:"errors"`
+	Error      string `json:"error,omitempty"`
+}
+
 type ReindexStatus struct {
-	Running bool   `json:"running"`
-	Total   int64  `json:"total"`
-	Indexed int64  `json:"indexed"`
-	Errors  int64  `json:"errors"`
-	Error   string `json:"error,omitempty"`
+	Running    bool    `json:"running"`
+	Selective  bool    `json:"selective,omitempty"`
+	Phase      string  `json:"phase,omitempty"`
+	Collection string  `json:"collection,omitempty"`
+	Total      int64   `json:"total"`
+	Indexed    int64   `json:"indexed"`
+	Errors     int64   `json:"errors"`
+	Error      string  `json:"error,omitempty"`
+	Expected   int64   `json:"expected,omitempty"`
+	Workers    int     `json:"workers"`
+	BatchSize  int     `json:"batch_size"`
+	Rate       float64 `json:"rate"` // events per second
+	ETA        string  `json:"eta,omitempty"`
 }
 
+// Reindexer rebuilds the search index from BoltDB into a new versioned
+// collection and then atomically points the TS_COLLECTION alias at it, so
+// searches keep being served from the old collection during the rebuild.
 type Reindexer struct {
 	tsDB   *typesense30142.TSBackend
 	boltDB *boltdb.BoltBackend
 	mgmt   *ManagementStore
+	outbox *IndexOutbox
+	admin  *TypesenseAdmin
+	config ReindexConfig
+
+	batcher      *adaptiveBatcher
+	selective    atomic.Bool
+	expected     atomic.Int64
+	started      atomic.Int64 // unix nanos when the bulk copy started
+	startIndexed atomic.Int64 // indexed count when the bulk copy started
 
-	mu      sync.Mutex
-	running atomic.Bool
-	total   atomic.Int64
-	indexed atomic.Int64
-	errors  atomic.Int64
-	lastErr atomic.Value // stores string
+	mu         sync.Mutex
+	running    atomic.Bool
+	total      atomic.Int64
+	indexed    atomic.Int64
+	errors     atomic.Int64
+	lastErr    atomic.Value // stores string
+	phase      atomic.Value // stores string
+	collection atomic.Value // stores string
+
+	cancelMu sync.Mutex
+	cancel   context.CancelFunc
+	stopped  bool
+	jobs     sync.WaitGroup
+
+	// Embedding returns the embedder and fields a full reindex builds the new
+	// collection with. Without it, the collection is built without vectors.
+	Embedding func() (typesense30142.Embedder, []string)
+	// OnSwap is called after a full reindex has swapped the alias. embedded
+	// reports whether the new collection was built with embeddings.
+	OnSwap func(embedded bool)
+	// Metrics, if set, records the latency and errors of batch imports.
+	Metrics *Metrics
 }
 
-func NewReindexer(tsDB *typesense30142.TSBackend, boltDB *boltdb.BoltBackend, mgmt *ManagementStore) *Reindexer {
+func NewReindexer(tsDB *typesense30142.TSBackend, boltDB *boltdb.BoltBackend, mgmt *ManagementStore, outbox *IndexOutbox, config ReindexConfig) *Reindexer {
 	return &Reindexer{
-		tsDB:   tsDB,
-		boltDB: boltDB,
-		mgmt:   mgmt,
+		tsDB:    tsDB,
+		boltDB:  boltDB,
+		mgmt:    mgmt,
+		outbox:  outbox,
+		admin:   NewTypesenseAdmin(tsDB),
+		config:  config,
+		batcher: &adaptiveBatcher{size: config.BatchSize, config: config},
 	}
 }
 
 // Start begins a reindex in the background. Returns an error if one is already running.
 func (r *Reindexer) Start() error {
+	return r.start(nil, nil)
+}
+
+// StartSelective re-upserts only the kind 30142 events matching filter from
+// BoltDB into the live collection, without rebuilding it. Runs in the background.
+func (r *Reindexer) StartSelective(filter nostr.Filter) error {
+	if filter.Search != "" {
+		return fmt.Errorf("search is not supported in a reindex filter")
+	}
+	filter.Kinds = []nostr.Kind{30142}
+	filter.Limit = 0
+	return r.start(nil, &filter)
+}
+
+// Resume continues a reindex interrupted by a restart, if a checkpoint was left behind.
+// Returns true if a reindex was resumed.
+func (r *Reindexer) Resume() (bool, error) {
+	cp, err := r.mgmt.LoadReindexCheckpoint()
+	if err != nil {
+		return false, err
+	}
+	if cp == nil {
+		// Drop operations recorded for a reindex that already finished
+		r.outbox.StopMirror(nil)
+		return false, nil
+	}
+	exists, err := r.admin.CollectionExists(cp.Collection)
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		r.outbox.StopMirror(nil)
+		r.mgmt.DeleteReindexCheckpoint()
+		r.mgmt.AddReindexJob(ReindexJob{
+			Collection: cp.Collection,
+			Status:     reindexPhaseFailed,
+			StartedAt:  cp.StartedAt,
+			FinishedAt: time.Now().Unix(),
+			Total:      cp.Total,
+			Indexed:    cp.Indexed,
+			Errors:     cp.Errors,
+			Error:      "collection disappeared before the reindex could be resumed",
+		})
+		return false, nil
+	}
+	return true, r.start(cp, nil)
+}
+
+// Cancel stops a running reindex and drops the collection it was building.
+// Once the alias is being swapped the reindex can no longer be cancelled.
+func (r *Reindexer) Cancel() error {
+	r.cancelMu.Lock()
+	defer r.cancelMu.Unlock()
+	if !r.running.Load() || r.cancel == nil {
+		return fmt.Errorf("no reindex in progress")
+	}
+	if phase, _ := r.phase.Load().(string); phase != reindexPhaseBuilding && phase != reindexPhaseCatchingUp {
+		return fmt.Errorf("reindex is %s and can no longer be cancelled", phase)
+	}
+	r.cancel()
+	return nil
+}
+
+// Stop interrupts a running reindex for a shutdown and waits until it exited
+// or ctx is done. Unlike Cancel, a full reindex keeps its collection and
+// checkpoint, so Resume continues it on the next start. No reindex can be
+// started afterwards.
+func (r *Reindexer) Stop(ctx context.Context) error {
+	r.interrupt()
+	done := make(chan struct{})
+	go func() {
+		r.jobs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// interrupt is Stop without waiting for the reindex to exit.
+func (r *Reindexer) interrupt() {
+	r.cancelMu.Lock()
+	defer r.cancelMu.Unlock()
+	r.stopped = true
+	if r.cancel != nil {
+		r.cancel()
+	}
+}
+
+func (r *Reindexer) start(cp *ReindexCheckpoint, selective *nostr.Filter) error {
 	if !r.running.CompareAndSwap(false, true) {
 		return fmt.Errorf("reindex already in progress")
 	}
+	r.cancelMu.Lock()
+	defer r.cancelMu.Unlock()
+	if r.stopped {
+		r.running.Store(false)
+		return fmt.Errorf("relay is shutting down")
+	}
 
-	// Reset counters
+	// Reset counters, or continue from the checkpoint
 	r.total.Store(0)
 	r.indexed.Store(0)
 	r.errors.Store(0)
+	if cp != nil {
+		r.total.Store(cp.Total)
+		r.indexed.Store(cp.Indexed)
+		r.errors.Store(cp.Errors)
+	}
 	r.lastErr.Store("")
+	r.phase.Store(reindexPhaseBuilding)
+	r.collection.Store("")
+	r.expected.Store(0)
+	r.started.Store(0)
+	r.batcher.Reset()
+	r.selective.Store(selective != nil)
 
-	go r.run()
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.jobs.Add(1)
+	go func() {
+		defer r.jobs.Done()
+		if selective != nil {
+			r.runSelective(ctx, *selective)
+		} else {
+			r.run(ctx, cp)
+		}
+	}()
 	return nil
 }
 
-func (r *Reindexer) run() {
+func (r *Reindexer) runSelective(ctx context.Context, filter nostr.Filter) {
+	defer r.running.Store(false)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	job := ReindexCheckpoint{Collection: r.tsDB.CollectionName, StartedAt: time.Now().Unix()}
+	r.collection.Store(job.Collection)
+	slog.Info("selective re-upsert started", "component", "reindex", "collection", job.Collection)
+
+	r.bulkCopy(ctx, func(events []nostr.Event) { r.queueBatch(ctx, events) }, filter, nil)
+
+	phase := reindexPhaseDone
+	if ctx.Err() != nil {
+		phase = reindexPhaseCancelled
+	}
+	r.finish(&job, phase, "")
+	slog.Info("selective re-upsert finished", "component", "reindex", "phase", phase,
+		"total", r.total.Load(), "indexed", r.indexed.Load(), "errors", r.errors.Load())
+}
+
+func (r *Reindexer) run(ctx context.Context, cp *ReindexCheckpoint) {
 	defer r.running.Store(false)
 
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	// Load schema (custom or default)
 	schema, err := r.mgmt.LoadSchema()
 	if err != nil {
-		r.lastErr.Store(fmt.Sprintf("failed to load schema: %v", err))
+		r.finish(nil, reindexPhaseFailed, fmt.Sprintf("failed to load schema: %v", err))
 		return
 	}
 
-	// Recreate the collection with the (possibly updated) schema
-	if err := r.tsDB.RecreateCollection(schema); err != nil {
-		r.lastErr.Store(fmt.Sprintf("failed to recreate collection: %v", err))
+	// Build into a new versioned collection next to the live one
+	alias := r.tsDB.CollectionName
+	job := ReindexCheckpoint{
+		Collection: fmt.Sprintf("%s_%d", alias, time.Now().Unix()),
+		StartedAt:  time.Now().Unix(),
+	}
+	if cp != nil {
+		job = *cp
+		job.Resumed = true
+	}
+	target := job.Collection
+	r.collection.Store(target)
+	var embedder typesense30142.Embedder
+	var embedFields []string
+	if r.Embedding != nil {
+		embedder, embedFields = r.Embedding()
+	}
+	shadow := &typesense30142.TSBackend{
+		ApiKey:         r.tsDB.ApiKey,
+		Host:           r.tsDB.Host,
+		CollectionName: target,
+		Schema:         schema,
+		Embedder:       embedder,
+		EmbedFields:    embedFields,
+	}
+	if err := shadow.Init(); err != nil {
+		r.finish(&job, reindexPhaseFailed, fmt.Sprintf("failed to create collection %s: %v", target, err))
 		return
 	}
+	r.checkpoint(&job)
+
+	// Writes arriving from now on go to both collections. A resumed reindex
+	// also replays those recorded before it was interrupted.
+	if err := r.outbox.StartMirror(shadow, cp != nil); err != nil {
+		r.finish(&job, reindexPhaseFailed, fmt.Sprintf("failed to start mirroring writes: %v", err))
+		return
+	}
+
+	filter := nostr.Filter{Kinds: []nostr.Kind{30142}}
+	if cp != nil && cp.Until != 0 {
+		// Events at the checkpoint timestamp are upserted again, which is harmless
+		filter.Until = cp.Until
+		slog.Info("resuming collection", "component", "reindex", "collection", target, "until", cp.Until)
+	} else {
+		slog.Info("building collection", "component", "reindex", "collection", target)
+	}
+
+	r.bulkCopy(ctx, func(events []nostr.Event) { r.upsertBatch(shadow, events) }, filter, &job)
+
+	if ctx.Err() == nil {
+		// Replay writes that arrived during the bulk copy, since the copy may
+		// have overwritten them with the older BoltDB snapshot
+		r.phase.Store(reindexPhaseCatchingUp)
+		r.replay(shadow, r.outbox.TakeMirrored())
+	}
+
+	// A cancel or stop is honoured up to here; from the swap on, Cancel refuses
+	r.cancelMu.Lock()
+	cancelled, stopped := ctx.Err() != nil, r.stopped
+	if !cancelled {
+		r.phase.Store(reindexPhaseSwapping)
+	}
+	r.cancelMu.Unlock()
+	if cancelled && stopped {
+		// Pages are only checkpointed once complete, so the checkpoint is
+		// consistent and the reindex resumes from it after the restart. Writes
+		// are still recorded until then and replayed by the resumed reindex.
+		r.outbox.DetachMirror()
+		r.phase.Store(reindexPhaseInterrupted)
+		slog.Info("interrupted by shutdown, resuming on the next start", "component", "reindex", "collection", target, "until", job.Until)
+		return
+	}
+	if cancelled {
+		r.outbox.StopMirror(nil)
+		r.admin.DeleteCollection(target)
+		r.finish(&job, reindexPhaseCancelled, "")
+		return
+	}
+
+	// Swap while no index operation can be applied in between
+	var swapErr error
+	r.outbox.StopMirror(func(pending []outboxEntry) {
+		r.replay(shadow, pending)
+		swapErr = r.swap(alias, target)
+	})
+	if swapErr != nil {
+		r.admin.DeleteCollection(target)
+		r.finish(&job, reindexPhaseFailed, fmt.Sprintf("failed to swap alias %s to %s: %v", alias, target, swapErr))
+		return
+	}
+
+	if r.OnSwap != nil {
+		r.OnSwap(shadow.Embedder != nil)
+	}
+	r.finish(&job, reindexPhaseDone, "")
+	slog.Info("reindex completed", "component", "reindex", "alias", alias, "collection", target,
+		"total", r.total.Load(), "indexed", r.indexed.Load(), "errors", r.errors.Load())
+}
+
+// reindexBatch is a slice of events handed to a worker, together with the
+// page it belongs to.
+type reindexBatch struct {
+	events []nostr.Event
+	page   *reindexPage
+}
+
+// reindexPage tracks the outstanding batches of one page read from BoltDB.
+// The checkpoint only advances past a page once all of its batches are done.
+type reindexPage struct {
+	until nostr.Timestamp
+	wg    sync.WaitGroup
+}
+
+// bulkCopy reads the events matching filter from BoltDB page by page and
+// passes them to upsert in batches from a pool of workers. If job is non-nil, pages
+// are checkpointed in order as they complete.
+func (r *Reindexer) bulkCopy(ctx context.Context, upsert func(events []nostr.Event), filter nostr.Filter, job *ReindexCheckpoint) {
+	// BoltDB only indexes single-letter tags; other tag conditions are
+	// checked against each event with filter.Matches
+	storeFilter := filter
+	storeFilter.Tags = nostr.TagMap{}
+	for key, values := range filter.Tags {
+		if len(key) == 1 {
+			storeFilter.Tags[key] = values
+		}
+	}
+	if len(storeFilter.Tags) == 0 {
+		storeFilter.Tags = nil
+	}
 
-	log.Println("reindex: collection recreated, starting event re-indexing with batching")
+	if len(storeFilter.Tags) == len(filter.Tags) {
+		if expected, err := r.boltDB.CountEvents(storeFilter); err == nil {
+			r.expected.Store(int64(expected) + r.total.Load())
+		}
+	}
+	r.started.Store(time.Now().UnixNano())
+	r.startIndexed.Store(r.indexed.Load())
+
+	batches := make(chan reindexBatch, r.config.Workers)
+	pages := make(chan *reindexPage, 2)
+
+	var workers sync.WaitGroup
+	for range r.config.Workers {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for b := range batches {
+				if ctx.Err() == nil {
+					upsert(b.events)
+				}
+				b.page.wg.Done()
+			}
+		}()
+	}
 
-	// Collect events in batches for efficient bulk upsert
-	var batch []nostr.Event
+	checkpointed := make(chan struct{})
+	go func() {
+		defer close(checkpointed)
+		for page := range pages {
+			page.wg.Wait()
+			if ctx.Err() != nil || job == nil {
+				continue
+			}
+			job.Until = page.until
+			r.checkpoint(job)
+		}
+	}()
 
-	// Iterate all events from BoltDB
-	for event := range r.boltDB.QueryEvents(nostr.Filter{Kinds: []nostr.Kind{30142}}, reindexMaxEvents) {
-		r.total.Add(1)
-		batch = append(batch, event)
+	pageSize := max(reindexPageSize, r.config.MaxBatchSize*r.config.Workers)
+	pageEvents(r.boltDB.QueryEvents, storeFilter, pageSize, func(events []nostr.Event) bool {
+		var accepted []nostr.Event
+		for _, event := range events {
+			if !filter.Matches(event) {
+				continue
+			}
+			// Events of banned pubkeys that were hidden stay out of the index
+			if r.mgmt.PubKeyPurgeMode(event.PubKey) == PurgeHide {
+				continue
+			}
+			accepted = append(accepted, event)
+		}
+		r.total.Add(int64(len(accepted)))
 
-		// Process batch when full
-		if len(batch) >= reindexBatchSize {
-			indexed, errs := r.tsDB.BatchUpsertEvents(batch)
-			r.indexed.Add(int64(indexed))
-			r.errors.Add(int64(len(errs)))
-			for _, err := range errs {
-				log.Printf("reindex: batch error: %v", err)
+		// Pages are newest first, so the last event is the oldest processed
+		page := &reindexPage{until: events[len(events)-1].CreatedAt}
+		for len(accepted) > 0 {
+			if ctx.Err() != nil {
+				break
 			}
-			batch = batch[:0] // Reset batch, reuse backing array
+			n := min(r.batcher.Size(), len(accepted))
+			page.wg.Add(1)
+			batches <- reindexBatch{events: accepted[:n], page: page}
+			accepted = accepted[n:]
+		}
+		pages <- page
+		return ctx.Err() == nil
+	})
+
+	close(batches)
+	close(pages)
+	workers.Wait()
+	<-checkpointed
+}
+
+// queueBatch re-upserts one batch of a selective reindex through the outbox,
+// so it is ordered with live writes to the collection, and waits for it.
+// Events replaced or hidden since they were read are dropped; the write that
+// changed them indexes the address.
+func (r *Reindexer) queueBatch(ctx context.Context, events []nostr.Event) {
+	var seqs []uint64
+	for _, event := range events {
+		seq, err := r.outbox.QueueIf(outboxOpSave, &event, event.ID, func() bool {
+			current, ok := indexedVersion(r.boltDB, r.mgmt, event)
+			return ok && current.ID == event.ID
+		})
+		if err != nil {
+			r.errors.Add(1)
+			slog.Warn("queue error", "component", "reindex", "id", event.ID.Hex(), "err", err)
+			continue
+		}
+		if seq != 0 {
+			seqs = append(seqs, seq)
+		}
+	}
+	for _, seq := range seqs {
+		if err := r.outbox.Wait(ctx, seq); err != nil {
+			r.errors.Add(1)
+			continue
+		}
+		r.indexed.Add(1)
+	}
+}
+
+// upsertBatch upserts one batch and feeds its latency into the batch sizing.
+func (r *Reindexer) upsertBatch(target *typesense30142.TSBackend, events []nostr.Event) {
+	start := time.Now()
+	indexed, errs := target.BatchUpsertEvents(events)
+	r.batcher.Observe(time.Since(start), len(errs) > 0)
+	var err error
+	if len(errs) > 0 {
+		err = errs[0]
+	}
+	r.Metrics.ObserveTypesense("import", start, err)
+
+	r.indexed.Add(int64(indexed))
+	r.errors.Add(int64(len(errs)))
+	for _, err := range errs {
+		slog.Warn("batch error", "component", "reindex", "err", err)
+	}
+}
+
+// pageEvents reads the events matching filter newest first, pageSize at a
+// time, and calls fn with each page until it returns false. No query is held
+// open while fn runs. Each page starts at the oldest timestamp of the previous
+// one, with the limit raised by the events already processed at that
+// timestamp, so events sharing a timestamp across pages are not skipped.
+func pageEvents(query func(nostr.Filter, int) iter.Seq[nostr.Event], filter nostr.Filter, pageSize int, fn func(page []nostr.Event) bool) {
+	var boundary map[nostr.ID]bool // already processed IDs at filter.Until
+	for {
+		f := filter
+		f.Limit = pageSize + len(boundary)
+		var page []nostr.Event
+		var returned int
+		var oldest nostr.Timestamp
+		for event := range query(f, f.Limit) {
+			returned++
+			if oldest == 0 || event.CreatedAt < oldest {
+				oldest = event.CreatedAt
+			}
+			if !boundary[event.ID] {
+				page = append(page, event)
+			}
+		}
+		// Nothing new means only processed events are left
+		if len(page) == 0 {
+			return
+		}
+		if !fn(page) || returned < f.Limit {
+			return
+		}
+
+		next := map[nostr.ID]bool{}
+		if filter.Until == oldest && boundary != nil {
+			next = boundary
+		}
+		for _, event := range page {
+			if event.CreatedAt == oldest {
+				next[event.ID] = true
+			}
+		}
+		boundary = next
+		filter.Until = oldest
+	}
+}
+
+// checkpoint persists the progress of job.
+func (r *Reindexer) checkpoint(job *ReindexCheckpoint) {
+	job.Total = r.total.Load()
+	job.Indexed = r.indexed.Load()
+	job.Errors = r.errors.Load()
+	if err := r.mgmt.SaveReindexCheckpoint(*job); err != nil {
+		slog.Error("failed to save checkpoint", "component", "reindex", "err", err)
+	}
+}
+
+// finish records the outcome of a job in the history and clears its checkpoint
+// and the writes recorded for it.
+func (r *Reindexer) finish(job *ReindexCheckpoint, phase, msg string) {
+	r.phase.Store(phase)
+	if msg != "" {
+		r.lastErr.Store(msg)
+		slog.Error("reindex ended with an error", "component", "reindex", "phase", phase, "err", msg)
+	}
+	if job == nil {
+		return
+	}
+	selective := r.selective.Load()
+	if !selective {
+		r.outbox.StopMirror(nil)
+		r.mgmt.DeleteReindexCheckpoint()
+	}
+	r.mgmt.AddReindexJob(ReindexJob{
+		Collection: job.Collection,
+		Selective:  selective,
+		Status:     phase,
+		StartedAt:  job.StartedAt,
+		FinishedAt: time.Now().Unix(),
+		Resumed:    job.Resumed,
+		Total:      r.total.Load(),
+		Indexed:    r.indexed.Load(),
+		Errors:     r.errors.Load(),
+		Error:      msg,
+	})
+}
+
+func (r *Reindexer) replay(shadow *typesense30142.TSBackend, entries []outboxEntry) {
+	for _, entry := range entries {
+		if err := applyOutboxEntry(shadow, entry); err != nil {
+			r.errors.Add(1)
+			slog.Warn("replay failed", "component", "reindex", "op", entry.Op, "id", entry.ID, "err", err)
 		}
 	}
+}
 
-	// Process remaining events in final batch
-	if len(batch) > 0 {
-		indexed, errs := r.tsDB.BatchUpsertEvents(batch)
-		r.indexed.Add(int64(indexed))
-		r.errors.Add(int64(len(errs)))
-		for _, err := range errs {
-			log.Printf("reindex: batch error: %v", err)
+// InitCollectionAlias makes the collection name of tsDB an alias, which a
+// reindex swaps to the rebuilt collection. It runs before the relay serves
+// anything. A plain collection from before aliases were used is copied to
+// <name>_v0 first and only dropped once the copy is complete; if the alias
+// cannot be created after that, the next start finds the copy and retries.
+// On a fresh install, <name>_v0 is created empty.
+func InitCollectionAlias(tsDB *typesense30142.TSBackend, mgmt *ManagementStore) error {
+	admin := NewTypesenseAdmin(tsDB)
+	alias := tsDB.CollectionName
+	if current, err := admin.GetAlias(alias); err != nil || current != "" {
+		return err
+	}
+	collections, err := admin.ListCollections()
+	if err != nil {
+		return err
+	}
+	versioned := alias + "_v0"
+	switch {
+	case slices.Contains(collections, alias):
+		// A copy left by an interrupted migration may be incomplete
+		if err := admin.DeleteCollection(versioned); err != nil {
+			return err
+		}
+		slog.Info("copying plain collection before replacing it with an alias", "component", "reindex", "collection", alias, "copy", versioned)
+		if err := admin.CopyCollection(alias, versioned); err != nil {
+			return fmt.Errorf("copy %s to %s: %w", alias, versioned, err)
+		}
+		if err := admin.DeleteCollection(alias); err != nil {
+			return err
 		}
+	case !slices.Contains(collections, versioned):
+		initial := &typesense30142.TSBackend{
+			ApiKey:         tsDB.ApiKey,
+			Host:           tsDB.Host,
+			CollectionName: versioned,
+			Schema:         tsDB.Schema,
+		}
+		if err := initial.Init(); err != nil {
+			return err
+		}
+	}
+	if err := admin.UpsertAlias(alias, versioned); err != nil {
+		return err
 	}
+	return mgmt.SaveCollectionVersions(CollectionVersions{Current: versioned})
+}
 
-	log.Printf("reindex: completed. total=%d indexed=%d errors=%d",
-		r.total.Load(), r.indexed.Load(), r.errors.Load())
+// swap points alias at target and keeps the collection it pointed to before
+// for rollback. Older collections are dropped.
+func (r *Reindexer) swap(alias, target string) error {
+	versions, err := r.mgmt.LoadCollectionVersions()
+	if err != nil {
+		return err
+	}
+	current, err := r.admin.GetAlias(alias)
+	if err != nil {
+		return err
+	}
+	if current == "" {
+		return fmt.Errorf("%s is not an alias", alias)
+	}
+	if err := r.admin.UpsertAlias(alias, target); err != nil {
+		return err
+	}
+	if versions.Previous != "" && versions.Previous != current && versions.Previous != target {
+		if err := r.admin.DeleteCollection(versions.Previous); err != nil {
+			slog.Warn("failed to drop old collection", "component", "reindex", "collection", versions.Previous, "err", err)
+		}
+	}
+	return r.mgmt.SaveCollectionVersions(CollectionVersions{Current: target, Previous: current})
+}
+
+// Rollback points the alias back at the collection that was live before the
+// last reindex. Writes made since that reindex are not in it; run repairindex
+// afterwards to bring it up to date.
+func (r *Reindexer) Rollback() (CollectionVersions, error) {
+	if r.running.Load() {
+		return CollectionVersions{}, fmt.Errorf("reindex in progress")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	versions, err := r.mgmt.LoadCollectionVersions()
+	if err != nil {
+		return versions, err
+	}
+	if versions.Previous == "" {
+		return versions, fmt.Errorf("no previous collection to roll back to")
+	}
+	if err := r.admin.UpsertAlias(r.tsDB.CollectionName, versions.Previous); err != nil {
+		return versions, err
+	}
+	versions = CollectionVersions{Current: versions.Previous, Previous: versions.Current}
+	return versions, r.mgmt.SaveCollectionVersions(versions)
 }
 
 // GetStatus returns the current reindex status.
 func (r *Reindexer) GetStatus() ReindexStatus {
 	status := ReindexStatus{
-		Running: r.running.Load(),
-		Total:   r.total.Load(),
-		Indexed: r.indexed.Load(),
-		Errors:  r.errors.Load(),
+		Running:   r.running.Load(),
+		Selective: r.selective.Load(),
+		Total:     r.total.Load(),
+		Indexed:   r.indexed.Load(),
+		Errors:    r.errors.Load(),
 	}
 	if v := r.lastErr.Load(); v != nil {
 		if s, ok := v.(string); ok {
 			status.Error = s
 		}
 	}
+	if v, ok := r.phase.Load().(string); ok {
+		status.Phase = v
+	}
+	if v, ok := r.collection.Load().(string); ok {
+		status.Collection = v
+	}
+
+	status.Workers = r.config.Workers
+	status.BatchSize = r.batcher.Size()
+	status.Expected = r.expected.Load()
+	if started := r.started.Load(); started != 0 && status.Running {
+		elapsed := time.Since(time.Unix(0, started)).Seconds()
+		if elapsed > 0 {
+			status.Rate = float64(status.Indexed-r.startIndexed.Load()) / elapsed
+		}
+		if status.Rate > 0 && status.Expected > status.Indexed {
+			remaining := float64(status.Expected-status.Indexed) / status.Rate
+			status.ETA = (time.Duration(remaining) * time.Second).String()
+		}
+	}
 	return status
 }
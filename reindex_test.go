@@ -0,0 +1,566 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// sliceQuery returns a query function over events that behaves like the
+// event store: newest first, honoring Until and the limit.
+func sliceQuery(events []nostr.Event) func(nostr.Filter, int) iter.Seq[nostr.Event] {
+	sorted := slices.Clone(events)
+	slices.SortFunc(sorted, func(a, b nostr.Event) int {
+		if c := cmp.Compare(b.CreatedAt, a.CreatedAt); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ID.Hex(), b.ID.Hex())
+	})
+	return func(filter nostr.Filter, limit int) iter.Seq[nostr.Event] {
+		return func(yield func(nostr.Event) bool) {
+			n := 0
+			for _, event := range sorted {
+				if filter.Until != 0 && event.CreatedAt > filter.Until {
+					continue
+				}
+				if n >= limit || !yield(event) {
+					return
+				}
+				n++
+			}
+		}
+	}
+}
+
+func TestPageEventsSharedTimestamps(t *testing.T) {
+	alice := testPubKey("alice")
+	var events []nostr.Event
+	// Pages of 3 cut right through the 7 events sharing timestamp 500
+	for i := range 7 {
+		events = append(events, makeEvent(alice, fmt.Sprintf("same-%d", i), "Same", 500))
+	}
+	for i := range 4 {
+		events = append(events, makeEvent(alice, fmt.Sprintf("older-%d", i), "Older", nostr.Timestamp(100+i)))
+	}
+	events = append(events, makeEvent(alice, "newest", "Newest", 900))
+
+	seen := map[nostr.ID]int{}
+	pages := 0
+	pageEvents(sliceQuery(events), nostr.Filter{}, 3, func(page []nostr.Event) bool {
+		pages++
+		for _, event := range page {
+			seen[event.ID]++
+		}
+		return true
+	})
+
+	if len(seen) != len(events) {
+		t.Errorf("processed %d distinct events, want %d", len(seen), len(events))
+	}
+	for id, n := range seen {
+		if n != 1 {
+			t.Errorf("event %s processed %d times", id.Hex(), n)
+		}
+	}
+	if pages == 0 {
+		t.Error("fn was never called")
+	}
+}
+
+func TestPageEventsStops(t *testing.T) {
+	alice := testPubKey("alice")
+	var events []nostr.Event
+	for i := range 10 {
+		events = append(events, makeEvent(alice, fmt.Sprint(i), "E", nostr.Timestamp(100+i)))
+	}
+	pages := 0
+	pageEvents(sliceQuery(events), nostr.Filter{}, 3, func(page []nostr.Event) bool {
+		pages++
+		return false
+	})
+	if pages != 1 {
+		t.Errorf("fn called %d times after returning false, want 1", pages)
+	}
+}
+
+func TestAdaptiveBatcher(t *testing.T) {
+	config := ReindexConfig{BatchSize: 100, MinBatchSize: 10, MaxBatchSize: 200, TargetLatency: time.Second}
+	b := &adaptiveBatcher{size: config.BatchSize, config: config}
+
+	b.Observe(100*time.Millisecond, false)
+	if b.Size() != 150 {
+		t.Errorf("size after a fast batch = %d, want 150", b.Size())
+	}
+	b.Observe(100*time.Millisecond, false)
+	if b.Size() != 200 {
+		t.Errorf("size = %d, want it capped at 200", b.Size())
+	}
+	b.Observe(700*time.Millisecond, false)
+	if b.Size() != 200 {
+		t.Errorf("size after a batch within target = %d, want 200", b.Size())
+	}
+	b.Observe(100*time.Millisecond, true)
+	if b.Size() != 100 {
+		t.Errorf("size after a failed batch = %d, want 100", b.Size())
+	}
+	for range 10 {
+		b.Observe(2*time.Second, false)
+	}
+	if b.Size() != 10 {
+		t.Errorf("size after slow batches = %d, want the minimum 10", b.Size())
+	}
+	b.Reset()
+	if b.Size() != 100 {
+		t.Errorf("size after Reset = %d, want 100", b.Size())
+	}
+}
+
+// waitReindex waits for the running reindex of r to finish.
+func waitReindex(t *testing.T, r *Reindexer) ReindexStatus {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for r.GetStatus().Running {
+		if time.Now().After(deadline) {
+			t.Fatal("reindex did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return r.GetStatus()
+}
+
+func TestReindexSwapsAlias(t *testing.T) {
+	ts := newFakeTypesense(t)
+	db := newTestBolt(t)
+	mgmt := newTestManagement(t, db)
+	tsDB := newTestTSBackend(t, ts, "amb")
+	outbox := NewIndexOutbox(tsDB, db)
+	if err := outbox.Init(db.DB); err != nil {
+		t.Fatal(err)
+	}
+
+	// A plain collection from before aliases were used is kept as amb_v0
+	legacy := makeEvent(testPubKey("bob"), "legacy", "Legacy", 500)
+	if err := tsDB.SaveEvent(legacy); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitCollectionAlias(tsDB, mgmt); err != nil {
+		t.Fatal(err)
+	}
+	if target := ts.alias("amb"); target != "amb_v0" {
+		t.Fatalf("alias amb points to %q, want amb_v0", target)
+	}
+	if _, ok := ts.collectionDocs("amb_v0")[legacy.ID.Hex()]; !ok {
+		t.Fatal("documents of the plain collection were not copied to amb_v0")
+	}
+
+	alice, mallory := testPubKey("alice"), testPubKey("mallory")
+	var want []string
+	for i := range 25 {
+		event := makeEvent(alice, fmt.Sprint(i), fmt.Sprintf("Resource %d", i), nostr.Timestamp(1000+i))
+		saveEvents(t, db, event)
+		want = append(want, event.ID.Hex())
+	}
+	hidden := makeEvent(mallory, "spam", "Spam", 2000)
+	saveEvents(t, db, hidden)
+	mgmt.BanPubKey(mallory, "spam")
+	mgmt.SetPubKeyPurge(mallory, PurgeHide)
+
+	config := DefaultReindexConfig()
+	config.Workers = 2
+	config.BatchSize = 4
+	r := NewReindexer(tsDB, db, mgmt, outbox, config)
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	status := waitReindex(t, r)
+	if status.Phase != reindexPhaseDone || status.Error != "" {
+		t.Fatalf("reindex finished with phase %q, error %q", status.Phase, status.Error)
+	}
+	if status.Total != 25 || status.Indexed != 25 || status.Errors != 0 {
+		t.Errorf("total=%d indexed=%d errors=%d, want 25/25/0", status.Total, status.Indexed, status.Errors)
+	}
+
+	target := ts.alias("amb")
+	if !strings.HasPrefix(target, "amb_") || target != status.Collection {
+		t.Fatalf("alias amb points to %q, want the new collection %q", target, status.Collection)
+	}
+	if names := ts.collectionNames(); !slices.Equal(names, []string{target, "amb_v0"}) {
+		t.Errorf("collections = %v, want amb_v0 and %s", names, target)
+	}
+	docs := ts.collectionDocs("amb")
+	var got []string
+	for id := range docs {
+		got = append(got, id)
+	}
+	slices.Sort(got)
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("new collection has %d documents, want the %d events of alice", len(got), len(want))
+	}
+	if _, ok := docs[hidden.ID.Hex()]; ok {
+		t.Error("hidden event of a banned pubkey was indexed")
+	}
+
+	versions, _ := mgmt.LoadCollectionVersions()
+	if versions.Current != target || versions.Previous != "amb_v0" {
+		t.Errorf("versions = %+v, want current %s and previous amb_v0", versions, target)
+	}
+	if cp, _ := mgmt.LoadReindexCheckpoint(); cp != nil {
+		t.Errorf("checkpoint %+v left behind after a finished reindex", cp)
+	}
+	jobs, _ := mgmt.ListReindexJobs()
+	if len(jobs) != 1 || jobs[0].Status != reindexPhaseDone || jobs[0].Indexed != 25 {
+		t.Errorf("history = %+v, want one finished job", jobs)
+	}
+
+	if _, err := r.Rollback(); err != nil {
+		t.Fatalf("Rollback to the migrated collection: %v", err)
+	}
+	if target := ts.alias("amb"); target != "amb_v0" {
+		t.Errorf("alias amb points to %q after rollback, want amb_v0", target)
+	}
+}
+
+func TestReindexRollback(t *testing.T) {
+	ts := newFakeTypesense(t)
+	db := newTestBolt(t)
+	mgmt := newTestManagement(t, db)
+	tsDB := newTestTSBackend(t, ts, "amb_1")
+	tsDB.CollectionName = "amb"
+	ts.addCollection("amb_2")
+	r := NewReindexer(tsDB, db, mgmt, NewIndexOutbox(tsDB, db), DefaultReindexConfig())
+
+	if _, err := r.Rollback(); err == nil {
+		t.Fatal("Rollback succeeded without a previous collection")
+	}
+
+	if err := r.admin.UpsertAlias("amb", "amb_2"); err != nil {
+		t.Fatal(err)
+	}
+	mgmt.SaveCollectionVersions(CollectionVersions{Current: "amb_2", Previous: "amb_1"})
+	versions, err := r.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if versions != (CollectionVersions{Current: "amb_1", Previous: "amb_2"}) {
+		t.Errorf("Rollback returned %+v", versions)
+	}
+	if target := ts.alias("amb"); target != "amb_1" {
+		t.Errorf("alias amb points to %q after rollback, want amb_1", target)
+	}
+	if stored, _ := mgmt.LoadCollectionVersions(); stored != versions {
+		t.Errorf("stored versions = %+v, want %+v", stored, versions)
+	}
+}
+
+func TestReindexResumeWithoutCollection(t *testing.T) {
+	ts := newFakeTypesense(t)
+	db := newTestBolt(t)
+	mgmt := newTestManagement(t, db)
+	tsDB := newTestTSBackend(t, ts, "amb")
+	outbox := NewIndexOutbox(tsDB, db)
+	if err := outbox.Init(db.DB); err != nil {
+		t.Fatal(err)
+	}
+	r := NewReindexer(tsDB, db, mgmt, outbox, DefaultReindexConfig())
+
+	mgmt.SaveReindexCheckpoint(ReindexCheckpoint{Collection: "amb_gone", StartedAt: 100, Indexed: 5})
+	resumed, err := r.Resume()
+	if err != nil || resumed {
+		t.Fatalf("Resume = (%v, %v), want (false, nil)", resumed, err)
+	}
+	if cp, _ := mgmt.LoadReindexCheckpoint(); cp != nil {
+		t.Error("checkpoint of a vanished collection was kept")
+	}
+	jobs, _ := mgmt.ListReindexJobs()
+	if len(jobs) != 1 || jobs[0].Status != reindexPhaseFailed || jobs[0].Collection != "amb_gone" {
+		t.Errorf("history = %+v, want one failed job for amb_gone", jobs)
+	}
+}
+
+func TestReindexStopKeepsCheckpoint(t *testing.T) {
+	ts := newFakeTypesense(t)
+	db := newTestBolt(t)
+	mgmt := newTestManagement(t, db)
+	tsDB := newTestTSBackend(t, ts, "amb")
+	if err := InitCollectionAlias(tsDB, mgmt); err != nil {
+		t.Fatal(err)
+	}
+	// Hold back document writes so the reindex is still copying when stopped
+	release := make(chan struct{})
+	blocked := make(chan struct{}, 1)
+	ts.before = func(r *http.Request) {
+		if strings.Contains(r.URL.Path, "/documents") {
+			select {
+			case blocked <- struct{}{}:
+			default:
+			}
+			<-release
+		}
+	}
+	outbox := NewIndexOutbox(tsDB, db)
+	if err := outbox.Init(db.DB); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 10 {
+		saveEvents(t, db, makeEvent(testPubKey("alice"), fmt.Sprint(i), fmt.Sprintf("Resource %d", i), nostr.Timestamp(1000+i)))
+	}
+
+	r := NewReindexer(tsDB, db, mgmt, outbox, DefaultReindexConfig())
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-blocked:
+	case <-time.After(10 * time.Second):
+		t.Fatal("reindex did not start copying")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := r.Stop(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Stop with a blocked batch = %v, want the deadline to expire", err)
+	}
+	close(release)
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if status := r.GetStatus(); status.Running || status.Phase != reindexPhaseInterrupted {
+		t.Errorf("status = %+v, want a stopped reindex in phase %q", status, reindexPhaseInterrupted)
+	}
+	if err := r.Start(); err == nil {
+		t.Error("Start succeeded after Stop")
+	}
+
+	cp, _ := mgmt.LoadReindexCheckpoint()
+	if cp == nil {
+		t.Fatal("checkpoint was dropped by Stop")
+	}
+	if !slices.Contains(ts.collectionNames(), cp.Collection) {
+		t.Errorf("collection %s was dropped by Stop", cp.Collection)
+	}
+	if jobs, _ := mgmt.ListReindexJobs(); len(jobs) != 0 {
+		t.Errorf("history = %+v, want no finished job", jobs)
+	}
+
+	// The next start resumes and completes the reindex
+	resumed := NewReindexer(tsDB, db, mgmt, outbox, DefaultReindexConfig())
+	if ok, err := resumed.Resume(); err != nil || !ok {
+		t.Fatalf("Resume = (%v, %v), want (true, nil)", ok, err)
+	}
+	if status := waitReindex(t, resumed); status.Phase != reindexPhaseDone || status.Indexed != 10 {
+		t.Errorf("resumed reindex finished with phase %q, indexed %d", status.Phase, status.Indexed)
+	}
+	if target := ts.alias("amb"); target != cp.Collection {
+		t.Errorf("alias amb points to %q, want the resumed collection %s", target, cp.Collection)
+	}
+}
+
+// runOutbox runs the worker of o until the returned function is called.
+func runOutbox(o *IndexOutbox) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		o.Run(ctx)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func TestReindexResumeReplaysWritesFromBeforeRestart(t *testing.T) {
+	ts := newFakeTypesense(t)
+	db := newTestBolt(t)
+	mgmt := newTestManagement(t, db)
+	tsDB := newTestTSBackend(t, ts, "amb")
+	var events []nostr.Event
+	for i := range 10 {
+		event := makeEvent(testPubKey("alice"), fmt.Sprint(i), fmt.Sprintf("Resource %d", i), nostr.Timestamp(1000+i))
+		saveEvents(t, db, event)
+		if err := tsDB.SaveEvent(event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	if err := InitCollectionAlias(tsDB, mgmt); err != nil {
+		t.Fatal(err)
+	}
+	// Hold back the bulk copy so a write is mirrored while it runs
+	release := make(chan struct{})
+	blocked := make(chan struct{}, 1)
+	ts.before = func(r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/documents/import") {
+			select {
+			case blocked <- struct{}{}:
+			default:
+			}
+			<-release
+		}
+	}
+	outbox := NewIndexOutbox(tsDB, db)
+	if err := outbox.Init(db.DB); err != nil {
+		t.Fatal(err)
+	}
+	stopOutbox := runOutbox(outbox)
+
+	r := NewReindexer(tsDB, db, mgmt, outbox, DefaultReindexConfig())
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-blocked:
+	case <-time.After(10 * time.Second):
+		t.Fatal("reindex did not start copying")
+	}
+
+	// The delete reaches the new collection before the copy of the event,
+	// which was read from BoltDB earlier
+	deleted := events[9]
+	if err := writeThroughOutbox(outbox, outboxOpDelete, nil, deleted.ID, func() error {
+		return db.DeleteEvent(deleted.ID)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := outbox.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The relay stops before the reindex could replay the delete
+	r.interrupt()
+	close(release)
+	if err := r.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	stopOutbox()
+
+	restarted := NewIndexOutbox(tsDB, db)
+	if err := restarted.Init(db.DB); err != nil {
+		t.Fatal(err)
+	}
+	defer runOutbox(restarted)()
+	resumed := NewReindexer(tsDB, db, mgmt, restarted, DefaultReindexConfig())
+	if ok, err := resumed.Resume(); err != nil || !ok {
+		t.Fatalf("Resume = (%v, %v), want (true, nil)", ok, err)
+	}
+	if status := waitReindex(t, resumed); status.Phase != reindexPhaseDone {
+		t.Fatalf("resumed reindex finished with phase %q, error %q", status.Phase, status.Error)
+	}
+	docs := ts.collectionDocs("amb")
+	if _, ok := docs[deleted.ID.Hex()]; ok {
+		t.Error("event deleted during the interrupted reindex is in the new collection")
+	}
+	if len(docs) != 9 {
+		t.Errorf("new collection has %d documents, want 9", len(docs))
+	}
+}
+
+func TestReindexCancelDuringSwap(t *testing.T) {
+	ts := newFakeTypesense(t)
+	db := newTestBolt(t)
+	mgmt := newTestManagement(t, db)
+	tsDB := newTestTSBackend(t, ts, "amb")
+	if err := InitCollectionAlias(tsDB, mgmt); err != nil {
+		t.Fatal(err)
+	}
+	// Hold back the alias update so the reindex stays in the swap
+	release := make(chan struct{})
+	blocked := make(chan struct{}, 1)
+	ts.before = func(r *http.Request) {
+		if r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/aliases/") {
+			blocked <- struct{}{}
+			<-release
+		}
+	}
+	outbox := NewIndexOutbox(tsDB, db)
+	if err := outbox.Init(db.DB); err != nil {
+		t.Fatal(err)
+	}
+	saveEvents(t, db, makeEvent(testPubKey("alice"), "physics-101", "Physics 101", 1000))
+
+	r := NewReindexer(tsDB, db, mgmt, outbox, DefaultReindexConfig())
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-blocked:
+	case <-time.After(10 * time.Second):
+		t.Fatal("reindex did not reach the swap")
+	}
+	if err := r.Cancel(); err == nil {
+		t.Error("Cancel succeeded while the alias was being swapped")
+	}
+	close(release)
+	if status := waitReindex(t, r); status.Phase != reindexPhaseDone {
+		t.Errorf("reindex finished with phase %q, want %q", status.Phase, reindexPhaseDone)
+	}
+	if target := ts.alias("amb"); target == "amb_v0" {
+		t.Error("alias still points to the old collection")
+	}
+}
+
+func TestReindexSelectiveThroughOutbox(t *testing.T) {
+	ts := newFakeTypesense(t)
+	db := newTestBolt(t)
+	mgmt := newTestManagement(t, db)
+	tsDB := newTestTSBackend(t, ts, "amb")
+	outbox := NewIndexOutbox(tsDB, db)
+	if err := outbox.Init(db.DB); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		outbox.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	alice := testPubKey("alice")
+	physics := makeEvent(alice, "physics-101", "Physics 101", 1000)
+	biology := makeEvent(alice, "biology-101", "Biology 101", 1000)
+	writing := makeEvent(alice, "chemistry-101", "Chemistry 101", 1000)
+	saveEvents(t, db, physics, biology, writing)
+	// A write of the same address that is between its outbox entry and commit
+	seq, err := outbox.Enqueue(outboxOpSave, &writing, writing.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outbox.Discard(seq)
+
+	r := NewReindexer(tsDB, db, mgmt, outbox, DefaultReindexConfig())
+	if err := r.StartSelective(nostr.Filter{Kinds: []nostr.Kind{30142}}); err != nil {
+		t.Fatal(err)
+	}
+	status := waitReindex(t, r)
+	if status.Phase != reindexPhaseDone || status.Indexed != 2 || status.Errors != 0 {
+		t.Fatalf("status = %+v, want done with 2 indexed", status)
+	}
+	docs := ts.collectionDocs("amb")
+	for _, event := range []nostr.Event{physics, biology} {
+		if _, ok := docs[event.ID.Hex()]; !ok {
+			t.Errorf("%s was not re-upserted", event.Tags.GetD())
+		}
+	}
+	if _, ok := docs[writing.ID.Hex()]; ok {
+		t.Error("re-upsert overtook a queued write of the same address")
+	}
+	if names := ts.collectionNames(); !slices.Equal(names, []string{"amb"}) {
+		t.Errorf("collections = %v, want the live collection only", names)
+	}
+}
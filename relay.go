@@ -0,0 +1,824 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore/boltdb"
+	"fiatjaf.com/nostr/eventstore/typesense30142"
+	"fiatjaf.com/nostr/khatru"
+	"fiatjaf.com/nostr/nip11"
+)
+
+// AMBRelay is a khatru relay for kind 30142 events, stored in BoltDB and
+// searched through Typesense, together with the background jobs and
+// management state behind its NIP-86 API. It serves HTTP through the
+// embedded khatru.Relay, so several can run in one process, each with its
+// own Config.
+type AMBRelay struct {
+	*khatru.Relay
+
+	config  Config
+	admins  map[nostr.PubKey]bool
+	started time.Time
+	cancel  context.CancelFunc
+	metrics *Metrics
+
+	// writeMu guards closing; writes counts the StoreEvent, ReplaceEvent and
+	// DeleteEvent calls in progress so Shutdown can wait for them.
+	writeMu    sync.RWMutex
+	closing    bool
+	writes     sync.WaitGroup
+	outboxDone chan struct{}
+
+	boltDB *boltdb.BoltBackend
+	tsDB   *typesense30142.TSBackend
+	// keywordDB shares the collection with tsDB but never embeds queries.
+	keywordDB *typesense30142.TSBackend
+	mgmt      *ManagementStore
+	// readyAdmin checks the collection for /readyz with a short timeout.
+	readyAdmin *TypesenseAdmin
+	embedProbe embedProbe
+
+	embedClient  *EmbeddingClient
+	embedBreaker *EmbeddingBreaker
+	embedCache   *EmbeddingCache
+	// embedder is the full embedding chain: breaker, cache and chunking.
+	embedder   *ChunkingEmbedder
+	modelCheck *EmbeddingModelCheck
+	// semanticMu serializes applySemanticConfig, attached holds its result.
+	semanticMu sync.Mutex
+	attached   atomic.Pointer[attachedEmbedding]
+
+	outbox    *IndexOutbox
+	reindexer *Reindexer
+	verifier  *IndexVerifier
+	purger    *Purger
+	stats     *StatsCollector
+
+	searcher    *SemanticSearcher
+	queryCache  *QueryVectorCache
+	resultCache *SearchResultCache
+}
+
+// NewAMBRelay opens the BoltDB at cfg.DBPath, connects to Typesense and wires
+// up the relay. Close releases what it opened.
+func NewAMBRelay(cfg Config) (_ *AMBRelay, err error) {
+	r := &AMBRelay{
+		Relay:   khatru.NewRelay(),
+		config:  cfg,
+		admins:  map[nostr.PubKey]bool{},
+		started: time.Now(),
+		metrics: NewMetrics(),
+	}
+	r.setInfo()
+	addLogSecret(cfg.TSAPIKey)
+	addLogSecret(cfg.MetricsToken)
+
+	if cfg.PubKey != (nostr.PubKey{}) {
+		r.admins[cfg.PubKey] = true
+	}
+	for _, pk := range cfg.AdminPubKeys {
+		r.admins[pk] = true
+	}
+
+	// BoltDB backend (raw event persistence) — initialized first so we can load schema
+	if dir := filepath.Dir(cfg.DBPath); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create data directory %s: %w", dir, err)
+		}
+	}
+	r.boltDB = &boltdb.BoltBackend{Path: cfg.DBPath}
+	if err := r.boltDB.Init(); err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", cfg.DBPath, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	defer func() {
+		if err != nil {
+			r.Close()
+		}
+	}()
+
+	// Management store (bans + schema) — shares the same bbolt database
+	r.mgmt = &ManagementStore{}
+	if err := r.mgmt.Init(r.boltDB.DB); err != nil {
+		return nil, err
+	}
+
+	// Typesense backend (search index)
+	r.tsDB = &typesense30142.TSBackend{
+		ApiKey:         cfg.TSAPIKey,
+		Host:           cfg.TSHost,
+		CollectionName: cfg.TSCollection,
+	}
+
+	// Load custom schema from BoltDB if one was stored
+	if customSchema, err := r.mgmt.LoadSchema(); err != nil {
+		slog.Warn("failed to load custom schema", "err", err)
+	} else if customSchema != nil {
+		r.tsDB.Schema = customSchema
+		slog.Info("using custom Typesense schema from BoltDB")
+	}
+
+	if err := InitCollectionAlias(r.tsDB, r.mgmt); err != nil {
+		return nil, fmt.Errorf("failed to set up Typesense alias %s: %w", cfg.TSCollection, err)
+	}
+	if err := r.tsDB.Init(); err != nil {
+		return nil, fmt.Errorf("failed to initialize Typesense collection %s: %w", cfg.TSCollection, err)
+	}
+	r.readyAdmin = NewTypesenseAdmin(r.tsDB)
+	// CollectionFields makes two requests within readyTimeout
+	r.readyAdmin.HTTPClient.Timeout = readyTimeout / 2
+
+	// Outbox keeping Typesense in sync with BoltDB writes
+	r.outbox = NewIndexOutbox(r.tsDB, r.boltDB)
+	r.outbox.Metrics = r.metrics
+	if err := r.outbox.Init(r.boltDB.DB); err != nil {
+		return nil, err
+	}
+
+	if err := r.initEmbedding(); err != nil {
+		return nil, err
+	}
+
+	// Created before the worker starts, which invalidates it for every
+	// operation it applies
+	if cfg.SearchResultCacheTTL > 0 {
+		r.resultCache = NewSearchResultCache(cfg.SearchResultCacheTTL, DefaultResultCacheEntries)
+	}
+	r.outboxDone = make(chan struct{})
+	go func() {
+		defer close(r.outboxDone)
+		r.outbox.Run(ctx)
+	}()
+
+	// Reindexer for rebuilding Typesense from BoltDB
+	r.reindexer = NewReindexer(r.tsDB, r.boltDB, r.mgmt, r.outbox, cfg.Reindex)
+	r.reindexer.Metrics = r.metrics
+	// A reindex embeds with the current model even while the live collection
+	// cannot take its vectors
+	r.reindexer.Embedding = func() (typesense30142.Embedder, []string) {
+		cfg, _ := r.mgmt.LoadSemanticConfig()
+		return r.semanticEmbedder(cfg)
+	}
+	r.reindexer.OnSwap = func(embedded bool) {
+		if embedded {
+			if err := r.modelCheck.MarkIndexed(); err != nil {
+				slog.Warn("failed to record embedding model", "err", err)
+			}
+		}
+		r.modelCheck.Run()
+		cfg, _ := r.mgmt.LoadSemanticConfig()
+		r.applySemanticConfig(cfg)
+	}
+	resumed, err := r.reindexer.Resume()
+	if err != nil {
+		slog.Warn("failed to resume interrupted reindex", "err", err)
+	} else if resumed {
+		slog.Info("resuming interrupted reindex from checkpoint")
+	}
+	if r.embedClient.Configured() && !resumed {
+		r.reembedIfModelChanged()
+	}
+
+	// Verifier for detecting and repairing drift between BoltDB and Typesense
+	r.verifier = NewIndexVerifier(r.tsDB, r.boltDB, r.mgmt, r.outbox)
+
+	// Purger for retroactively hiding/deleting events of banned pubkeys
+	r.purger = NewPurger(r.tsDB, r.boltDB, r.mgmt, r.outbox)
+
+	// Breakdowns for the stats method, cached since they take dozens of searches
+	r.stats = NewStatsCollector(r.tsDB, r.boltDB, cfg.StatsCacheTTL)
+	r.stats.Metrics = r.metrics
+
+	if err := r.initSearch(); err != nil {
+		return nil, err
+	}
+
+	r.OnConnect = func(ctx context.Context) {
+		khatru.RequestAuth(ctx)
+		ctxLogger(ctx).Debug("connection opened", "ip", khatru.GetIP(ctx))
+	}
+	r.OnDisconnect = func(ctx context.Context) {
+		ctxLogger(ctx).Debug("connection closed")
+	}
+
+	// Dual-write eventstore wiring (query from Typesense, persist to both)
+	r.QueryStored = r.queryStored
+	r.Count = r.count
+	r.Relay.StoreEvent = r.storeEvent
+	r.Relay.ReplaceEvent = r.replaceEvent
+	r.Relay.DeleteEvent = r.deleteEvent
+	r.Negentropy = true
+
+	// Event validation + ban check
+	r.OnEvent = func(ctx context.Context, event nostr.Event) (reject bool, msg string) {
+		reason, msg := checkEvent(r.mgmt, event)
+		r.metrics.ObserveEvent(reason)
+		logger := ctxLogger(ctx).With("id", event.ID.Hex(), "kind", event.Kind, "pubkey", event.PubKey.Hex())
+		if reason != "" {
+			logger.Info("event rejected", "reason", reason)
+		} else {
+			logger.Debug("event accepted")
+		}
+		return reason != "", msg
+	}
+
+	r.setManagementAPI()
+	r.Router().HandleFunc("GET /metrics", r.serveMetrics)
+	r.Router().HandleFunc("GET /healthz", r.serveHealthz)
+	r.Router().HandleFunc("GET /readyz", r.serveReadyz)
+	return r, nil
+}
+
+// Shutdown stops the relay gracefully: new writes are rejected, writes in
+// progress finish, a running reindex stops at its checkpoint, purges and
+// verifications run to completion and the outbox is drained into Typesense.
+// Once ctx is done it stops waiting, and the BoltDB is closed either way.
+// Index operations that were not applied stay queued for the next start.
+// Call it after the HTTP server stopped accepting connections.
+func (r *AMBRelay) Shutdown(ctx context.Context) error {
+	defer r.Close()
+
+	r.writeMu.Lock()
+	r.closing = true
+	r.writeMu.Unlock()
+
+	writesDone := make(chan struct{})
+	go func() {
+		r.writes.Wait()
+		close(writesDone)
+	}()
+	select {
+	case <-writesDone:
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for writes: %w", ctx.Err())
+	}
+
+	if err := r.reindexer.Stop(ctx); err != nil {
+		return fmt.Errorf("waiting for reindex: %w", err)
+	}
+	for r.purger.GetStatus().Running || r.verifier.GetStatus().Running {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for purge or verification: %w", ctx.Err())
+		case <-time.After(outboxDrainInterval):
+		}
+	}
+	if err := r.outbox.Drain(ctx); err != nil {
+		status := r.outbox.GetStatus()
+		return fmt.Errorf("draining index outbox, %d operations left for the next start: %w", status.Pending, err)
+	}
+
+	// Let the worker finish its last operation before BoltDB is closed
+	r.cancel()
+	select {
+	case <-r.outboxDone:
+	case <-ctx.Done():
+		return fmt.Errorf("stopping index outbox: %w", ctx.Err())
+	}
+	return nil
+}
+
+// Close stops the background jobs without waiting for them and closes the
+// BoltDB. Use Shutdown to stop gracefully.
+func (r *AMBRelay) Close() {
+	if r.reindexer != nil {
+		r.reindexer.interrupt()
+	}
+	if r.embedBreaker != nil {
+		r.embedBreaker.Stop()
+	}
+	if r.cancel != nil {
+		r.cancel()
+	}
+	if r.boltDB != nil {
+		r.boltDB.Close()
+	}
+}
+
+// setInfo fills the NIP-11 relay information document.
+func (r *AMBRelay) setInfo() {
+	r.Info.Name = r.config.Name
+	r.Info.Description = r.config.Description
+	r.Info.Icon = r.config.Icon
+	if r.config.PubKey != (nostr.PubKey{}) {
+		pk := r.config.PubKey
+		r.Info.PubKey = &pk
+	}
+
+	// NIP-11: Software identification
+	r.Info.Software = "https://git.edufeed.org/edufeed/amb-relay"
+	r.Info.Version = getVersion()
+
+	// NIP-11: Supported NIPs (khatru defaults: 1, 11, 42, 70, 86)
+	r.Info.AddSupportedNIPs([]int{9, 45, 50}) // deletion, count, search
+	// AMB-NIP reference (custom NIP for kind 30142 educational metadata)
+	r.Info.SupportedNIPs = append(r.Info.SupportedNIPs,
+		"naddr1qvzqqqrcvypzp0wzr7fmrcktw4sgemxh5zsq5auh08vnvlwf0x9anusn7pkft0zgqy28wumn8ghj7un9d3shjtnyv9kh2uewd9hsqzm9v36kvet9vskkzmtzvjvrtf")
+
+	// NIP-11: Limitations
+	r.Info.Limitation = &nip11.RelayLimitationDocument{
+		MaxLimit:         250,
+		RestrictedWrites: true,
+		AuthRequired:     false,
+	}
+
+	// NIP-11: Retention
+	r.Info.Retention = []*nip11.RelayRetentionDocument{
+		{Kinds: [][]int{{5}, {30142}}},
+	}
+}
+
+// initEmbedding sets up the embedding chain, loads the semantic search
+// configuration and attaches the embedder to the TSBackend if it is enabled.
+func (r *AMBRelay) initEmbedding() error {
+	cfg := r.config
+
+	// Embedding provider: config, overridden by one stored through setembeddingprovider
+	embedProvider := cfg.EmbedProvider
+	if stored, err := r.mgmt.LoadEmbeddingProvider(); err != nil {
+		slog.Warn("failed to load embedding provider", "err", err)
+	} else if stored != nil {
+		embedProvider = *stored
+		slog.Info("using embedding provider stored in BoltDB")
+	}
+	embedProvider = validEmbeddingProvider(embedProvider)
+
+	// Initialize embedding client; it stays unused until an endpoint is configured
+	r.embedClient = NewEmbeddingClient(embedProvider)
+	r.embedClient.MaxRetries = cfg.EmbedMaxRetries
+	r.embedClient.RetryBackoff = cfg.EmbedRetryBackoff
+	r.embedClient.Metrics = r.metrics
+	if embedProvider.Provider == EmbedProviderHash {
+		slog.Warn("using deterministic hash embeddings, not suitable for production", "dimensions", embedProvider.HashDimensions())
+	} else if r.embedClient.Configured() {
+		slog.Info("embedding service configured", "endpoint", embedProvider.Endpoint, "provider", embedProvider.Provider)
+	}
+
+	// Stop calling a failing service and fall back to keyword-only search
+	r.embedBreaker = NewEmbeddingBreaker(r.embedClient, cfg.EmbedBreakerThreshold, cfg.EmbedBreakerCooldown)
+	var embedder typesense30142.Embedder = r.embedBreaker
+
+	// Cache vectors in BoltDB so unchanged texts are not embedded again
+	if cfg.EmbedCacheMaxEntries > 0 {
+		r.embedCache = NewEmbeddingCache(embedder, embedProvider.ModelID(), cfg.EmbedCacheMaxEntries)
+		if err := r.embedCache.Init(r.boltDB.DB); err != nil {
+			return err
+		}
+		embedder = r.embedCache
+		if r.embedClient.Configured() {
+			slog.Info("embedding cache enabled", "entries", r.embedCache.GetStats().Entries, "max_entries", cfg.EmbedCacheMaxEntries)
+		}
+	}
+
+	// Split long texts into chunks and pool the chunk vectors
+	r.embedder = NewChunkingEmbedder(embedder, cfg.EmbedChunkTokens, cfg.EmbedMaxChunks)
+
+	// Load semantic config and configure TSBackend
+	semanticCfg, err := r.mgmt.LoadSemanticConfig()
+	if err != nil {
+		slog.Warn("failed to load semantic config", "err", err)
+		semanticCfg = DefaultSemanticConfig()
+	}
+
+	// Override enabled state from config if set
+	if cfg.SemanticSearchEnabled && r.embedClient.Configured() {
+		if !semanticCfg.Enabled {
+			semanticCfg.Enabled = true
+			r.mgmt.SaveSemanticConfig(semanticCfg) // Persist so NIP-86 reflects it
+		}
+	}
+
+	// Check which model produced the stored vectors and whether the current
+	// one fits the collection
+	r.modelCheck = NewEmbeddingModelCheck(r.embedClient, r.mgmt, r.tsDB)
+	if r.embedClient.Configured() {
+		status := r.modelCheck.Run()
+		if status.Error != "" {
+			slog.Warn("embedding model check failed", "err", status.Error)
+		}
+		if status.DimensionMismatch {
+			slog.Warn("embedding model does not fit the collection, semantic search stays off until reindexed",
+				"model", status.Model, "dimensions", status.Dimensions, "collection_dimensions", status.CollectionDimensions)
+		}
+	}
+
+	r.embedBreaker.OnStateChange = func(bool) {
+		// Notifications may arrive out of order; act on the current state
+		open := r.embedBreaker.IsOpen()
+		cfg, err := r.mgmt.LoadSemanticConfig()
+		if err != nil {
+			slog.Warn("failed to load semantic config", "err", err)
+			return
+		}
+		if open && cfg.Enabled {
+			slog.Warn("embedding service failing, falling back to keyword-only indexing and search")
+		}
+		r.applySemanticConfig(cfg)
+		if !open && cfg.Enabled {
+			go r.reembedUnembedded()
+		}
+	}
+	// Events indexed while the breaker is open get no vector; they are
+	// re-embedded once it closes
+	r.outbox.OnApplied = func(entry outboxEntry) {
+		// Writes return before they are indexed, so results cached in
+		// between are stale too
+		r.invalidateResults()
+		if entry.Event == nil || !r.embedBreaker.IsOpen() {
+			return
+		}
+		if cfg, err := r.mgmt.LoadSemanticConfig(); err != nil || !cfg.Enabled {
+			return
+		}
+		if err := r.mgmt.AddUnembedded(entry.eventID()); err != nil {
+			slog.Warn("failed to record event indexed without embedding", "component", "embedding", "id", entry.ID, "err", err)
+		}
+	}
+
+	r.applySemanticConfig(semanticCfg)
+	if semanticCfg.Enabled && r.embedClient.Configured() {
+		slog.Info("semantic search enabled", "fields", semanticCfg.EmbedFields)
+	} else {
+		slog.Info("semantic search disabled")
+	}
+	return nil
+}
+
+// semanticEmbedder returns the embedder and fields to index with if semantic
+// search is enabled and the embedding service is not failing.
+func (r *AMBRelay) semanticEmbedder(cfg SemanticConfig) (typesense30142.Embedder, []string) {
+	if cfg.Enabled && r.embedClient.Configured() && !r.embedBreaker.IsOpen() {
+		return r.embedder, WeightedEmbedFields(cfg)
+	}
+	return nil, nil
+}
+
+// applySemanticConfig attaches the embedder to the TSBackend unless the
+// model's vectors do not fit the live collection. It is called from the
+// breaker's state changes as well as from management requests.
+func (r *AMBRelay) applySemanticConfig(cfg SemanticConfig) {
+	r.semanticMu.Lock()
+	defer r.semanticMu.Unlock()
+	embedder, fields := r.semanticEmbedder(cfg)
+	if r.modelCheck.Blocked() {
+		embedder, fields = nil, nil
+	}
+	r.attached.Store(&attachedEmbedding{embedder: embedder})
+	r.outbox.SetEmbedding(embedder, fields)
+}
+
+// attachedEmbedding is the embedder applySemanticConfig attached, nil while
+// indexing and search are keyword-only.
+type attachedEmbedding struct {
+	embedder typesense30142.Embedder
+}
+
+// attachedEmbedder returns the embedder new events are indexed with, or nil.
+func (r *AMBRelay) attachedEmbedder() typesense30142.Embedder {
+	if attached := r.attached.Load(); attached != nil {
+		return attached.embedder
+	}
+	return nil
+}
+
+// reembedUnembedded queues the events indexed without a vector while the
+// breaker was open, now that the embedder is attached again. Events replaced
+// since then are skipped; the newer version was embedded on its own.
+func (r *AMBRelay) reembedUnembedded() {
+	ids, err := r.mgmt.ListUnembedded()
+	if err != nil {
+		slog.Warn("failed to list events indexed without embedding", "component", "embedding", "err", err)
+		return
+	}
+	queued := 0
+	for _, id := range ids {
+		if r.embedBreaker.IsOpen() {
+			// The rest waits for the breaker to close again
+			break
+		}
+		for event := range r.boltDB.QueryEvents(nostr.Filter{IDs: []nostr.ID{id}}, 1) {
+			seq, err := r.outbox.QueueIf(outboxOpSave, &event, id, func() bool {
+				current, ok := indexedVersion(r.boltDB, r.mgmt, event)
+				return ok && current.ID == id
+			})
+			if err != nil {
+				slog.Warn("failed to queue re-embedding", "component", "embedding", "id", id.Hex(), "err", err)
+				return
+			}
+			if seq != 0 {
+				queued++
+			}
+		}
+		if err := r.mgmt.RemoveUnembedded(id); err != nil {
+			slog.Warn("failed to forget re-embedded event", "component", "embedding", "id", id.Hex(), "err", err)
+		}
+	}
+	if queued > 0 {
+		slog.Info("re-embedding events indexed while the embedding service was failing", "component", "embedding", "events", queued)
+	}
+}
+
+// validEmbeddingProvider registers the token of provider as a log secret and
+// returns provider, or an unconfigured one if it is invalid.
+func validEmbeddingProvider(provider EmbeddingProviderConfig) EmbeddingProviderConfig {
+	addLogSecret(provider.Token)
+	if provider.Configured() {
+		if err := provider.Validate(); err != nil {
+			slog.Warn("invalid embedding provider", "err", err)
+			return EmbeddingProviderConfig{Provider: EmbedProviderEdufeed}
+		}
+	}
+	return provider
+}
+
+// switchEmbeddingProvider embeds with provider from now on and re-checks the
+// model against the indexed vectors.
+func (r *AMBRelay) switchEmbeddingProvider(provider EmbeddingProviderConfig) {
+	r.embedClient.SetProvider(provider)
+	if r.embedCache != nil {
+		r.embedCache.SetModel(provider.ModelID())
+	}
+	r.modelCheck.Run()
+	cfg, _ := r.mgmt.LoadSemanticConfig()
+	r.applySemanticConfig(cfg)
+	r.reembedIfModelChanged()
+}
+
+// reembedIfModelChanged reports a model change and, with EmbedAutoReembed,
+// starts a reindex to re-embed all events with the new model.
+func (r *AMBRelay) reembedIfModelChanged() {
+	status := r.modelCheck.GetStatus()
+	if !status.ReembedRequired {
+		return
+	}
+	slog.Warn("embedding model changed, semantic search stays off until the stored vectors are re-embedded with reindex",
+		"indexed_model", status.IndexedModel, "model", status.Model)
+	if !r.modelCheck.CanReembed() {
+		slog.Warn("collection schema dimensions do not fit the model, update the schema before reindexing",
+			"schema_dimensions", status.SchemaDimensions, "dimensions", status.Dimensions)
+		return
+	}
+	if cfg, _ := r.mgmt.LoadSemanticConfig(); !r.config.EmbedAutoReembed || !cfg.Enabled {
+		return
+	}
+	if err := r.reindexer.Start(); err != nil {
+		slog.Warn("automatic re-embed not started", "err", err)
+	} else {
+		slog.Info("started reindex to re-embed with the new model")
+	}
+}
+
+// initSearch sets up the search backends for the NIP-50 extensions and the
+// query vector cache.
+func (r *AMBRelay) initSearch() error {
+	cfg := r.config
+
+	// Search backends for the NIP-50 mode: and alpha: extensions. The keyword
+	// backend shares the collection but never embeds queries.
+	r.keywordDB = &typesense30142.TSBackend{
+		ApiKey:         r.tsDB.ApiKey,
+		Host:           r.tsDB.Host,
+		CollectionName: r.tsDB.CollectionName,
+		Schema:         r.tsDB.Schema,
+	}
+	if err := r.keywordDB.Init(); err != nil {
+		return err
+	}
+
+	// Cache query vectors and search results so popular queries are not
+	// embedded and searched again
+	if cfg.QueryCacheMaxEntries > 0 {
+		r.queryCache = NewQueryVectorCache(cfg.QueryCacheMaxEntries, cfg.QueryBatchWindow, func() string {
+			return r.embedClient.Provider().ModelID()
+		})
+		if cfg.QueryCachePersist {
+			if err := r.queryCache.Init(r.boltDB.DB); err != nil {
+				return err
+			}
+		}
+	}
+	r.searcher = NewSemanticSearcher(r.tsDB, r.boltDB, r.attachedEmbedder, r.queryCache)
+	r.searcher.Metrics = r.metrics
+	return nil
+}
+
+// runSearch strips the search extensions from filter and picks the backend they ask for.
+// Searches run through the SemanticSearcher while an embedder is attached, so
+// query vectors are cached, and through the keyword-only backend otherwise.
+// The error is set when the search failed without a fallback.
+func (r *AMBRelay) runSearch(ctx context.Context, filter nostr.Filter, maxLimit int) (iter.Seq[nostr.Event], error) {
+	if filter.Search == "" {
+		return r.metrics.TimeTypesenseQuery("search", r.keywordDB.QueryEvents(filter, maxLimit)), nil
+	}
+	query, opts := parseSearchExtensions(filter.Search)
+	filter.Search = query
+	limit := maxLimit
+	if filter.Limit > 0 {
+		limit = min(filter.Limit, maxLimit)
+	}
+	switch {
+	case opts.Similar != "":
+		events, err := r.searcher.Similar(filter, opts.Similar, query, opts, limit)
+		if err != nil {
+			ctxLogger(ctx).Warn("similar search failed", "similar", opts.Similar, "err", err)
+			return func(yield func(nostr.Event) bool) {}, err
+		}
+		return events, nil
+	case opts.Mode != SearchModeKeyword:
+		events, err := r.searcher.Search(ctx, filter, query, opts, limit)
+		if err == nil {
+			return events, nil
+		}
+		// Fall back to keyword search, as while semantic search is off or
+		// for filters only the event store can apply
+		if !errors.Is(err, errSemanticSearchOff) && !errors.Is(err, errFilterNotTranslatable) {
+			ctxLogger(ctx).Warn("vector search failed, using keyword search", "err", err)
+		}
+	}
+	return r.metrics.TimeTypesenseQuery("search", r.keywordDB.QueryEvents(filter, maxLimit)), nil
+}
+
+// searchEvents serves repeated searches from the result cache.
+func (r *AMBRelay) searchEvents(ctx context.Context, filter nostr.Filter, maxLimit int) (iter.Seq[nostr.Event], error) {
+	if filter.Search == "" || r.resultCache == nil {
+		return r.runSearch(ctx, filter, maxLimit)
+	}
+	key := searchCacheKey(filter, maxLimit)
+	events, generation, ok := r.resultCache.Get(key)
+	if !ok {
+		found, err := r.runSearch(ctx, filter, maxLimit)
+		if err != nil {
+			return found, err
+		}
+		events = slices.Collect(found)
+		if ctx.Err() == nil {
+			r.resultCache.Put(key, generation, events)
+		}
+	}
+	return slices.Values(events), nil
+}
+
+func (r *AMBRelay) queryStored(ctx context.Context, filter nostr.Filter) iter.Seq[nostr.Event] {
+	maxLimit := 250
+	if khatru.IsNegentropySession(ctx) {
+		maxLimit = 250 * 20
+	}
+	start := time.Now()
+	events, err := r.searchEvents(ctx, filter, maxLimit)
+	return func(yield func(nostr.Event) bool) {
+		// The latency includes sending the events to the client
+		sent := 0
+		defer func() {
+			r.metrics.ObserveQuery("req", start, err)
+			ctxLogger(ctx).Debug("req", "filter", filter, "events", sent, "duration", time.Since(start))
+		}()
+		for event := range events {
+			if r.excludedFromResults(event) {
+				continue
+			}
+			if !yield(event) {
+				return
+			}
+			sent++
+		}
+	}
+}
+
+// excludedFromResults reports whether REQ leaves out an indexed event: it is
+// banned, or its pubkey is banned and its events are being purged.
+func (r *AMBRelay) excludedFromResults(event nostr.Event) bool {
+	if r.mgmt.IsEventBanned(event.ID) {
+		return true
+	}
+	mode := r.mgmt.PubKeyPurgeMode(event.PubKey)
+	return mode == PurgeHide || mode == PurgeDelete
+}
+
+func (r *AMBRelay) count(ctx context.Context, filter nostr.Filter) (uint32, error) {
+	start := time.Now()
+	filter.Search, _ = parseSearchExtensions(filter.Search)
+	count, err := r.keywordDB.CountEvents(filter)
+	if err == nil {
+		// Leave out the events of purged pubkeys, as REQ does
+		var excluded uint32
+		excluded, err = r.countPurged(filter)
+		count -= min(excluded, count)
+	}
+	r.metrics.ObserveTypesense("count", start, err)
+	r.metrics.ObserveQuery("count", start, err)
+	if err != nil {
+		ctxLogger(ctx).Warn("count failed", "filter", filter, "err", err)
+	} else {
+		ctxLogger(ctx).Debug("count", "filter", filter, "count", count, "duration", time.Since(start))
+	}
+	return count, err
+}
+
+// countPurged counts the events matching filter whose pubkeys are being
+// purged and still indexed.
+func (r *AMBRelay) countPurged(filter nostr.Filter) (uint32, error) {
+	purged, err := r.mgmt.PurgedPubKeys()
+	if err != nil {
+		return 0, err
+	}
+	if len(filter.Authors) > 0 {
+		purged = slices.DeleteFunc(purged, func(pk nostr.PubKey) bool {
+			return !slices.Contains(filter.Authors, pk)
+		})
+	}
+	if len(purged) == 0 {
+		return 0, nil
+	}
+	filter.Authors = purged
+	return r.keywordDB.CountEvents(filter)
+}
+
+// invalidateResults drops cached search results, which writes make stale.
+func (r *AMBRelay) invalidateResults() {
+	if r.resultCache != nil {
+		r.resultCache.Invalidate()
+	}
+}
+
+// errShuttingDown rejects writes that arrive after Shutdown was called.
+var errShuttingDown = errors.New("relay is shutting down")
+
+// beginWrite registers a write with Shutdown. It returns false once the
+// relay is shutting down; otherwise the caller must call r.writes.Done.
+func (r *AMBRelay) beginWrite() bool {
+	r.writeMu.RLock()
+	defer r.writeMu.RUnlock()
+	if r.closing {
+		return false
+	}
+	r.writes.Add(1)
+	return true
+}
+
+func (r *AMBRelay) storeEvent(ctx context.Context, event nostr.Event) error {
+	if !r.beginWrite() {
+		return errShuttingDown
+	}
+	defer r.writes.Done()
+	if event.Kind != 30142 {
+		return r.boltDB.SaveEvent(event)
+	}
+	defer r.invalidateResults()
+	return writeThroughOutbox(r.outbox, outboxOpSave, &event, event.ID, func() error {
+		return r.boltDB.SaveEvent(event)
+	})
+}
+
+func (r *AMBRelay) replaceEvent(ctx context.Context, event nostr.Event) error {
+	if !r.beginWrite() {
+		return errShuttingDown
+	}
+	defer r.writes.Done()
+	defer r.invalidateResults()
+	return writeThroughOutbox(r.outbox, outboxOpReplace, &event, event.ID, func() error {
+		return r.boltDB.ReplaceEvent(event)
+	})
+}
+
+func (r *AMBRelay) deleteEvent(ctx context.Context, id nostr.ID) error {
+	if !r.beginWrite() {
+		return errShuttingDown
+	}
+	defer r.writes.Done()
+	defer r.invalidateResults()
+	return writeThroughOutbox(r.outbox, outboxOpDelete, nil, id, func() error {
+		return r.boltDB.DeleteEvent(id)
+	})
+}
+
+// writeThroughOutbox persists a write to BoltDB and queues the matching index
+// operation. The operation is recorded before the BoltDB write and confirmed
+// after it, so the two stores cannot drift if either step fails. It returns
+// once the write is durable; the worker indexes it in the background.
+func writeThroughOutbox(outbox *IndexOutbox, op string, event *nostr.Event, id nostr.ID, write func() error) error {
+	seq, err := outbox.Enqueue(op, event, id)
+	if err != nil {
+		return fmt.Errorf("failed to queue index operation: %w", err)
+	}
+	if err := write(); err != nil {
+		outbox.Discard(seq)
+		return err
+	}
+	if err := outbox.Commit(seq); err != nil {
+		return fmt.Errorf("failed to confirm index operation: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,688 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/nip86"
+)
+
+// newTestRelay starts a relay on the fake Typesense with its own BoltDB and
+// collection, using hash embeddings. Close is called when the test ends.
+func newTestRelay(t *testing.T, ts *fakeTypesense, collection string) *AMBRelay {
+	t.Helper()
+	return newTestRelayWith(t, testRelayConfig(t, ts, collection))
+}
+
+// testRelayConfig is the configuration newTestRelay starts a relay with.
+func testRelayConfig(t *testing.T, ts *fakeTypesense, collection string) Config {
+	cfg := DefaultConfig()
+	cfg.Name = "test relay " + collection
+	cfg.DBPath = filepath.Join(t.TempDir(), "relay.db")
+	cfg.TSHost = ts.URL
+	cfg.TSAPIKey = fakeTypesenseAPIKey
+	cfg.TSCollection = collection
+	cfg.EmbedProvider = EmbeddingProviderConfig{Provider: EmbedProviderHash}
+	return cfg
+}
+
+func newTestRelayWith(t *testing.T, cfg Config) *AMBRelay {
+	t.Helper()
+	r, err := NewAMBRelay(cfg)
+	if err != nil {
+		t.Fatalf("NewAMBRelay: %v", err)
+	}
+	t.Cleanup(r.Close)
+	return r
+}
+
+// drainOutbox waits until the relay indexed every write queued so far;
+// writes return before they are indexed.
+func drainOutbox(t *testing.T, r *AMBRelay) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := r.outbox.Drain(ctx); err != nil {
+		t.Fatalf("drain outbox: %v", err)
+	}
+}
+
+func TestNewAMBRelayServesInfo(t *testing.T) {
+	r := newTestRelay(t, newFakeTypesense(t), "amb")
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set("Accept", "application/nostr+json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var info struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatalf("decode relay information: %v", err)
+	}
+	if info.Name != "test relay amb" {
+		t.Errorf("name = %q, want %q", info.Name, "test relay amb")
+	}
+}
+
+func TestNewAMBRelayFailsWithoutTypesense(t *testing.T) {
+	ts := newFakeTypesense(t)
+	cfg := DefaultConfig()
+	cfg.DBPath = filepath.Join(t.TempDir(), "relay.db")
+	cfg.TSHost = ts.URL
+	cfg.TSAPIKey = "wrong-key"
+	cfg.TSCollection = "amb"
+	if r, err := NewAMBRelay(cfg); err == nil {
+		r.Close()
+		t.Fatal("NewAMBRelay succeeded with an invalid Typesense API key")
+	}
+}
+
+func TestRelayWritesReachIndex(t *testing.T) {
+	ts := newFakeTypesense(t)
+	r := newTestRelay(t, ts, "amb")
+	ctx := context.Background()
+	event := makeEvent(testPubKey("alice"), "physics-101", "Physics 101", 1000)
+
+	if reject, msg := r.OnEvent(ctx, event); reject {
+		t.Fatalf("OnEvent rejected a valid event: %s", msg)
+	}
+	if err := r.StoreEvent(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+	drainOutbox(t, r)
+	if _, ok := ts.collectionDocs("amb")[event.ID.Hex()]; !ok {
+		t.Fatal("stored event was not indexed")
+	}
+	stored := 0
+	for range r.boltDB.QueryEvents(nostr.Filter{IDs: []nostr.ID{event.ID}}, 1) {
+		stored++
+	}
+	if stored != 1 {
+		t.Fatal("stored event is not in BoltDB")
+	}
+
+	if err := r.DeleteEvent(ctx, event.ID); err != nil {
+		t.Fatal(err)
+	}
+	drainOutbox(t, r)
+	if _, ok := ts.collectionDocs("amb")[event.ID.Hex()]; ok {
+		t.Error("deleted event is still indexed")
+	}
+}
+
+func TestRelayWriteDoesNotWaitForIndex(t *testing.T) {
+	ts := newFakeTypesense(t)
+	var hold atomic.Bool
+	held := make(chan struct{})
+	ts.before = func(r *http.Request) {
+		if hold.Load() && strings.Contains(r.URL.Path, "/documents") {
+			<-held
+		}
+	}
+	r := newTestRelay(t, ts, "amb")
+	release := sync.OnceFunc(func() { close(held) })
+	t.Cleanup(release)
+
+	// Typesense takes longer than any write should
+	hold.Store(true)
+	event := makeEvent(testPubKey("alice"), "physics-101", "Physics 101", 1000)
+	start := time.Now()
+	if err := r.StoreEvent(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("StoreEvent took %s, want it to return before the event is indexed", elapsed)
+	}
+	if status := r.outbox.GetStatus(); status.Pending != 1 {
+		t.Errorf("pending = %d, want the index operation queued", status.Pending)
+	}
+
+	hold.Store(false)
+	release()
+	waitIndexed(t, ts, event.ID)
+}
+
+func TestRelayInstancesAreIndependent(t *testing.T) {
+	ts := newFakeTypesense(t)
+	a := newTestRelay(t, ts, "amb_a")
+	b := newTestRelay(t, ts, "amb_b")
+	ctx := context.Background()
+
+	mallory := testPubKey("mallory")
+	if err := a.ManagementAPI.BanPubKey(ctx, mallory, "spam"); err != nil {
+		t.Fatal(err)
+	}
+	event := makeEvent(mallory, "x", "X", 1000)
+	if reject, _ := a.OnEvent(ctx, event); !reject {
+		t.Error("relay a accepted an event of a pubkey banned on it")
+	}
+	if reject, msg := b.OnEvent(ctx, event); reject {
+		t.Errorf("relay b rejected an event of a pubkey banned on relay a: %s", msg)
+	}
+
+	if err := b.StoreEvent(ctx, makeEvent(testPubKey("alice"), "y", "Y", 1000)); err != nil {
+		t.Fatal(err)
+	}
+	drainOutbox(t, a)
+	drainOutbox(t, b)
+	if n := len(ts.collectionDocs("amb_a")); n != 0 {
+		t.Errorf("relay a's collection has %d documents, want 0", n)
+	}
+	if n := len(ts.collectionDocs("amb_b")); n != 1 {
+		t.Errorf("relay b's collection has %d documents, want 1", n)
+	}
+}
+
+func TestRelayManagementMethods(t *testing.T) {
+	r := newTestRelay(t, newFakeTypesense(t), "amb")
+	ctx := context.Background()
+	call := func(method string, params ...any) nip86.Response {
+		t.Helper()
+		resp, err := r.ManagementAPI.Generic(ctx, nip86.Request{Method: method, Params: params})
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		return resp
+	}
+
+	if resp := call("enablesemanticsearch"); resp.Error != "" {
+		t.Fatalf("enablesemanticsearch: %s", resp.Error)
+	}
+	cfg, ok := call("getsemanticsearchconfig").Result.(SemanticConfig)
+	if !ok || !cfg.Enabled {
+		t.Errorf("getsemanticsearchconfig = %+v, want semantic search enabled", cfg)
+	}
+	if r.attachedEmbedder() == nil {
+		t.Error("enabling semantic search did not attach the embedder")
+	}
+
+	if resp := call("updatesemanticsearchconfig", map[string]any{"enabled": true, "embed_fields": []string{"title"}}); resp.Error == "" {
+		t.Error("updatesemanticsearchconfig accepted an unknown field")
+	}
+	if resp := call("updatesemanticsearchconfig", map[string]any{"enabled": true, "embed_fields": []string{"name"}, "languages": []string{"de"}}); resp.Error == "" {
+		t.Error("updatesemanticsearchconfig accepted an unsupported key")
+	}
+	if resp := call("disablesemanticsearch"); resp.Error != "" {
+		t.Fatalf("disablesemanticsearch: %s", resp.Error)
+	}
+	if r.attachedEmbedder() != nil {
+		t.Error("disabling semantic search left the embedder attached")
+	}
+
+	if stats, ok := call("refreshstats").Result.(*CollectionStats); !ok || stats.ComputedAt == 0 {
+		t.Errorf("refreshstats = %+v, want computed collection stats", stats)
+	}
+
+	if resp := call("nosuchmethod"); resp.Error == "" {
+		t.Error("unknown method did not return an error")
+	}
+}
+
+func TestRelayShutdown(t *testing.T) {
+	ts := newFakeTypesense(t)
+	r := newTestRelay(t, ts, "amb")
+	ctx := context.Background()
+	event := makeEvent(testPubKey("alice"), "physics-101", "Physics 101", 1000)
+	if err := r.StoreEvent(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := r.Shutdown(shutdownCtx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if _, ok := ts.collectionDocs("amb")[event.ID.Hex()]; !ok {
+		t.Error("stored event was not indexed before the shutdown finished")
+	}
+	later := makeEvent(testPubKey("alice"), "chemistry-101", "Chemistry 101", 1001)
+	if err := r.StoreEvent(ctx, later); !errors.Is(err, errShuttingDown) {
+		t.Errorf("StoreEvent after Shutdown = %v, want %v", err, errShuttingDown)
+	}
+	if err := r.DeleteEvent(ctx, event.ID); !errors.Is(err, errShuttingDown) {
+		t.Errorf("DeleteEvent after Shutdown = %v, want %v", err, errShuttingDown)
+	}
+}
+
+func TestRelayShutdownKeepsUnindexedWrites(t *testing.T) {
+	ts := newFakeTypesense(t)
+	cfg := testRelayConfig(t, ts, "amb")
+	r := newTestRelayWith(t, cfg)
+	ctx := context.Background()
+
+	// The write reaches BoltDB but cannot be indexed before the deadline
+	ts.Close()
+	event := makeEvent(testPubKey("alice"), "physics-101", "Physics 101", 1000)
+	if err := r.StoreEvent(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+	shutdownCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	if err := r.Shutdown(shutdownCtx); !errors.Is(err, errOutboxFailing) && !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown = %v, want the failing write left queued", err)
+	}
+
+	// The queued operation is applied after the restart
+	ts = newFakeTypesense(t)
+	cfg.TSHost = ts.URL
+	newTestRelayWith(t, cfg)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, ok := ts.collectionDocs("amb")[event.ID.Hex()]; ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("write queued at shutdown was not indexed after the restart")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRelayMetrics(t *testing.T) {
+	ts := newFakeTypesense(t)
+	cfg := testRelayConfig(t, ts, "amb")
+	cfg.MetricsToken = "secret"
+	r := newTestRelayWith(t, cfg)
+	ctx := context.Background()
+
+	event := makeEvent(testPubKey("alice"), "physics-101", "Physics 101", 1000)
+	note := makeEvent(testPubKey("alice"), "note", "Note", 1000)
+	note.Kind = 1
+	r.OnEvent(ctx, event)
+	r.OnEvent(ctx, note)
+	if err := r.StoreEvent(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Count(ctx, nostr.Filter{Kinds: []nostr.Kind{30142}}); err != nil {
+		t.Fatal(err)
+	}
+	for range r.QueryStored(ctx, nostr.Filter{Kinds: []nostr.Kind{30142}}) {
+	}
+	for range r.QueryStored(ctx, nostr.Filter{Search: "similar:30142:unknown:x"}) {
+	}
+
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	get := func(token string) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/metrics", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	if resp, _ := get("wrong"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status with a wrong token = %d, want 401", resp.StatusCode)
+	}
+	resp, body := get("secret")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	lines := strings.Split(body, "\n")
+	for _, line := range []string{
+		"amb_events_accepted_total 1",
+		`amb_events_rejected_total{reason="unsupported_kind"} 1`,
+		`amb_typesense_request_duration_seconds_count{op="save"} 1`,
+		`amb_typesense_request_duration_seconds_count{op="count"} 1`,
+		`amb_typesense_request_duration_seconds_count{op="search"} 1`,
+		`amb_query_duration_seconds_count{type="count"} 1`,
+		`amb_query_duration_seconds_count{type="req"} 2`,
+		`amb_query_errors_total{type="req"} 1`,
+		"amb_index_outbox_pending 0",
+		"amb_index_outbox_applied_total 1",
+		"amb_reindex_running 0",
+		"amb_embedding_breaker_open 0",
+	} {
+		if !slices.Contains(lines, line) {
+			t.Errorf("metrics lack %q", line)
+		}
+	}
+	if !strings.Contains(body, "\namb_bolt_size_bytes ") {
+		t.Error("metrics lack amb_bolt_size_bytes")
+	}
+}
+
+func TestRelayBanEventThroughOutbox(t *testing.T) {
+	ts := newFakeTypesense(t)
+	r := newTestRelay(t, ts, "amb")
+	ctx := context.Background()
+	event := makeEvent(testPubKey("alice"), "physics-101", "Physics 101", 1000)
+	if err := r.StoreEvent(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.ManagementAPI.BanEvent(ctx, event.ID, "spam"); err != nil {
+		t.Fatalf("BanEvent: %v", err)
+	}
+	drainOutbox(t, r)
+	if _, ok := ts.collectionDocs("amb")[event.ID.Hex()]; ok {
+		t.Error("banned event is still indexed")
+	}
+	for range r.boltDB.QueryEvents(nostr.Filter{IDs: []nostr.ID{event.ID}}, 1) {
+		t.Error("banned event is still in BoltDB")
+	}
+
+	if err := r.ManagementAPI.AllowEvent(ctx, event.ID, ""); err != nil {
+		t.Fatalf("AllowEvent: %v", err)
+	}
+	drainOutbox(t, r)
+	if _, ok := ts.collectionDocs("amb")[event.ID.Hex()]; !ok {
+		t.Error("allowed event was not re-indexed")
+	}
+}
+
+func TestRelayCountLeavesOutPurgedPubKeys(t *testing.T) {
+	ts := newFakeTypesense(t)
+	r := newTestRelay(t, ts, "amb")
+	ctx := context.Background()
+	alice, bob := testPubKey("alice"), testPubKey("bob")
+	for _, event := range []nostr.Event{
+		makeEvent(alice, "physics-101", "Physics 101", 1000),
+		makeEvent(alice, "chemistry-101", "Chemistry 101", 1000),
+		makeEvent(bob, "biology-101", "Biology 101", 1000),
+	} {
+		if err := r.StoreEvent(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	drainOutbox(t, r)
+
+	// Alice's events are being hidden, but the purge has not reached them yet
+	if err := r.mgmt.BanPubKey(alice, "spam"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.mgmt.SetPubKeyPurge(alice, PurgeHide); err != nil {
+		t.Fatal(err)
+	}
+	for _, filter := range []nostr.Filter{
+		{Kinds: []nostr.Kind{30142}},
+		{Authors: []nostr.PubKey{alice}},
+		{Authors: []nostr.PubKey{alice, bob}},
+	} {
+		sent := 0
+		for range r.queryStored(ctx, filter) {
+			sent++
+		}
+		count, err := r.count(ctx, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int(count) != sent {
+			t.Errorf("count(%v) = %d, but REQ returns %d events", filter, count, sent)
+		}
+	}
+	if count, _ := r.count(ctx, nostr.Filter{Kinds: []nostr.Kind{30142}}); count != 1 {
+		t.Errorf("count = %d, want only bob's event", count)
+	}
+}
+
+func TestRelayRepairIndexThroughOutbox(t *testing.T) {
+	ts := newFakeTypesense(t)
+	r := newTestRelay(t, ts, "amb")
+	alice := testPubKey("alice")
+	missing := makeEvent(alice, "physics-101", "Physics 101", 1000)
+	orphan := makeEvent(alice, "deleted", "Deleted", 1000)
+	pending := makeEvent(alice, "chemistry-101", "Chemistry 101", 1000)
+	saveEvents(t, r.boltDB, missing, pending)
+	if err := r.tsDB.SaveEvent(orphan); err != nil {
+		t.Fatal(err)
+	}
+	// A write that is between its outbox entry and the BoltDB commit
+	seq, err := r.outbox.Enqueue(outboxOpSave, &pending, pending.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.outbox.Discard(seq)
+
+	if err := r.verifier.Start(true); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for r.verifier.GetStatus().Running && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	status := r.verifier.GetStatus()
+	if status.Missing != 2 || status.Orphaned != 1 || status.Repaired != 2 || status.Skipped != 1 {
+		t.Errorf("status = %+v, want 2 missing, 1 orphaned, 2 repaired and the pending address skipped", status)
+	}
+
+	waitIndexed(t, ts, missing.ID)
+	for time.Now().Before(deadline) {
+		if _, ok := ts.collectionDocs("amb")[orphan.ID.Hex()]; !ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	docs := ts.collectionDocs("amb")
+	if _, ok := docs[orphan.ID.Hex()]; ok {
+		t.Error("orphaned document was not deleted")
+	}
+	if _, ok := docs[pending.ID.Hex()]; ok {
+		t.Error("repair indexed an event with a queued outbox operation")
+	}
+}
+
+func TestRelayModelChangeDetachesEmbedder(t *testing.T) {
+	r := newTestRelay(t, newFakeTypesense(t), "amb")
+	cfg := DefaultSemanticConfig()
+	cfg.Enabled = true
+	cfg.Model = "edufeed:older-model"
+	if err := r.mgmt.SaveSemanticConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if status := r.modelCheck.Run(); !status.ReembedRequired {
+		t.Fatalf("model status = %+v, want a re-embed required", status)
+	}
+	r.applySemanticConfig(cfg)
+	if r.attachedEmbedder() != nil {
+		t.Error("embedder attached while the collection holds vectors of another model")
+	}
+
+	// A reindex re-embedded everything with the current model
+	if err := r.modelCheck.MarkIndexed(); err != nil {
+		t.Fatal(err)
+	}
+	r.applySemanticConfig(cfg)
+	if r.attachedEmbedder() == nil {
+		t.Error("embedder not attached after re-embedding")
+	}
+}
+
+func TestRelayReembedsAfterBreakerCloses(t *testing.T) {
+	var down atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		var req struct {
+			Texts []string `json:"texts"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		writeJSON(w, http.StatusOK, map[string]any{"embeddings": hashEmbed(req.Texts, DefaultHashDimensions)})
+	}))
+	defer srv.Close()
+	ts := newFakeTypesense(t)
+	cfg := testRelayConfig(t, ts, "amb")
+	cfg.EmbedProvider = EmbeddingProviderConfig{Provider: EmbedProviderEdufeed, Endpoint: srv.URL}
+	cfg.EmbedMaxRetries = 0
+	cfg.EmbedBreakerThreshold = 1
+	cfg.EmbedBreakerCooldown = 50 * time.Millisecond
+	cfg.EmbedCacheMaxEntries = 0
+	cfg.SemanticSearchEnabled = true
+	r := newTestRelayWith(t, cfg)
+	if r.attachedEmbedder() == nil {
+		t.Fatal("embedder not attached")
+	}
+
+	// The first failure opens the breaker and the event is indexed keyword-only
+	down.Store(true)
+	r.embedBreaker.Embed(context.Background(), []string{"probe"})
+	event := makeEvent(testPubKey("alice"), "physics-101", "Physics 101", 1000)
+	if err := r.StoreEvent(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	drainOutbox(t, r)
+	if _, ok := ts.collectionDocs("amb")[event.ID.Hex()]["embedding"]; ok {
+		t.Fatal("event embedded while the breaker was open")
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if ids, _ := r.mgmt.ListUnembedded(); len(ids) == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ids, _ := r.mgmt.ListUnembedded(); len(ids) != 1 || ids[0] != event.ID {
+		t.Fatalf("unembedded events = %v, want %s", ids, event.ID.Hex())
+	}
+
+	// The next probe succeeds, the breaker closes and the event is re-embedded
+	down.Store(false)
+	time.Sleep(cfg.EmbedBreakerCooldown)
+	r.embedBreaker.Embed(context.Background(), []string{"probe"})
+	for time.Now().Before(deadline) {
+		if _, ok := ts.collectionDocs("amb")[event.ID.Hex()]["embedding"]; ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := ts.collectionDocs("amb")[event.ID.Hex()]["embedding"]; !ok {
+		t.Error("event was not re-embedded after the breaker closed")
+	}
+	if ids, _ := r.mgmt.ListUnembedded(); len(ids) != 0 {
+		t.Errorf("unembedded events = %v, want none", ids)
+	}
+}
+
+func TestRelayDefaultSearchUsesQueryCache(t *testing.T) {
+	ts := newFakeTypesense(t)
+	cfg := testRelayConfig(t, ts, "amb")
+	cfg.SemanticSearchEnabled = true
+	cfg.SearchResultCacheTTL = 0
+	r := newTestRelayWith(t, cfg)
+	ctx := context.Background()
+	event := makeEvent(testPubKey("alice"), "physics-101", "Physics 101", 1000)
+	if err := r.StoreEvent(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		ids := []nostr.ID{}
+		for found := range r.queryStored(ctx, nostr.Filter{Search: "physics"}) {
+			ids = append(ids, found.ID)
+		}
+		if len(ids) != 1 || ids[0] != event.ID {
+			t.Fatalf("search found %v, want %s", ids, event.ID.Hex())
+		}
+	}
+	if stats := r.queryCache.GetStats(); stats.Misses != 1 || stats.Hits != 1 {
+		t.Errorf("query cache stats = %+v, want the second search to reuse the vector", stats)
+	}
+}
+
+func TestRelayBanPubKeyKeepsModeWhenPurgeFails(t *testing.T) {
+	cfg := testRelayConfig(t, newFakeTypesense(t), "amb")
+	cfg.BanPubKeyPurge = PurgeHide
+	r := newTestRelayWith(t, cfg)
+	alice := testPubKey("alice")
+	// Another purge is running
+	r.purger.running.Store(true)
+	defer r.purger.running.Store(false)
+
+	if err := r.ManagementAPI.BanPubKey(context.Background(), alice, "spam"); err == nil {
+		t.Fatal("BanPubKey succeeded while another purge was running")
+	}
+	if mode := r.mgmt.PubKeyPurgeMode(alice); mode != "" {
+		t.Errorf("purge mode = %q after the purge failed to start, want none", mode)
+	}
+	if err := r.mgmt.SetPubKeyPurge(alice, PurgeHide); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := r.handleManagementMethod(context.Background(), nip86.Request{Method: "purgepubkey", Params: []any{alice.Hex(), PurgeDelete}})
+	if err != nil || resp.Error == "" {
+		t.Fatalf("purgepubkey = %+v, %v, want an error", resp, err)
+	}
+	if mode := r.mgmt.PubKeyPurgeMode(alice); mode != PurgeHide {
+		t.Errorf("purge mode = %q after the purge failed to start, want %q", mode, PurgeHide)
+	}
+}
+
+func TestRelayBreakerTripsDuringIndexing(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "down", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	ts := newFakeTypesense(t)
+	cfg := testRelayConfig(t, ts, "amb")
+	cfg.EmbedProvider = EmbeddingProviderConfig{Provider: EmbedProviderEdufeed, Endpoint: srv.URL}
+	cfg.EmbedMaxRetries = 0
+	cfg.EmbedBreakerThreshold = 1
+	cfg.EmbedBreakerCooldown = 20 * time.Millisecond
+	cfg.EmbedCacheMaxEntries = 0
+	cfg.SemanticSearchEnabled = true
+	r := newTestRelayWith(t, cfg)
+	if r.attachedEmbedder() == nil {
+		t.Fatal("embedder not attached")
+	}
+
+	// The embedding of the first event trips the breaker inside the outbox apply
+	ctx := context.Background()
+	first := makeEvent(testPubKey("alice"), "physics-101", "Physics 101", 1000)
+	if err := r.StoreEvent(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	drainOutbox(t, r)
+	if !r.embedBreaker.IsOpen() {
+		t.Fatal("breaker did not open")
+	}
+	second := makeEvent(testPubKey("alice"), "chemistry-101", "Chemistry 101", 1000)
+	if err := r.StoreEvent(ctx, second); err != nil {
+		t.Fatal(err)
+	}
+	waitIndexed(t, ts, first.ID)
+	waitIndexed(t, ts, second.ID)
+	deadline := time.Now().Add(3 * time.Second)
+	for r.attachedEmbedder() != nil && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if r.attachedEmbedder() != nil {
+		t.Error("embedder still attached with the breaker open")
+	}
+
+	// A closed relay stops probing the service
+	r.Close()
+	time.Sleep(2 * cfg.EmbedBreakerCooldown)
+	before := requests.Load()
+	time.Sleep(5 * cfg.EmbedBreakerCooldown)
+	if n := requests.Load() - before; n != 0 {
+		t.Errorf("breaker probed %d times after Close", n)
+	}
+}
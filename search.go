@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore/boltdb"
+	"fiatjaf.com/nostr/eventstore/typesense30142"
+)
+
+// NIP-50 search modes selected with a mode:<mode> token.
+const (
+	SearchModeKeyword  = "keyword"
+	SearchModeSemantic = "semantic"
+	SearchModeHybrid   = "hybrid"
+)
+
+const (
+	// searchOverfetch is how many more hits than requested are fetched from
+	// Typesense, since conditions it cannot apply are checked afterwards.
+	searchOverfetch = 4
+	// searchMaxHits is the largest page Typesense returns.
+	searchMaxHits = 250
+	// searchFieldsTTL is how long the collection fields are cached.
+	searchFieldsTTL = time.Minute
+)
+
+var errSemanticSearchOff = errors.New("semantic search is not enabled")
+
+// errFilterNotTranslatable is returned by Search for filters with conditions
+// that cannot be sent to Typesense, so the caller can use a search that
+// applies them instead of missing matches.
+var errFilterNotTranslatable = errors.New("filter cannot be applied by the vector search")
+
+// SearchOptions are the NIP-50 extension tokens taken from a search string.
+type SearchOptions struct {
+	Mode  string
+	Alpha *float64 // weight of the vector rank in hybrid search, 0 to 1
+	// Similar is an event ID or a 30142:<pubkey>:<d> address whose stored
+	// vector is used instead of embedding the query.
+	Similar string
+}
+
+// parseSearchExtensions removes the mode:, alpha: and similar: tokens from search and
+// returns the remaining query. Invalid values are dropped and have no effect,
+// as NIP-50 asks relays to ignore extensions they do not support. Other
+// key:value tokens, such as field searches, are left in place.
+func parseSearchExtensions(search string) (string, SearchOptions) {
+	var opts SearchOptions
+	var rest []string
+	for _, token := range strings.Fields(search) {
+		key, value, ok := strings.Cut(token, ":")
+		switch {
+		case ok && key == "mode":
+			if value == SearchModeKeyword || value == SearchModeSemantic || value == SearchModeHybrid {
+				opts.Mode = value
+			}
+		case ok && key == "alpha":
+			if alpha, err := strconv.ParseFloat(value, 64); err == nil && alpha >= 0 && alpha <= 1 {
+				opts.Alpha = &alpha
+			}
+		case ok && key == "similar":
+			opts.Similar = value
+		default:
+			rest = append(rest, token)
+		}
+	}
+	return strings.Join(rest, " "), opts
+}
+
+// SemanticSearcher runs the searches TSBackend cannot express, such as pure
+// vector search or hybrid search with a custom alpha, directly against
+// Typesense. Hits are loaded from BoltDB by ID and checked against the
+// filter, so Typesense documents must use the event ID as document ID.
+type SemanticSearcher struct {
+	admin      *TypesenseAdmin
+	collection string
+	boltDB     *boltdb.BoltBackend
+	// embedder returns the embedder for query texts, or nil if semantic search is off.
+	embedder func() typesense30142.Embedder
+	// queries caches query vectors, nil to embed every query.
+	queries *QueryVectorCache
+	// Metrics, if set, records the latency and errors of vector searches.
+	Metrics *Metrics
+
+	mu        sync.Mutex
+	fields    []CollectionField
+	fieldsAge time.Time
+}
+
+func NewSemanticSearcher(tsDB *typesense30142.TSBackend, boltDB *boltdb.BoltBackend, embedder func() typesense30142.Embedder, queries *QueryVectorCache) *SemanticSearcher {
+	return &SemanticSearcher{
+		admin:      NewTypesenseAdmin(tsDB),
+		collection: tsDB.CollectionName,
+		boltDB:     boltDB,
+		embedder:   embedder,
+		queries:    queries,
+	}
+}
+
+// Search embeds query and returns up to limit events matching filter, ranked
+// by vector similarity (mode semantic) or by hybrid rank with the given alpha.
+func (s *SemanticSearcher) Search(ctx context.Context, filter nostr.Filter, query string, opts SearchOptions, limit int) (iter.Seq[nostr.Event], error) {
+	embedder := s.embedder()
+	if embedder == nil {
+		return nil, errSemanticSearchOff
+	}
+	if strings.TrimSpace(query) == "" {
+		return nil, fmt.Errorf("empty search query")
+	}
+	vector, err := s.embedQuery(ctx, embedder, query)
+	if err != nil {
+		return nil, fmt.Errorf("embed query: %w", err)
+	}
+
+	return s.vectorSearch(filter, query, formatVector(vector), "", opts, limit, nil, true)
+}
+
+func (s *SemanticSearcher) embedQuery(ctx context.Context, embedder typesense30142.Embedder, query string) ([]float32, error) {
+	if s.queries != nil {
+		return s.queries.Vector(ctx, embedder, query)
+	}
+	vectors, err := embedder.Embed(ctx, []string{query})
+	if err != nil {
+		return nil, err
+	}
+	if len(vectors) != 1 {
+		return nil, fmt.Errorf("embedding service returned %d vectors", len(vectors))
+	}
+	return vectors[0], nil
+}
+
+// Similar returns up to limit events matching filter that are nearest to the
+// stored vector of the event ref points to, excluding that event. Any query
+// text left in the search string makes it a hybrid search.
+func (s *SemanticSearcher) Similar(filter nostr.Filter, ref, query string, opts SearchOptions, limit int) (iter.Seq[nostr.Event], error) {
+	source, err := s.resolveRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(query) == "" {
+		opts.Mode = SearchModeSemantic
+	}
+	exclude := map[nostr.ID]bool{source: true}
+	return s.vectorSearch(filter, query, "", "id: "+source.Hex()+", ", opts, limit, exclude, false)
+}
+
+// resolveRef returns the ID of the stored event an event ID or a
+// 30142:<pubkey>:<d> address refers to.
+func (s *SemanticSearcher) resolveRef(ref string) (nostr.ID, error) {
+	if !strings.Contains(ref, ":") {
+		id, err := nostr.IDFromHex(ref)
+		if err != nil {
+			return nostr.ID{}, fmt.Errorf("invalid event id %q", ref)
+		}
+		return id, nil
+	}
+
+	parts := strings.SplitN(ref, ":", 3)
+	if len(parts) != 3 || parts[0] != "30142" {
+		return nostr.ID{}, fmt.Errorf("invalid address %q, expected 30142:<pubkey>:<d>", ref)
+	}
+	pubkey, err := nostr.PubKeyFromHex(parts[1])
+	if err != nil {
+		return nostr.ID{}, fmt.Errorf("invalid pubkey in address %q", ref)
+	}
+	filter := nostr.Filter{
+		Kinds:   []nostr.Kind{30142},
+		Authors: []nostr.PubKey{pubkey},
+		Tags:    nostr.TagMap{"d": {parts[2]}},
+	}
+	for event := range s.boltDB.QueryEvents(filter, 1) {
+		return event.ID, nil
+	}
+	return nostr.ID{}, fmt.Errorf("no event found for address %q", ref)
+}
+
+// vectorSearch queries Typesense with the given query vector, or with the
+// stored vector of a document when vector is empty and params names it. The
+// filter is sent as filter_by as far as the collection allows and checked
+// against the hits afterwards; with exact set, a filter that cannot be sent
+// in full fails with errFilterNotTranslatable.
+func (s *SemanticSearcher) vectorSearch(filter nostr.Filter, query, vector, params string, opts SearchOptions, limit int, exclude map[nostr.ID]bool, exact bool) (iter.Seq[nostr.Event], error) {
+	vectorField, queryBy, fields, err := s.searchFields()
+	if err != nil {
+		return nil, err
+	}
+	filterBy, complete := searchFilterBy(filter, fields)
+	if exact && !complete {
+		return nil, errFilterNotTranslatable
+	}
+	// The excluded events, such as the source of a similar: search, are
+	// usually among the nearest hits
+	k := min((limit+len(exclude))*searchOverfetch, searchMaxHits)
+	params += fmt.Sprintf("k: %d", k)
+	search := map[string]any{
+		"collection":     s.collection,
+		"q":              "*",
+		"per_page":       k,
+		"include_fields": "id",
+	}
+	if filterBy != "" {
+		search["filter_by"] = filterBy
+	}
+	if opts.Mode != SearchModeSemantic {
+		if len(queryBy) == 0 {
+			return nil, fmt.Errorf("collection %s has no searchable string fields", s.collection)
+		}
+		search["q"] = query
+		search["query_by"] = strings.Join(queryBy, ",")
+		if opts.Alpha != nil {
+			params += fmt.Sprintf(", alpha: %g", *opts.Alpha)
+		}
+	}
+	search["vector_query"] = fmt.Sprintf("%s:([%s], %s)", vectorField, vector, params)
+
+	start := time.Now()
+	ids, err := s.admin.SearchIDs(search)
+	s.Metrics.ObserveTypesense("vector_search", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return s.loadHits(ids, filter, exclude, limit), nil
+}
+
+// loadHits loads the events of ids from BoltDB in rank order and yields those
+// matching filter, skipping exclude, up to limit.
+func (s *SemanticSearcher) loadHits(ids []string, filter nostr.Filter, exclude map[nostr.ID]bool, limit int) iter.Seq[nostr.Event] {
+	var eventIDs []nostr.ID
+	for _, hex := range ids {
+		if id, err := nostr.IDFromHex(hex); err == nil && !exclude[id] {
+			eventIDs = append(eventIDs, id)
+		}
+	}
+
+	return func(yield func(nostr.Event) bool) {
+		if len(eventIDs) == 0 {
+			return
+		}
+		byID := make(map[nostr.ID]nostr.Event, len(eventIDs))
+		for event := range s.boltDB.QueryEvents(nostr.Filter{IDs: eventIDs}, len(eventIDs)) {
+			byID[event.ID] = event
+		}
+
+		filter.Search = ""
+		n := 0
+		for _, id := range eventIDs {
+			event, ok := byID[id]
+			if !ok || !filter.Matches(event) {
+				continue
+			}
+			if !yield(event) {
+				return
+			}
+			if n++; n >= limit {
+				return
+			}
+		}
+	}
+}
+
+// searchFilterBy translates the conditions of filter into a filter_by
+// expression over the fields of the collection. complete is false if some
+// conditions, such as tags, have no field to filter on.
+func searchFilterBy(filter nostr.Filter, fields map[string]bool) (filterBy string, complete bool) {
+	complete = len(filter.Tags) == 0
+	var clauses []string
+	add := func(field, clause string) {
+		if fields[field] {
+			clauses = append(clauses, clause)
+		} else {
+			complete = false
+		}
+	}
+	if len(filter.IDs) > 0 {
+		ids := make([]string, len(filter.IDs))
+		for i, id := range filter.IDs {
+			ids[i] = id.Hex()
+		}
+		add("id", "id:=["+strings.Join(ids, ",")+"]")
+	}
+	if len(filter.Authors) > 0 {
+		authors := make([]string, len(filter.Authors))
+		for i, pubkey := range filter.Authors {
+			authors[i] = pubkey.Hex()
+		}
+		add("pubkey", "pubkey:=["+strings.Join(authors, ",")+"]")
+	}
+	if len(filter.Kinds) > 0 {
+		kinds := make([]string, len(filter.Kinds))
+		for i, kind := range filter.Kinds {
+			kinds[i] = strconv.Itoa(int(kind))
+		}
+		add("kind", "kind:=["+strings.Join(kinds, ",")+"]")
+	}
+	if filter.Since != 0 {
+		add("created_at", fmt.Sprintf("created_at:>=%d", filter.Since))
+	}
+	if filter.Until != 0 {
+		add("created_at", fmt.Sprintf("created_at:<=%d", filter.Until))
+	}
+	return strings.Join(clauses, " && "), complete
+}
+
+// searchFields returns the vector field, the indexed string fields and the
+// names of all fields of the collection, cached for searchFieldsTTL.
+func (s *SemanticSearcher) searchFields() (string, []string, map[string]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fields == nil || time.Since(s.fieldsAge) > searchFieldsTTL {
+		fields, err := s.admin.CollectionFields(s.collection)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("read collection fields: %w", err)
+		}
+		s.fields = fields
+		s.fieldsAge = time.Now()
+	}
+
+	var vectorField string
+	var queryBy []string
+	// Every document has an id, whether or not the schema declares it
+	names := map[string]bool{"id": true}
+	for _, field := range s.fields {
+		names[field.Name] = true
+		switch {
+		case field.NumDim > 0 && vectorField == "":
+			vectorField = field.Name
+		case (field.Type == "string" || field.Type == "string[]") && field.Name != "id" &&
+			(field.Index == nil || *field.Index) && !strings.Contains(field.Name, "*"):
+			queryBy = append(queryBy, field.Name)
+		}
+	}
+	if vectorField == "" {
+		return "", nil, nil, fmt.Errorf("collection %s has no vector field", s.collection)
+	}
+	return vectorField, queryBy, names, nil
+}
+
+func formatVector(vector []float32) string {
+	parts := make([]string, len(vector))
+	for i, f := range vector {
+		parts[i] = strconv.FormatFloat(float64(f), 'g', -1, 32)
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"slices"
+	"testing"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore/boltdb"
+	"fiatjaf.com/nostr/eventstore/typesense30142"
+)
+
+func TestParseSearchExtensions(t *testing.T) {
+	tests := []struct {
+		search  string
+		query   string
+		mode    string
+		alpha   float64 // -1 for unset
+		similar string
+	}{
+		{"photosynthesis", "photosynthesis", "", -1, ""},
+		{"mode:semantic plants and light", "plants and light", SearchModeSemantic, -1, ""},
+		{"plants alpha:0.3 mode:hybrid", "plants", SearchModeHybrid, 0.3, ""},
+		{"plants mode:fuzzy alpha:2", "plants", "", -1, ""},
+		{"similar:30142:abc:d1", "", "", -1, "30142:abc:d1"},
+		{"name:plants  language:de", "name:plants language:de", "", -1, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.search, func(t *testing.T) {
+			query, opts := parseSearchExtensions(tt.search)
+			if query != tt.query || opts.Mode != tt.mode || opts.Similar != tt.similar {
+				t.Errorf("parseSearchExtensions = (%q, %+v)", query, opts)
+			}
+			switch {
+			case tt.alpha < 0 && opts.Alpha != nil:
+				t.Errorf("alpha = %g, want unset", *opts.Alpha)
+			case tt.alpha >= 0 && (opts.Alpha == nil || *opts.Alpha != tt.alpha):
+				t.Errorf("alpha = %v, want %g", opts.Alpha, tt.alpha)
+			}
+		})
+	}
+}
+
+// semanticFixture is a collection on the fake Typesense whose documents carry
+// hash embeddings of their names, backed by the same events in BoltDB.
+type semanticFixture struct {
+	ts       *fakeTypesense
+	db       *boltdb.BoltBackend
+	searcher *SemanticSearcher
+	events   map[string]nostr.Event // by d tag
+	alice    nostr.PubKey
+	bob      nostr.PubKey
+}
+
+func newSemanticFixture(t *testing.T) *semanticFixture {
+	t.Helper()
+	ts := newFakeTypesense(t)
+	db := newTestBolt(t)
+	ts.addCollection("amb",
+		map[string]any{"name": "name", "type": "string"},
+		map[string]any{"name": "description", "type": "string", "optional": true},
+		map[string]any{"name": "pubkey", "type": "string"},
+		map[string]any{"name": "kind", "type": "int32"},
+		map[string]any{"name": "created_at", "type": "int64"},
+		map[string]any{"name": "embedding", "type": "float[]", "num_dim": DefaultHashDimensions},
+	)
+
+	f := &semanticFixture{ts: ts, db: db, events: map[string]nostr.Event{}, alice: testPubKey("alice"), bob: testPubKey("bob")}
+	resources := []struct {
+		author nostr.PubKey
+		d      string
+		name   string
+	}{
+		{f.alice, "quantum-physics", "Introduction to quantum physics"},
+		{f.alice, "quantum-computing", "Quantum computing with qubits"},
+		{f.bob, "quantum-chemistry", "Quantum chemistry of molecules"},
+		{f.alice, "medieval", "Castles and knights of the middle ages"},
+	}
+	for i, r := range resources {
+		f.add(t, makeEvent(r.author, r.d, r.name, nostr.Timestamp(1000+i)))
+	}
+
+	embedder := NewEmbeddingClient(EmbeddingProviderConfig{Provider: EmbedProviderHash})
+	tsDB := &typesense30142.TSBackend{ApiKey: fakeTypesenseAPIKey, Host: ts.URL, CollectionName: "amb"}
+	f.searcher = NewSemanticSearcher(tsDB, db, func() typesense30142.Embedder { return embedder }, nil)
+	return f
+}
+
+// add stores event in BoltDB and indexes it with the hash embedding of its name.
+func (f *semanticFixture) add(t *testing.T, event nostr.Event) {
+	t.Helper()
+	saveEvents(t, f.db, event)
+	f.events[event.Tags.GetD()] = event
+	name := event.Tags.Find("name")[1]
+	f.ts.addDocument("amb", map[string]any{
+		"id":         event.ID.Hex(),
+		"name":       name,
+		"pubkey":     event.PubKey.Hex(),
+		"kind":       float64(event.Kind),
+		"created_at": float64(event.CreatedAt),
+		"embedding":  toAnySlice(hashEmbed([]string{name}, DefaultHashDimensions)[0]),
+	})
+}
+
+func toAnySlice(v []float32) []any {
+	out := make([]any, len(v))
+	for i, x := range v {
+		out[i] = float64(x)
+	}
+	return out
+}
+
+// dTags returns the d tags of the events in results.
+func dTags(results iter.Seq[nostr.Event]) []string {
+	var tags []string
+	for event := range results {
+		tags = append(tags, event.Tags.GetD())
+	}
+	return tags
+}
+
+func TestSemanticSearch(t *testing.T) {
+	f := newSemanticFixture(t)
+	filter := nostr.Filter{Kinds: []nostr.Kind{30142}}
+
+	results, err := f.searcher.Search(context.Background(), filter, "introduction to quantum physics", SearchOptions{Mode: SearchModeSemantic}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := dTags(results)
+	if len(got) != 2 || got[0] != "quantum-physics" {
+		t.Errorf("semantic search returned %v, want quantum-physics first of 2", got)
+	}
+
+	// The filter applies to the hits
+	filter.Authors = []nostr.PubKey{f.bob}
+	results, err = f.searcher.Search(context.Background(), filter, "quantum", SearchOptions{Mode: SearchModeSemantic}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dTags(results); !slices.Equal(got, []string{"quantum-chemistry"}) {
+		t.Errorf("search by bob returned %v, want [quantum-chemistry]", got)
+	}
+
+	// Typesense applies the filter, so better hits of other authors do not
+	// crowd out the matching one
+	for i := range 10 {
+		f.add(t, makeEvent(f.alice, fmt.Sprint("physics-", i), "Introduction to quantum physics", nostr.Timestamp(2000+i)))
+	}
+	results, err = f.searcher.Search(context.Background(), filter, "introduction to quantum physics", SearchOptions{Mode: SearchModeSemantic}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dTags(results); !slices.Equal(got, []string{"quantum-chemistry"}) {
+		t.Errorf("search by bob among better hits returned %v, want [quantum-chemistry]", got)
+	}
+
+	// Tag conditions have no field to filter on
+	filter.Tags = nostr.TagMap{"t": {"physics"}}
+	if _, err := f.searcher.Search(context.Background(), filter, "quantum", SearchOptions{}, 10); !errors.Is(err, errFilterNotTranslatable) {
+		t.Errorf("Search with a tag filter = %v, want %v", err, errFilterNotTranslatable)
+	}
+}
+
+func TestSemanticSearchHybrid(t *testing.T) {
+	f := newSemanticFixture(t)
+	alpha := 0.5
+	results, err := f.searcher.Search(context.Background(), nostr.Filter{}, "knights", SearchOptions{Mode: SearchModeHybrid, Alpha: &alpha}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dTags(results); len(got) == 0 || got[0] != "medieval" {
+		t.Errorf("hybrid search returned %v, want medieval first", got)
+	}
+}
+
+func TestSemanticSearchOff(t *testing.T) {
+	f := newSemanticFixture(t)
+	f.searcher.embedder = func() typesense30142.Embedder { return nil }
+	if _, err := f.searcher.Search(context.Background(), nostr.Filter{}, "quantum", SearchOptions{}, 10); err != errSemanticSearchOff {
+		t.Errorf("Search error = %v, want %v", err, errSemanticSearchOff)
+	}
+}
+
+func TestSimilar(t *testing.T) {
+	f := newSemanticFixture(t)
+	source := f.events["quantum-physics"]
+
+	for _, ref := range []string{source.ID.Hex(), "30142:" + f.alice.Hex() + ":quantum-physics"} {
+		results, err := f.searcher.Similar(nostr.Filter{}, ref, "", SearchOptions{}, 2)
+		if err != nil {
+			t.Fatalf("Similar(%s): %v", ref, err)
+		}
+		got := dTags(results)
+		if len(got) != 2 || slices.Contains(got, "quantum-physics") {
+			t.Errorf("Similar(%s) = %v, want 2 events without the source", ref, got)
+		}
+		if !slices.Contains(got, "quantum-computing") && !slices.Contains(got, "quantum-chemistry") {
+			t.Errorf("Similar(%s) = %v, want a related quantum resource", ref, got)
+		}
+	}
+
+	for _, ref := range []string{"not-hex", "30142:" + f.bob.Hex() + ":quantum-physics", "1:" + f.alice.Hex() + ":x"} {
+		if _, err := f.searcher.Similar(nostr.Filter{}, ref, "", SearchOptions{}, 2); err == nil {
+			t.Errorf("Similar(%s) succeeded, want an error", ref)
+		}
+	}
+}
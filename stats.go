@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore/boltdb"
+	"fiatjaf.com/nostr/eventstore/typesense30142"
+)
+
+const (
+	DefaultStatsCacheTTL = 5 * time.Minute
+	// statsTopValues is how many values each breakdown lists.
+	statsTopValues = 20
+	// statsDays and statsWeeks are the periods counted per day and per week.
+	// Together they stay below the 50 searches Typesense allows per multi_search.
+	statsDays  = 30
+	statsWeeks = 12
+)
+
+// statsFacets are the breakdowns of CollectionStats and the Typesense fields
+// they facet on. A field must be declared with facet: true in the collection
+// schema; otherwise its breakdown is skipped and reported as an error.
+var statsFacets = []struct {
+	name  string
+	field string
+}{
+	{"publishers", "pubkey"},
+	{"about", "about.id"},
+	{"learning_resource_types", "learningResourceType.id"},
+	{"languages", "inLanguage"},
+	{"licenses", "license.id"},
+}
+
+// FacetCount is a value of a faceted field and the number of events with it.
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+// PeriodCount counts the events and deletions created in the day or week
+// starting at Start (UTC).
+type PeriodCount struct {
+	Start     string `json:"start"`
+	Events    int64  `json:"events"`
+	Deletions int64  `json:"deletions"`
+}
+
+// CollectionStats breaks down the indexed events for the stats method.
+type CollectionStats struct {
+	ComputedAt int64 `json:"computed_at"`
+	// TypesenseTotal and BoltDBTotal count the kind 30142 events in each
+	// store. They differ while the outbox is behind, for hidden events of
+	// banned pubkeys, or when the index drifted (see verifyindex).
+	TypesenseTotal int64 `json:"typesense_total"`
+	BoltDBTotal    int64 `json:"boltdb_total"`
+	// Deletions is the number of kind 5 events in BoltDB.
+	Deletions  int64                   `json:"deletions"`
+	Breakdowns map[string][]FacetCount `json:"breakdowns"`
+	PerDay     []PeriodCount           `json:"per_day"`
+	PerWeek    []PeriodCount           `json:"per_week"`
+	// Errors holds the breakdowns or periods that could not be computed.
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// StatsCollector computes CollectionStats from Typesense facets and BoltDB
+// counts and caches them. A computation runs dozens of searches and counts,
+// so the stats method only starts it in the background.
+type StatsCollector struct {
+	admin      *TypesenseAdmin
+	collection string
+	boltDB     *boltdb.BoltBackend
+	ttl        time.Duration
+	// Metrics, if set, records the latency and errors of the searches.
+	Metrics *Metrics
+
+	// computeMu serializes computations
+	computeMu sync.Mutex
+	// mu guards the result of the last computation
+	mu      sync.Mutex
+	cached  *CollectionStats
+	err     error
+	running bool
+	now     func() time.Time
+}
+
+// NewStatsCollector creates a collector for the collection of tsDB that
+// reuses its stats for ttl, or recomputes them on every call if ttl is 0.
+func NewStatsCollector(tsDB *typesense30142.TSBackend, boltDB *boltdb.BoltBackend, ttl time.Duration) *StatsCollector {
+	return &StatsCollector{
+		admin:      NewTypesenseAdmin(tsDB),
+		collection: tsDB.CollectionName,
+		boltDB:     boltDB,
+		ttl:        ttl,
+		now:        time.Now,
+	}
+}
+
+// Get returns the cached stats and the error of the last computation. If
+// the stats are missing or older than the TTL, a computation starts in the
+// background and a later call returns its result; until then Get returns the
+// previous stats, or nil.
+func (s *StatsCollector) Get() (*CollectionStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.running && (s.cached == nil || s.now().Sub(time.Unix(s.cached.ComputedAt, 0)) >= s.ttl) {
+		s.running = true
+		go func() {
+			s.Refresh()
+			s.mu.Lock()
+			s.running = false
+			s.mu.Unlock()
+		}()
+	}
+	return s.cached, s.err
+}
+
+// Refresh computes the stats now and caches them.
+func (s *StatsCollector) Refresh() (*CollectionStats, error) {
+	s.computeMu.Lock()
+	defer s.computeMu.Unlock()
+	stats, err := s.compute()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+	if err != nil {
+		return nil, err
+	}
+	s.cached = stats
+	return stats, nil
+}
+
+func (s *StatsCollector) compute() (*CollectionStats, error) {
+	now := s.now().UTC()
+	stats := &CollectionStats{
+		ComputedAt: now.Unix(),
+		Breakdowns: map[string][]FacetCount{},
+		Errors:     map[string]string{},
+	}
+
+	// Only fields declared as facets can be broken down
+	fields, err := s.admin.CollectionFields(s.collection)
+	if err != nil {
+		return nil, err
+	}
+	faceted := map[string]bool{}
+	for _, field := range fields {
+		faceted[field.Name] = field.Facet
+	}
+	var facets []int
+	for i, facet := range statsFacets {
+		if faceted[facet.field] {
+			facets = append(facets, i)
+		} else {
+			stats.Errors[facet.name] = fmt.Sprintf("field %s is not declared as a facet in the collection schema", facet.field)
+		}
+	}
+
+	// The total and one facet per breakdown
+	searches := []map[string]any{s.countSearch("")}
+	for _, i := range facets {
+		search := s.countSearch("")
+		search["facet_by"] = statsFacets[i].field
+		search["max_facet_values"] = statsTopValues
+		searches = append(searches, search)
+	}
+	results, err := s.multiSearch(searches)
+	if err != nil {
+		return nil, err
+	}
+	if results[0].Error != "" {
+		return nil, fmt.Errorf("typesense search error: %s", results[0].Error)
+	}
+	stats.TypesenseTotal = results[0].Found
+	for n, i := range facets {
+		facet, result := statsFacets[i], results[n+1]
+		if result.Error != "" {
+			stats.Errors[facet.name] = result.Error
+			continue
+		}
+		counts := []FacetCount{}
+		for _, fc := range result.FacetCounts {
+			for _, c := range fc.Counts {
+				counts = append(counts, FacetCount{Value: c.Value, Count: c.Count})
+			}
+		}
+		stats.Breakdowns[facet.name] = counts
+	}
+
+	// Days and ISO weeks, most recent first; the current ones are partial
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	monday := today.AddDate(0, 0, -(int(today.Weekday())+6)%7)
+	var periods []PeriodCount
+	var ranges [][2]time.Time
+	searches = nil
+	addPeriod := func(start, end time.Time) {
+		periods = append(periods, PeriodCount{Start: start.Format(time.DateOnly)})
+		ranges = append(ranges, [2]time.Time{start, end})
+		searches = append(searches, s.countSearch(fmt.Sprintf("created_at:>=%d && created_at:<%d", start.Unix(), end.Unix())))
+	}
+	for i := range statsDays {
+		start := today.AddDate(0, 0, -i)
+		addPeriod(start, start.AddDate(0, 0, 1))
+	}
+	for i := range statsWeeks {
+		start := monday.AddDate(0, 0, -7*i)
+		addPeriod(start, start.AddDate(0, 0, 7))
+	}
+	results, err = s.multiSearch(searches)
+	if err != nil {
+		return nil, err
+	}
+	for i, result := range results {
+		if result.Error != "" {
+			stats.Errors["periods"] = result.Error
+		}
+		periods[i].Events = result.Found
+		periods[i].Deletions = s.countBolt(stats, nostr.Filter{
+			Kinds: []nostr.Kind{nostr.KindDeletion},
+			Since: nostr.Timestamp(ranges[i][0].Unix()),
+			Until: nostr.Timestamp(ranges[i][1].Unix() - 1),
+		})
+	}
+	stats.PerDay, stats.PerWeek = periods[:statsDays], periods[statsDays:]
+
+	stats.BoltDBTotal = s.countBolt(stats, nostr.Filter{Kinds: []nostr.Kind{30142}})
+	stats.Deletions = s.countBolt(stats, nostr.Filter{Kinds: []nostr.Kind{nostr.KindDeletion}})
+	if len(stats.Errors) == 0 {
+		stats.Errors = nil
+	}
+	return stats, nil
+}
+
+// countSearch is a search that only counts the events matching filterBy.
+func (s *StatsCollector) countSearch(filterBy string) map[string]any {
+	search := map[string]any{
+		"collection": s.collection,
+		"q":          "*",
+		"per_page":   0,
+	}
+	if filterBy != "" {
+		search["filter_by"] = filterBy
+	}
+	return search
+}
+
+func (s *StatsCollector) multiSearch(searches []map[string]any) ([]SearchResult, error) {
+	start := time.Now()
+	results, err := s.admin.MultiSearch(searches)
+	s.Metrics.ObserveTypesense("stats", start, err)
+	return results, err
+}
+
+// countBolt counts the events matching filter in BoltDB, recording a failure in stats.
+func (s *StatsCollector) countBolt(stats *CollectionStats, filter nostr.Filter) int64 {
+	count, err := s.boltDB.CountEvents(filter)
+	if err != nil {
+		stats.Errors["boltdb"] = err.Error()
+		return 0
+	}
+	return int64(count)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestStatsCollector(t *testing.T) {
+	ts := newFakeTypesense(t)
+	ts.addCollection("amb",
+		map[string]any{"name": "pubkey", "type": "string", "facet": true},
+		map[string]any{"name": "about.id", "type": "string[]", "facet": true},
+		map[string]any{"name": "learningResourceType.id", "type": "string[]", "facet": true},
+		map[string]any{"name": "inLanguage", "type": "string[]", "facet": true},
+		map[string]any{"name": "license.id", "type": "string"},
+		map[string]any{"name": "created_at", "type": "int64"},
+	)
+	db := newTestBolt(t)
+
+	// A Wednesday; its ISO week starts on 2026-03-09
+	now := time.Date(2026, 3, 11, 12, 0, 0, 0, time.UTC)
+	alice, bob := testPubKey("alice"), testPubKey("bob")
+	at := func(d time.Time) float64 { return float64(d.Unix()) }
+	about := func(ids ...string) []any {
+		var out []any
+		for _, id := range ids {
+			out = append(out, map[string]any{"id": id})
+		}
+		return out
+	}
+	ts.addDocument("amb", map[string]any{"id": "1", "pubkey": alice.Hex(), "about": about("math"), "inLanguage": []any{"de"}, "created_at": at(now.Add(-2 * time.Hour))})
+	ts.addDocument("amb", map[string]any{"id": "2", "pubkey": alice.Hex(), "about": about("math", "physics"), "inLanguage": []any{"en"}, "created_at": at(now.AddDate(0, 0, -1))})
+	ts.addDocument("amb", map[string]any{"id": "3", "pubkey": bob.Hex(), "about": about("physics"), "inLanguage": []any{"de"}, "created_at": at(now.AddDate(0, 0, -10))})
+
+	saveEvents(t, db,
+		makeEvent(alice, "a", "A", nostr.Timestamp(now.Unix())),
+		makeEvent(bob, "b", "B", nostr.Timestamp(now.Unix())),
+	)
+	deletion := nostr.Event{PubKey: alice, CreatedAt: nostr.Timestamp(now.Add(-time.Hour).Unix()), Kind: nostr.KindDeletion}
+	deletion.ID = nostr.ID(sha256.Sum256([]byte("deletion")))
+	saveEvents(t, db, deletion)
+
+	s := NewStatsCollector(newTestTSBackend(t, ts, "amb"), db, time.Minute)
+	s.now = func() time.Time { return now }
+
+	stats, err := s.Refresh()
+	if err != nil {
+		t.Fatalf("get stats: %v", err)
+	}
+	if stats.TypesenseTotal != 3 || stats.BoltDBTotal != 2 || stats.Deletions != 1 {
+		t.Errorf("totals = typesense %d, boltdb %d, deletions %d, want 3, 2, 1", stats.TypesenseTotal, stats.BoltDBTotal, stats.Deletions)
+	}
+	wantPublishers := []FacetCount{{alice.Hex(), 2}, {bob.Hex(), 1}}
+	if got := stats.Breakdowns["publishers"]; !slices.Equal(got, wantPublishers) {
+		t.Errorf("publishers = %v, want %v", got, wantPublishers)
+	}
+	wantAbout := []FacetCount{{"math", 2}, {"physics", 2}}
+	if got := stats.Breakdowns["about"]; !slices.Equal(got, wantAbout) {
+		t.Errorf("about = %v, want %v", got, wantAbout)
+	}
+	if msg := stats.Errors["licenses"]; !strings.Contains(msg, "facet") {
+		t.Errorf("errors = %v, want an entry for licenses, which is not a facet field", stats.Errors)
+	}
+	if _, ok := stats.Breakdowns["licenses"]; ok {
+		t.Error("licenses has a breakdown despite failing")
+	}
+
+	if len(stats.PerDay) != statsDays || len(stats.PerWeek) != statsWeeks {
+		t.Fatalf("got %d days and %d weeks, want %d and %d", len(stats.PerDay), len(stats.PerWeek), statsDays, statsWeeks)
+	}
+	wantDays := []PeriodCount{{"2026-03-11", 1, 1}, {"2026-03-10", 1, 0}, {"2026-03-09", 0, 0}}
+	if got := stats.PerDay[:3]; !slices.Equal(got, wantDays) {
+		t.Errorf("per_day starts with %v, want %v", got, wantDays)
+	}
+	wantWeeks := []PeriodCount{{"2026-03-09", 2, 1}, {"2026-03-02", 0, 0}, {"2026-02-23", 1, 0}}
+	if got := stats.PerWeek[:3]; !slices.Equal(got, wantWeeks) {
+		t.Errorf("per_week starts with %v, want %v", got, wantWeeks)
+	}
+
+	// Cached until the TTL passes, unless refreshed
+	ts.addDocument("amb", map[string]any{"id": "4", "pubkey": bob.Hex(), "created_at": at(now)})
+	if cached, _ := s.Get(); cached != stats {
+		t.Error("stats were recomputed within the TTL")
+	}
+	refreshed, err := s.Refresh()
+	if err != nil || refreshed.TypesenseTotal != 4 {
+		t.Errorf("refreshed typesense_total = %d, %v, want 4", refreshed.TypesenseTotal, err)
+	}
+
+	// After the TTL the previous stats are returned while new ones are computed
+	ts.addDocument("amb", map[string]any{"id": "5", "pubkey": bob.Hex(), "created_at": at(now)})
+	now = now.Add(2 * time.Minute)
+	if expired, _ := s.Get(); expired != refreshed {
+		t.Error("Get waited for the recomputation")
+	}
+	if updated := waitStats(t, s); updated.TypesenseTotal != 5 {
+		t.Errorf("typesense_total after the TTL = %d, want 5", updated.TypesenseTotal)
+	}
+}
+
+// waitStats waits until the collector cached stats other than the current ones.
+func waitStats(t *testing.T, s *StatsCollector) *CollectionStats {
+	t.Helper()
+	previous, _ := s.Get()
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if stats, _ := s.Get(); stats != previous {
+			return stats
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("stats were not recomputed")
+	return nil
+}
+
+func TestStatsCollectorTypesenseDown(t *testing.T) {
+	ts := newFakeTypesense(t)
+	s := NewStatsCollector(newTestTSBackend(t, ts, "amb"), newTestBolt(t), time.Minute)
+	ts.Close()
+	if _, err := s.Refresh(); err == nil {
+		t.Error("got stats without Typesense")
+	}
+	if stats, err := s.Get(); stats != nil || err == nil {
+		t.Errorf("Get = %v, %v, want the error of the last computation", stats, err)
+	}
+}
@@ -79,9 +79,14 @@ for i in $(seq 1 30); do
   fi
 done
 
-# Drop stale collection from any previous run
+# Drop stale alias and collections from any previous run
 curl -sf -X DELETE -H "X-TYPESENSE-API-KEY: xyz" \
-  "http://localhost:8108/collections/amb_e2e_test" >/dev/null 2>&1 || true
+  "http://localhost:8108/aliases/amb_e2e_test" >/dev/null 2>&1 || true
+for c in $(curl -sf -H "X-TYPESENSE-API-KEY: xyz" "http://localhost:8108/collections" \
+  | jq -r '.[].name | select(startswith("amb_e2e_test"))' 2>/dev/null); do
+  curl -sf -X DELETE -H "X-TYPESENSE-API-KEY: xyz" \
+    "http://localhost:8108/collections/${c}" >/dev/null 2>&1 || true
+done
 
 # ============================================================
 # Generate test keys (before relay startup so PUBKEY can be set)
@@ -127,6 +132,12 @@ if [ -z "${EMBED_ENDPOINT:-}" ] && [ -f .env ]; then
   export EMBED_ENDPOINT EMBED_TOKEN
 fi
 
+# Without an embedding service, use the built-in hash embedder so the vector
+# search code paths still run. Its vectors only reflect shared words.
+if [ -z "${EMBED_ENDPOINT:-}" ] && [ -z "${EMBED_PROVIDER:-}" ]; then
+  export EMBED_PROVIDER=hash
+fi
+
 go run . > /tmp/amb-relay-e2e.log 2>&1 &
 RELAY_PID=$!
 
@@ -412,6 +423,14 @@ assert_count "by p-tag (tagged pubkey)" 1 \
 assert_count "NIP-50 search 'physics'" 1 \
   -k 30142 --search "physics"
 
+# 7a. NIP-50 extension tokens are stripped from the query
+assert_count "NIP-50 search 'physics mode:keyword'" 1 \
+  -k 30142 --search "physics mode:keyword"
+assert_count "NIP-50 search with unsupported alpha falls back" 1 \
+  -k 30142 --search "physics alpha:0.5"
+assert_count "similar: with an unknown address returns nothing" 0 \
+  -k 30142 --search "similar:30142:$PUB:https://example.org/missing"
+
 # 8. NIP-50 field-specific search (exact match on nested field)
 assert_count "NIP-50 field search about.prefLabel.de:Mathematik" 1 \
   -k 30142 --search "about.prefLabel.de:Mathematik"
@@ -623,6 +642,33 @@ else
   FAIL=$((FAIL + 1))
 fi
 
+# 20a. Purge a banned pubkey's events (hide from search, keep in BoltDB)
+wait_for_purge() {
+  for i in $(seq 1 30); do
+    RUNNING=$(nip86_call "getpurgestatus" '[]' | jq -r '.result.result.running')
+    [ "$RUNNING" = "false" ] && break
+    sleep 1
+  done
+}
+sleep 1
+nip86_call "banpubkey" "[\"${TAGGED_PUB}\", \"purge test\"]" >/dev/null
+assert_nip86 "purgepubkey hide starts" \
+  "purgepubkey" "[\"${TAGGED_PUB}\", \"hide\"]" \
+  '.result.result == "purge started"'
+wait_for_purge
+assert_nip86 "getpurgestatus reports processed events" \
+  "getpurgestatus" '[]' \
+  '.result.result.running == false and .result.result.processed > 0'
+assert_count "hidden pubkey events gone from search" 0 \
+  -k 30142 -a "$TAGGED_PUB"
+
+# 20b. Allowing the pubkey re-indexes its hidden events
+nip86_call "allowpubkey" "[\"${TAGGED_PUB}\", \"\"]" >/dev/null
+wait_for_purge
+sleep 1
+assert_count "allowed pubkey events re-indexed" 1 \
+  -k 30142 -a "$TAGGED_PUB"
+
 # 21. Ban event
 FAKE_EVENT_ID="aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
 assert_nip86 "banevent succeeds" \
@@ -644,6 +690,23 @@ assert_nip86 "listbannedevents empty after unban" \
   "listbannedevents" '[]' \
   '.result == null or (.result | length == 0)'
 
+# 24a. Banning a stored event removes it from query results
+EVENT_A_ID=$(query_events -k 30142 -d "https://example.org/courses/physics-101" | jq -r '.id' | head -1)
+assert_nip86 "banevent on stored event succeeds" \
+  "banevent" "[\"${EVENT_A_ID}\", \"takedown\"]" \
+  '.result == true'
+sleep 1
+assert_count "banned event hidden from queries" 0 \
+  -k 30142 -d "https://example.org/courses/physics-101"
+
+# 24b. Allowing the event restores it from the copy kept at ban time
+assert_nip86 "allowevent on banned stored event succeeds" \
+  "allowevent" "[\"${EVENT_A_ID}\", \"\"]" \
+  '.result == true'
+sleep 1
+assert_count "allowed event restored to queries" 1 \
+  -k 30142 -d "https://example.org/courses/physics-101"
+
 # 25. Change relay name
 assert_nip86 "changerelayname succeeds" \
   "changerelayname" '["Updated E2E Relay"]' \
@@ -674,6 +737,13 @@ assert_nip86 "stats returns event_count" \
   "stats" '[]' \
   '.result.result.event_count != null'
 
+# 29a. A repeated search is answered from the result cache
+query_events -k 30142 --search "physics" --limit 3 >/dev/null
+query_events -k 30142 --search "physics" --limit 3 >/dev/null
+assert_nip86 "stats reports search result cache hits" \
+  "stats" '[]' \
+  '.result.result.search_result_cache.hits > 0 and .result.result.search_result_cache.hit_ratio > 0'
+
 # ============================================================
 # NIP-86 Authorization tests
 # ============================================================
@@ -779,6 +849,17 @@ sleep 1
 assert_count "events queryable after reindex" 4 \
   -k 30142
 
+# 42a. Collection name is now an alias pointing at the rebuilt collection
+ALIAS_TARGET=$(curl -s -H "X-TYPESENSE-API-KEY: xyz" \
+  "http://localhost:8108/aliases/amb_e2e_test" | jq -r '.collection_name')
+if [[ "$ALIAS_TARGET" == amb_e2e_test_* ]]; then
+  printf "${GREEN}PASS${NC}: alias points to versioned collection %s\n" "$ALIAS_TARGET"
+  PASS=$((PASS + 1))
+else
+  printf "${RED}FAIL${NC}: alias not swapped (got: %s)\n" "$ALIAS_TARGET"
+  FAIL=$((FAIL + 1))
+fi
+
 # 43. Double reindex not allowed while running - start a reindex and immediately try another
 # First, update schema so reindex takes a moment (needs to recreate collection)
 SCHEMA_FOR_REINDEX=$(nip86_call "getcollectionschema" '[]' | jq '.result.result')
@@ -804,6 +885,58 @@ for i in $(seq 1 30); do
   sleep 1
 done
 
+# 43b. Finished reindex jobs are recorded in the history
+assert_nip86 "getreindexhistory lists finished jobs" \
+  "getreindexhistory" '[]' \
+  '.result.result | length > 0 and .[0].status != null'
+
+# 43c. Cancelling when nothing runs is an error
+CANCEL_RESP=$(nip86_call "cancelreindex" '[]')
+if echo "$CANCEL_RESP" | jq -e '.result.error != null and .result.error != ""' >/dev/null 2>&1; then
+  printf "${GREEN}PASS${NC}: cancelreindex rejected without running reindex\n"
+  PASS=$((PASS + 1))
+else
+  printf "${RED}FAIL${NC}: cancelreindex should fail when idle (response: %s)\n" "$CANCEL_RESP"
+  FAIL=$((FAIL + 1))
+fi
+
+# 43d. Selective reindex re-upserts only the events matching a filter
+assert_nip86 "selective reindex started" \
+  "reindex" '[{"#t":["physics"]}]' \
+  '.result.result == "selective reindex started"'
+for i in $(seq 1 30); do
+  RUNNING=$(nip86_call "getreindexstatus" '[]' | jq -r '.result.result.running')
+  [ "$RUNNING" = "false" ] && break
+  sleep 1
+done
+assert_nip86 "selective reindex processed only matching events" \
+  "getreindexstatus" '[]' \
+  '.result.result.selective == true and .result.result.phase == "done" and .result.result.total == 1 and .result.result.indexed == 1'
+assert_nip86 "selective reindex recorded in history" \
+  "getreindexhistory" '[]' \
+  '.result.result[0].selective == true'
+SEARCH_REINDEX_RESP=$(nip86_call "reindex" '[{"search":"physics"}]')
+if echo "$SEARCH_REINDEX_RESP" | jq -e '.result.error != null and .result.error != ""' >/dev/null 2>&1; then
+  printf "${GREEN}PASS${NC}: reindex rejects search filters\n"
+  PASS=$((PASS + 1))
+else
+  printf "${RED}FAIL${NC}: reindex should reject search filters (response: %s)\n" "$SEARCH_REINDEX_RESP"
+  FAIL=$((FAIL + 1))
+fi
+
+# 43a. Index verification finds no differences after a reindex
+assert_nip86 "verifyindex started" \
+  "verifyindex" '[]' \
+  '.result.result == "verifyindex started"'
+for i in $(seq 1 30); do
+  RUNNING=$(nip86_call "getverifyindexstatus" '[]' | jq -r '.result.result.running')
+  [ "$RUNNING" = "false" ] && break
+  sleep 1
+done
+assert_nip86 "getverifyindexstatus reports a consistent index" \
+  "getverifyindexstatus" '[]' \
+  '.result.result.running == false and .result.result.missing == 0 and .result.result.orphaned == 0'
+
 # 44. Non-admin cannot use custom methods
 NONADMIN_SCHEMA_RESP=$(nip86_call "getcollectionschema" '[]' "$NONADMIN_SEC")
 assert_nip86_error "non-admin rejected for getcollectionschema" "$NONADMIN_SCHEMA_RESP"
@@ -839,6 +972,22 @@ assert_nip86 "getsemanticsearchconfig shows custom fields" \
   "getsemanticsearchconfig" '[]' \
   '.result.result.embed_fields | contains(["name", "description"])'
 
+# 49a. Field weights are stored, unknown fields rejected
+assert_nip86 "updatesemanticsearchconfig with weights" \
+  "updatesemanticsearchconfig" '[{"enabled": true, "embed_fields": ["name", "about"], "field_weights": {"name": 2}}]' \
+  '.result.result == true'
+assert_nip86 "getsemanticsearchconfig shows weights" \
+  "getsemanticsearchconfig" '[]' \
+  '.result.result.field_weights.name == 2'
+BAD_FIELD_RESP=$(nip86_call "updatesemanticsearchconfig" '[{"enabled": true, "embed_fields": ["nosuchfield"]}]')
+if echo "$BAD_FIELD_RESP" | jq -e '.result.error != null and .result.error != ""' >/dev/null 2>&1; then
+  printf "${GREEN}PASS${NC}: updatesemanticsearchconfig rejects unknown fields\n"
+  PASS=$((PASS + 1))
+else
+  printf "${RED}FAIL${NC}: updatesemanticsearchconfig should reject unknown fields (response: %s)\n" "$BAD_FIELD_RESP"
+  FAIL=$((FAIL + 1))
+fi
+
 # 50. Disable semantic search
 assert_nip86 "disablesemanticsearch succeeds" \
   "disablesemanticsearch" '[]' \
@@ -849,6 +998,22 @@ assert_nip86 "getsemanticsearchconfig shows disabled" \
   "getsemanticsearchconfig" '[]' \
   '.result.result.enabled == false'
 
+# 51a. Embedding providers can be listed, and invalid ones are rejected
+assert_nip86 "getembeddingprovider lists providers" \
+  "getembeddingprovider" '[]' \
+  '.result.result.providers | contains(["edufeed", "ollama", "openai"])'
+BAD_PROVIDER_RESP=$(nip86_call "setembeddingprovider" '[{"provider": "openai", "endpoint": "http://localhost:1/v1/embeddings"}]')
+if echo "$BAD_PROVIDER_RESP" | jq -e '.result.error != null and .result.error != ""' >/dev/null 2>&1; then
+  printf "${GREEN}PASS${NC}: setembeddingprovider rejects openai without model\n"
+  PASS=$((PASS + 1))
+else
+  printf "${RED}FAIL${NC}: setembeddingprovider should require a model (response: %s)\n" "$BAD_PROVIDER_RESP"
+  FAIL=$((FAIL + 1))
+fi
+assert_nip86 "resetembeddingprovider returns the model status" \
+  "resetembeddingprovider" '[]' \
+  '.result.result | has("model")'
+
 # 52. Non-admin cannot access semantic search config
 NONADMIN_SEMANTIC_RESP=$(nip86_call "getsemanticsearchconfig" '[]' "$NONADMIN_SEC")
 assert_nip86_error "non-admin rejected for semantic search config" "$NONADMIN_SEMANTIC_RESP"
@@ -856,9 +1021,9 @@ assert_nip86_error "non-admin rejected for semantic search config" "$NONADMIN_SE
 # ============================================================
 # Semantic Search Functional tests (if embedding service available)
 # ============================================================
-if [ -n "${EMBED_ENDPOINT:-}" ]; then
+if [ -n "${EMBED_ENDPOINT:-}" ] || [ "${EMBED_PROVIDER:-}" = "hash" ]; then
   echo ""
-  echo "--- Semantic Search Functional tests ---"
+  echo "--- Semantic Search Functional tests (${EMBED_PROVIDER:-edufeed}) ---"
 
   # Enable semantic search
   nip86_call "enablesemanticsearch" '[]' >/dev/null
@@ -878,8 +1043,22 @@ if [ -n "${EMBED_ENDPOINT:-}" ]; then
 }
 EOF
 )
-  echo "  Publishing semantic test event..."
+  RELATED_EVENT=$(cat <<EOF
+{
+  "tags": [
+    ["d", "https://example.org/courses/quantum-computing"],
+    ["type", "LearningResource"],
+    ["name", "Quantum Computing Basics"],
+    ["description", "Qubits, superposition and the uncertainty principle in computation"],
+    ["t", "quantum"]
+  ],
+  "content": "Qubits and superposition"
+}
+EOF
+)
+  echo "  Publishing semantic test events..."
   publish "$SEMANTIC_EVENT"
+  publish "$RELATED_EVENT"
   sleep 3  # Wait for embedding computation
 
   # 53. Search with semantically related terms (not exact keyword match)
@@ -891,12 +1070,78 @@ EOF
     printf "${YELLOW}SKIP${NC}: semantic search results inconclusive\n"
   fi
 
+  # 53a. Vector-only and alpha-weighted searches
+  SEMANTIC_ONLY=$(query_events -k 30142 --search "Heisenberg Schrödinger subatomic mode:semantic")
+  if echo "$SEMANTIC_ONLY" | grep -q "quantum-physics"; then
+    printf "${GREEN}PASS${NC}: mode:semantic finds related content\n"
+    PASS=$((PASS + 1))
+  else
+    printf "${YELLOW}SKIP${NC}: mode:semantic results inconclusive\n"
+  fi
+  assert_count "mode:keyword ignores semantically related content" 0 \
+    -k 30142 --search "Heisenberg Schrödinger subatomic mode:keyword"
+
+  # 53c. Hash vectors are deterministic: shared words make a vector match
+  if [ "${EMBED_PROVIDER:-}" = "hash" ]; then
+    HASH_RESULTS=$(query_events -k 30142 --search "introduction to quantum mechanics mode:semantic" --limit 1)
+    if echo "$HASH_RESULTS" | grep -q "quantum-physics"; then
+      printf "${GREEN}PASS${NC}: hash embedder ranks the event sharing the query words first\n"
+      PASS=$((PASS + 1))
+    else
+      printf "${RED}FAIL${NC}: hash embedder did not rank quantum-physics first\n"
+      FAIL=$((FAIL + 1))
+    fi
+  fi
+
+  # 53b. similar: returns neighbours of a stored event, never the event itself
+  SOURCE_ID=$(query_events -k 30142 -d "https://example.org/courses/quantum-physics" | jq -r '.id' | head -1)
+  SIMILAR=$(query_events -k 30142 --search "similar:$SOURCE_ID")
+  if echo "$SIMILAR" | grep -q "quantum-computing" && ! echo "$SIMILAR" | grep -q "$SOURCE_ID"; then
+    printf "${GREEN}PASS${NC}: similar:<id> excludes the source event\n"
+    PASS=$((PASS + 1))
+  else
+    printf "${RED}FAIL${NC}: similar:<id> returned no events or the source event\n"
+    FAIL=$((FAIL + 1))
+  fi
+  SIMILAR_ADDR=$(query_events -k 30142 --search "similar:30142:$PUB:https://example.org/courses/quantum-physics")
+  if echo "$SIMILAR_ADDR" | grep -q "quantum-computing" && ! echo "$SIMILAR_ADDR" | grep -q "$SOURCE_ID"; then
+    printf "${GREEN}PASS${NC}: similar:<address> excludes the source event\n"
+    PASS=$((PASS + 1))
+  else
+    printf "${RED}FAIL${NC}: similar:<address> returned no events or the source event\n"
+    FAIL=$((FAIL + 1))
+  fi
+
+  # 54. Repeating a search reuses the cached query embedding (the limit
+  # keeps the search result cache from answering it)
+  HITS_BEFORE=$(nip86_call "getembeddingcachestats" '[]' | jq -r '.result.result.hits')
+  query_events -k 30142 --search "Heisenberg Schrödinger subatomic" --limit 7 >/dev/null
+  assert_nip86 "embedding cache hit on repeated search" \
+    "getembeddingcachestats" '[]' \
+    ".result.result.hits > ${HITS_BEFORE:-0} and .result.result.entries > 0"
+
+  # 54a. Repeated vector-only searches reuse the query vector
+  query_events -k 30142 --search "Heisenberg Schrödinger subatomic mode:semantic" --limit 7 >/dev/null
+  assert_nip86 "query vector cache hit on repeated semantic search" \
+    "stats" '[]' \
+    '.result.result.query_vector_cache.hits > 0'
+
+  # 56. The model probe records the model and its dimension
+  assert_nip86 "getembeddingmodelstatus reports model and dimensions" \
+    "getembeddingmodelstatus" '[]' \
+    '.result.result.dimensions > 0 and .result.result.indexed_model == .result.result.model and .result.result.reembed_required == false'
+
+  # 55. A healthy embedding service keeps the circuit breaker closed
+  assert_nip86 "stats reports closed embedding breaker" \
+    "stats" '[]' \
+    '.result.result.embedding_breaker.state == "closed"'
+
   # Disable semantic search for remaining tests
   nip86_call "disablesemanticsearch" '[]' >/dev/null
 else
   echo ""
   echo "--- Semantic Search Functional tests ---"
-  printf "${YELLOW}SKIP${NC}: EMBED_ENDPOINT not set, skipping functional tests\n"
+  printf "${YELLOW}SKIP${NC}: no embedding provider set, skipping functional tests\n"
 fi
 
 # ============================================================
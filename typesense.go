@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"fiatjaf.com/nostr/eventstore/typesense30142"
+)
+
+// TypesenseAdmin talks to the Typesense HTTP API directly for the collection
+// and alias operations that TSBackend does not cover.
+type TypesenseAdmin struct {
+	Host       string
+	ApiKey     string
+	HTTPClient *http.Client
+}
+
+// NewTypesenseAdmin creates an admin client sharing the TSBackend's connection settings.
+func NewTypesenseAdmin(tsDB *typesense30142.TSBackend) *TypesenseAdmin {
+	return &TypesenseAdmin{
+		Host:   tsDB.Host,
+		ApiKey: tsDB.ApiKey,
+		HTTPClient: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}
+}
+
+// GetAlias returns the collection an alias points to, or "" if the alias does not exist.
+func (a *TypesenseAdmin) GetAlias(name string) (string, error) {
+	var alias struct {
+		CollectionName string `json:"collection_name"`
+	}
+	status, err := a.do(http.MethodGet, "/aliases/"+url.PathEscape(name), nil, &alias)
+	if status == http.StatusNotFound {
+		return "", nil
+	}
+	return alias.CollectionName, err
+}
+
+// UpsertAlias atomically points an alias at a collection.
+func (a *TypesenseAdmin) UpsertAlias(name, collection string) error {
+	_, err := a.do(http.MethodPut, "/aliases/"+url.PathEscape(name), map[string]string{"collection_name": collection}, nil)
+	return err
+}
+
+// CollectionExists reports whether a collection (not an alias) with the given name exists.
+func (a *TypesenseAdmin) CollectionExists(name string) (bool, error) {
+	collections, err := a.ListCollections()
+	if err != nil {
+		return false, err
+	}
+	for _, c := range collections {
+		if c == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ListCollections returns the names of all collections.
+func (a *TypesenseAdmin) ListCollections() ([]string, error) {
+	var collections []struct {
+		Name string `json:"name"`
+	}
+	if _, err := a.do(http.MethodGet, "/collections", nil, &collections); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(collections))
+	for _, c := range collections {
+		names = append(names, c.Name)
+	}
+	return names, nil
+}
+
+// CollectionField is a field of a collection schema as returned by Typesense.
+type CollectionField struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Index  *bool  `json:"index,omitempty"`
+	Facet  bool   `json:"facet,omitempty"`
+	NumDim int    `json:"num_dim,omitempty"`
+}
+
+// CollectionFields returns the fields of a collection or alias, or nil if it does not exist.
+func (a *TypesenseAdmin) CollectionFields(name string) ([]CollectionField, error) {
+	if target, err := a.GetAlias(name); err != nil {
+		return nil, err
+	} else if target != "" {
+		name = target
+	}
+	var collection struct {
+		Fields []CollectionField `json:"fields"`
+	}
+	status, err := a.do(http.MethodGet, "/collections/"+url.PathEscape(name), nil, &collection)
+	if status == http.StatusNotFound {
+		return nil, nil
+	}
+	return collection.Fields, err
+}
+
+// CollectionDimensions returns the num_dim of the first vector field of a
+// collection or alias, or 0 if it has none or does not exist.
+func (a *TypesenseAdmin) CollectionDimensions(name string) (int, error) {
+	fields, err := a.CollectionFields(name)
+	if err != nil {
+		return 0, err
+	}
+	for _, field := range fields {
+		if field.NumDim > 0 {
+			return field.NumDim, nil
+		}
+	}
+	return 0, nil
+}
+
+// SearchIDs runs a single search through the multi_search endpoint, which
+// accepts long vector queries in the request body, and returns the IDs of the
+// hits in rank order.
+func (a *TypesenseAdmin) SearchIDs(search map[string]any) ([]string, error) {
+	var result struct {
+		Results []struct {
+			Hits []struct {
+				Document struct {
+					ID string `json:"id"`
+				} `json:"document"`
+			} `json:"hits"`
+			Error string `json:"error"`
+		} `json:"results"`
+	}
+	body := map[string]any{"searches": []map[string]any{search}}
+	if _, err := a.do(http.MethodPost, "/multi_search", body, &result); err != nil {
+		return nil, err
+	}
+	if len(result.Results) == 0 {
+		return nil, nil
+	}
+	if msg := result.Results[0].Error; msg != "" {
+		return nil, fmt.Errorf("typesense search error: %s", msg)
+	}
+	ids := make([]string, 0, len(result.Results[0].Hits))
+	for _, hit := range result.Results[0].Hits {
+		ids = append(ids, hit.Document.ID)
+	}
+	return ids, nil
+}
+
+// SearchResult is the part of a search result used for counting: the number
+// of matching documents and the facet counts.
+type SearchResult struct {
+	Found       int64 `json:"found"`
+	FacetCounts []struct {
+		FieldName string `json:"field_name"`
+		Counts    []struct {
+			Value string `json:"value"`
+			Count int64  `json:"count"`
+		} `json:"counts"`
+	} `json:"facet_counts"`
+	Error string `json:"error"`
+}
+
+// MultiSearch runs searches in one request. A search that fails has its
+// Error set; the request only fails as a whole if Typesense cannot be reached
+// or rejects it.
+func (a *TypesenseAdmin) MultiSearch(searches []map[string]any) ([]SearchResult, error) {
+	var result struct {
+		Results []SearchResult `json:"results"`
+	}
+	body := map[string]any{"searches": searches}
+	if _, err := a.do(http.MethodPost, "/multi_search", body, &result); err != nil {
+		return nil, err
+	}
+	if len(result.Results) != len(searches) {
+		return nil, fmt.Errorf("typesense returned %d results for %d searches", len(result.Results), len(searches))
+	}
+	return result.Results, nil
+}
+
+// CopyCollection creates dst with the schema of src and copies all documents
+// of src into it. The export is streamed into the import, so the collection
+// is never held in memory.
+func (a *TypesenseAdmin) CopyCollection(src, dst string) error {
+	var schema map[string]any
+	if _, err := a.do(http.MethodGet, "/collections/"+url.PathEscape(src), nil, &schema); err != nil {
+		return err
+	}
+	for _, key := range []string{"num_documents", "created_at"} {
+		delete(schema, key)
+	}
+	schema["name"] = dst
+	if _, err := a.do(http.MethodPost, "/collections", schema, nil); err != nil {
+		return err
+	}
+
+	// Copying takes as long as the collection is large
+	client := *a.HTTPClient
+	client.Timeout = 0
+	req, err := http.NewRequest(http.MethodGet, a.Host+"/collections/"+url.PathEscape(src)+"/documents/export", nil)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("X-TYPESENSE-API-KEY", a.ApiKey)
+	export, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("export %s: %w", src, err)
+	}
+	defer export.Body.Close()
+	if export.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(export.Body)
+		return fmt.Errorf("export %s: typesense error %d: %s", src, export.StatusCode, string(msg))
+	}
+
+	req, err = http.NewRequest(http.MethodPost, a.Host+"/collections/"+url.PathEscape(dst)+"/documents/import?action=create", export.Body)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("X-TYPESENSE-API-KEY", a.ApiKey)
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("import into %s: %w", dst, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("import into %s: typesense error %d: %s", dst, resp.StatusCode, string(msg))
+	}
+	// One result per document
+	var failed int
+	var firstErr string
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var result struct {
+			Success bool   `json:"success"`
+			Error   string `json:"error"`
+		}
+		if err := decoder.Decode(&result); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("decode import result: %w", err)
+		}
+		if !result.Success {
+			failed++
+			firstErr = cmp.Or(firstErr, result.Error)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d documents failed to copy into %s: %s", failed, dst, firstErr)
+	}
+	return nil
+}
+
+// DeleteCollection drops a collection. A missing collection is not an error.
+func (a *TypesenseAdmin) DeleteCollection(name string) error {
+	status, err := a.do(http.MethodDelete, "/collections/"+url.PathEscape(name), nil, nil)
+	if status == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+func (a *TypesenseAdmin) do(method, path string, body, result any) (int, error) {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, fmt.Errorf("marshal request: %w", err)
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, a.Host+path, reqBody)
+	if err != nil {
+		return 0, fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("X-TYPESENSE-API-KEY", a.ApiKey)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := a.HTTPClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, fmt.Errorf("typesense error %d: %s", resp.StatusCode, string(msg))
+	}
+	if result != nil {
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+			return resp.StatusCode, fmt.Errorf("decode response: %w", err)
+		}
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,867 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeTypesense is an in-process stand-in for the parts of the Typesense
+// HTTP API used by TSBackend, TypesenseAdmin and SemanticSearcher: collections,
+// aliases, document CRUD and import, and search. Searches support q over the
+// query_by fields, conjunctions of simple filter_by clauses and vector_query
+// by vector or by document id. Unsupported filter syntax is answered with 400
+// so tests fail loudly instead of matching the wrong documents.
+type fakeTypesense struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	collections map[string]*fakeCollection
+	aliases     map[string]string
+
+	// before, if set, is called with every request before it is served,
+	// e.g. to hold requests back. Set it before the first request.
+	before func(r *http.Request)
+}
+
+type fakeCollection struct {
+	schema map[string]any
+	docs   map[string]map[string]any
+}
+
+const fakeTypesenseAPIKey = "test-key"
+
+func newFakeTypesense(t *testing.T) *fakeTypesense {
+	t.Helper()
+	f := &fakeTypesense{
+		collections: map[string]*fakeCollection{},
+		aliases:     map[string]string{},
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// collectionDocs returns a copy of the documents of a collection or alias.
+func (f *fakeTypesense) collectionDocs(name string) map[string]map[string]any {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := f.collections[f.resolve(name)]
+	if c == nil {
+		return nil
+	}
+	docs := make(map[string]map[string]any, len(c.docs))
+	for id, doc := range c.docs {
+		docs[id] = doc
+	}
+	return docs
+}
+
+// collectionNames returns the names of all collections, sorted.
+func (f *fakeTypesense) collectionNames() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	names := make([]string, 0, len(f.collections))
+	for name := range f.collections {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// alias returns the collection an alias points to.
+func (f *fakeTypesense) alias(name string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.aliases[name]
+}
+
+// addCollection creates a collection with the given fields directly.
+func (f *fakeTypesense) addCollection(name string, fields ...map[string]any) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	anyFields := make([]any, len(fields))
+	for i, field := range fields {
+		anyFields[i] = field
+	}
+	f.collections[name] = &fakeCollection{
+		schema: map[string]any{"name": name, "fields": anyFields},
+		docs:   map[string]map[string]any{},
+	}
+}
+
+// addDocument stores a document directly, bypassing the HTTP API.
+func (f *fakeTypesense) addDocument(collection string, doc map[string]any) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.collections[f.resolve(collection)].docs[doc["id"].(string)] = doc
+}
+
+func (f *fakeTypesense) resolve(name string) string {
+	if target, ok := f.aliases[name]; ok {
+		return target
+	}
+	return name
+}
+
+func (f *fakeTypesense) serve(w http.ResponseWriter, r *http.Request) {
+	if f.before != nil {
+		f.before(r)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path == "/health" {
+		writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+		return
+	}
+	if r.Header.Get("X-TYPESENSE-API-KEY") != fakeTypesenseAPIKey {
+		writeJSON(w, http.StatusUnauthorized, map[string]any{"message": "Forbidden - a valid `x-typesense-api-key` header must be sent."})
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case parts[0] == "aliases":
+		f.serveAliases(w, r, parts[1:])
+	case parts[0] == "collections" && len(parts) <= 2:
+		f.serveCollections(w, r, parts[1:])
+	case parts[0] == "collections" && parts[2] == "documents":
+		f.serveDocuments(w, r, parts[1], parts[3:])
+	case parts[0] == "multi_search" && r.Method == http.MethodPost:
+		f.serveMultiSearch(w, r)
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]any{"message": "Not Found"})
+	}
+}
+
+func (f *fakeTypesense) serveAliases(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) == 0 {
+		var aliases []map[string]string
+		for name, target := range f.aliases {
+			aliases = append(aliases, map[string]string{"name": name, "collection_name": target})
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"aliases": aliases})
+		return
+	}
+	name := parts[0]
+	switch r.Method {
+	case http.MethodGet:
+		target, ok := f.aliases[name]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]any{"message": "Not Found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"name": name, "collection_name": target})
+	case http.MethodPut:
+		var body struct {
+			CollectionName string `json:"collection_name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.CollectionName == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"message": "Parameter `collection_name` is required."})
+			return
+		}
+		if _, ok := f.collections[name]; ok {
+			writeJSON(w, http.StatusConflict, map[string]any{"message": "A collection with that name already exists."})
+			return
+		}
+		f.aliases[name] = body.CollectionName
+		writeJSON(w, http.StatusOK, map[string]string{"name": name, "collection_name": body.CollectionName})
+	case http.MethodDelete:
+		target, ok := f.aliases[name]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]any{"message": "Not Found"})
+			return
+		}
+		delete(f.aliases, name)
+		writeJSON(w, http.StatusOK, map[string]string{"name": name, "collection_name": target})
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]any{"message": "Method Not Allowed"})
+	}
+}
+
+func (f *fakeTypesense) serveCollections(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			list := []map[string]any{}
+			for _, name := range slices.Sorted(mapsKeys(f.collections)) {
+				list = append(list, f.collectionInfo(name))
+			}
+			writeJSON(w, http.StatusOK, list)
+		case http.MethodPost:
+			var schema map[string]any
+			if err := json.NewDecoder(r.Body).Decode(&schema); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]any{"message": "Bad JSON."})
+				return
+			}
+			name, _ := schema["name"].(string)
+			if name == "" {
+				writeJSON(w, http.StatusBadRequest, map[string]any{"message": "Parameter `name` is required."})
+				return
+			}
+			if _, ok := f.collections[name]; ok {
+				writeJSON(w, http.StatusConflict, map[string]any{"message": fmt.Sprintf("A collection with name `%s` already exists.", name)})
+				return
+			}
+			f.collections[name] = &fakeCollection{schema: schema, docs: map[string]map[string]any{}}
+			writeJSON(w, http.StatusCreated, f.collectionInfo(name))
+		default:
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]any{"message": "Method Not Allowed"})
+		}
+		return
+	}
+
+	name := f.resolve(parts[0])
+	if _, ok := f.collections[name]; !ok {
+		writeJSON(w, http.StatusNotFound, map[string]any{"message": fmt.Sprintf("Collection `%s` not found.", parts[0])})
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, f.collectionInfo(name))
+	case http.MethodDelete:
+		info := f.collectionInfo(name)
+		delete(f.collections, name)
+		writeJSON(w, http.StatusOK, info)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]any{"message": "Method Not Allowed"})
+	}
+}
+
+func (f *fakeTypesense) collectionInfo(name string) map[string]any {
+	c := f.collections[name]
+	info := map[string]any{}
+	for k, v := range c.schema {
+		info[k] = v
+	}
+	info["name"] = name
+	info["num_documents"] = len(c.docs)
+	return info
+}
+
+func (f *fakeTypesense) serveDocuments(w http.ResponseWriter, r *http.Request, collection string, parts []string) {
+	c := f.collections[f.resolve(collection)]
+	if c == nil {
+		writeJSON(w, http.StatusNotFound, map[string]any{"message": fmt.Sprintf("Collection `%s` not found.", collection)})
+		return
+	}
+
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		var doc map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&doc); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"message": "Bad JSON."})
+			return
+		}
+		if err := c.upsert(doc, r.URL.Query().Get("action")); err != nil {
+			writeJSON(w, http.StatusConflict, map[string]any{"message": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusCreated, doc)
+
+	case len(parts) == 0 && r.Method == http.MethodDelete:
+		filter, err := parseFakeFilter(r.URL.Query().Get("filter_by"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"message": err.Error()})
+			return
+		}
+		deleted := 0
+		for id, doc := range c.docs {
+			if filter.matches(doc) {
+				delete(c.docs, id)
+				deleted++
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"num_deleted": deleted})
+
+	case len(parts) == 1 && parts[0] == "import" && r.Method == http.MethodPost:
+		action := r.URL.Query().Get("action")
+		var results []string
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(make([]byte, 0, 1<<20), 64<<20)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			var doc map[string]any
+			if err := json.Unmarshal([]byte(line), &doc); err != nil {
+				results = append(results, `{"success":false,"error":"Bad JSON."}`)
+				continue
+			}
+			if err := c.upsert(doc, action); err != nil {
+				data, _ := json.Marshal(map[string]any{"success": false, "error": err.Error()})
+				results = append(results, string(data))
+				continue
+			}
+			results = append(results, `{"success":true}`)
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, strings.Join(results, "\n"))
+
+	case len(parts) == 1 && parts[0] == "export" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "text/plain")
+		for _, id := range slices.Sorted(mapsKeys(c.docs)) {
+			data, _ := json.Marshal(c.docs[id])
+			w.Write(append(data, '\n'))
+		}
+
+	case len(parts) == 1 && parts[0] == "search" && r.Method == http.MethodGet:
+		params := map[string]any{}
+		for key, values := range r.URL.Query() {
+			params[key] = values[0]
+		}
+		status, result := c.search(params)
+		writeJSON(w, status, result)
+
+	case len(parts) == 1:
+		id, _ := url.PathUnescape(parts[0])
+		doc, ok := c.docs[id]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]any{"message": "Could not find a document with id: " + id})
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, doc)
+		case http.MethodDelete:
+			delete(c.docs, id)
+			writeJSON(w, http.StatusOK, doc)
+		case http.MethodPatch:
+			var update map[string]any
+			if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]any{"message": "Bad JSON."})
+				return
+			}
+			for k, v := range update {
+				doc[k] = v
+			}
+			writeJSON(w, http.StatusOK, doc)
+		default:
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]any{"message": "Method Not Allowed"})
+		}
+
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]any{"message": "Not Found"})
+	}
+}
+
+func (f *fakeTypesense) serveMultiSearch(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Searches []map[string]any `json:"searches"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"message": "Bad JSON."})
+		return
+	}
+	results := []any{}
+	for _, search := range body.Searches {
+		params := map[string]any{}
+		for key, values := range r.URL.Query() {
+			params[key] = values[0]
+		}
+		for key, value := range search {
+			params[key] = value
+		}
+		name, _ := params["collection"].(string)
+		c := f.collections[f.resolve(name)]
+		if c == nil {
+			results = append(results, map[string]any{"code": 404, "error": fmt.Sprintf("Collection `%s` not found.", name)})
+			continue
+		}
+		status, result := c.search(params)
+		if status != http.StatusOK {
+			result = map[string]any{"code": status, "error": result["message"]}
+		}
+		results = append(results, result)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"results": results})
+}
+
+func (c *fakeCollection) upsert(doc map[string]any, action string) error {
+	id, _ := doc["id"].(string)
+	if id == "" {
+		return fmt.Errorf("document has no id")
+	}
+	if _, exists := c.docs[id]; exists && (action == "" || action == "create") {
+		return fmt.Errorf("a document with id %s already exists", id)
+	}
+	c.docs[id] = doc
+	return nil
+}
+
+// search runs a Typesense search over the collection and returns the HTTP
+// status and response body.
+func (c *fakeCollection) search(params map[string]any) (int, map[string]any) {
+	str := func(key string) string {
+		switch v := params[key].(type) {
+		case string:
+			return v
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		case nil:
+			return ""
+		default:
+			return fmt.Sprint(v)
+		}
+	}
+	intParam := func(key string, def int) int {
+		if n, err := strconv.Atoi(str(key)); err == nil {
+			return n
+		}
+		return def
+	}
+	badRequest := func(msg string) (int, map[string]any) {
+		return http.StatusBadRequest, map[string]any{"message": msg}
+	}
+
+	q := str("q")
+	if q == "" {
+		return badRequest("Parameter `q` is required.")
+	}
+	filter, err := parseFakeFilter(str("filter_by"))
+	if err != nil {
+		return badRequest(err.Error())
+	}
+	var queryBy []string
+	if q != "*" {
+		if str("query_by") == "" {
+			return badRequest("Parameter `query_by` is required.")
+		}
+		queryBy = strings.Split(str("query_by"), ",")
+	}
+	var vq *fakeVectorQuery
+	if s := str("vector_query"); s != "" {
+		if vq, err = parseFakeVectorQuery(s); err != nil {
+			return badRequest(err.Error())
+		}
+		if len(vq.vector) == 0 {
+			source, ok := c.docs[vq.id]
+			if !ok {
+				return badRequest("Document id referenced in vector query is not found.")
+			}
+			vq.vector = docVector(source[vq.field])
+			if vq.vector == nil {
+				return badRequest("Document referenced in vector query does not contain a valid vector field.")
+			}
+		}
+	}
+
+	type hit struct {
+		doc      map[string]any
+		distance float64
+		keyword  bool
+	}
+	var hits []hit
+	terms := strings.Fields(strings.ToLower(q))
+	for id, doc := range c.docs {
+		if !filter.matches(doc) {
+			continue
+		}
+		h := hit{doc: doc, distance: math.Inf(1)}
+		if q == "*" {
+			h.keyword = vq == nil
+		} else {
+			h.keyword = matchesTerms(doc, queryBy, terms)
+		}
+		if vq != nil && id != vq.id {
+			if v := docVector(doc[vq.field]); len(v) == len(vq.vector) {
+				h.distance = cosineDistance(vq.vector, v)
+			}
+		}
+		if h.keyword || !math.IsInf(h.distance, 1) {
+			hits = append(hits, h)
+		}
+	}
+
+	if vq != nil {
+		// Nearest first, keyword-only matches after all vector matches
+		slices.SortFunc(hits, func(a, b hit) int {
+			if c := cmp.Compare(a.distance, b.distance); c != 0 {
+				return c
+			}
+			return cmp.Compare(fmt.Sprint(a.doc["id"]), fmt.Sprint(b.doc["id"]))
+		})
+		vectorHits := 0
+		hits = slices.DeleteFunc(hits, func(h hit) bool {
+			if math.IsInf(h.distance, 1) {
+				return false
+			}
+			vectorHits++
+			return vectorHits > vq.k && !h.keyword
+		})
+	} else {
+		slices.SortFunc(hits, func(a, b hit) int {
+			if c := cmp.Compare(docNumber(b.doc["created_at"]), docNumber(a.doc["created_at"])); c != 0 {
+				return c
+			}
+			return cmp.Compare(fmt.Sprint(a.doc["id"]), fmt.Sprint(b.doc["id"]))
+		})
+	}
+
+	perPage := intParam("per_page", 10)
+	page := max(intParam("page", 1), 1)
+	result := map[string]any{
+		"found":  len(hits),
+		"out_of": len(c.docs),
+		"page":   page,
+		"hits":   []any{},
+	}
+	if facetBy := str("facet_by"); facetBy != "" {
+		docs := make([]map[string]any, len(hits))
+		for i, h := range hits {
+			docs[i] = h.doc
+		}
+		facetCounts, err := c.facetCounts(docs, strings.Split(facetBy, ","), intParam("max_facet_values", 10))
+		if err != nil {
+			return badRequest(err.Error())
+		}
+		result["facet_counts"] = facetCounts
+	}
+	start := min((page-1)*perPage, len(hits))
+	end := min(start+perPage, len(hits))
+	out := []any{}
+	for _, h := range hits[start:end] {
+		entry := map[string]any{"document": h.doc}
+		if !math.IsInf(h.distance, 1) {
+			entry["vector_distance"] = h.distance
+		}
+		out = append(out, entry)
+	}
+	result["hits"] = out
+	return http.StatusOK, result
+}
+
+// facetCounts counts the values of each field over docs, most frequent first.
+// As in Typesense, only fields declared with facet: true can be faceted.
+func (c *fakeCollection) facetCounts(docs []map[string]any, fields []string, maxValues int) ([]any, error) {
+	var out []any
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		facetable := false
+		for _, f := range c.schema["fields"].([]any) {
+			if f, ok := f.(map[string]any); ok && f["name"] == field && f["facet"] == true {
+				facetable = true
+			}
+		}
+		if !facetable {
+			return nil, fmt.Errorf("Could not find a facet field named `%s` in the schema.", field)
+		}
+		counts := map[string]int{}
+		for _, doc := range docs {
+			seen := map[string]bool{}
+			for _, v := range docValues(doc, field) {
+				value := fmt.Sprint(v)
+				if !seen[value] {
+					seen[value] = true
+					counts[value]++
+				}
+			}
+		}
+		values := slices.SortedFunc(mapsKeys(counts), func(a, b string) int {
+			if c := cmp.Compare(counts[b], counts[a]); c != 0 {
+				return c
+			}
+			return cmp.Compare(a, b)
+		})
+		entries := []any{}
+		for _, value := range values[:min(maxValues, len(values))] {
+			entries = append(entries, map[string]any{"value": value, "count": counts[value]})
+		}
+		out = append(out, map[string]any{"field_name": field, "counts": entries})
+	}
+	return out, nil
+}
+
+// fakeFilter is a conjunction of filter_by clauses.
+type fakeFilter []fakeClause
+
+type fakeClause struct {
+	field  string
+	op     string // "=", "!=", ">", ">=", "<", "<=" or "" for a match
+	values []string
+}
+
+func parseFakeFilter(s string) (fakeFilter, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	if strings.Contains(s, "||") || strings.ContainsAny(s, "()") {
+		return nil, fmt.Errorf("fake typesense: unsupported filter_by %q", s)
+	}
+	var filter fakeFilter
+	for _, part := range splitOutsideQuotes(s, "&&") {
+		part = strings.TrimSpace(part)
+		field, rest, ok := strings.Cut(part, ":")
+		if !ok {
+			return nil, fmt.Errorf("fake typesense: could not parse filter_by clause %q", part)
+		}
+		clause := fakeClause{field: strings.TrimSpace(field)}
+		rest = strings.TrimSpace(rest)
+		for _, op := range []string{"!=", ">=", "<=", "=", ">", "<"} {
+			if strings.HasPrefix(rest, op) {
+				clause.op = op
+				rest = strings.TrimSpace(rest[len(op):])
+				break
+			}
+		}
+		if strings.HasPrefix(rest, "[") && strings.HasSuffix(rest, "]") {
+			for _, v := range splitOutsideQuotes(rest[1:len(rest)-1], ",") {
+				clause.values = append(clause.values, unquoteFilterValue(v))
+			}
+		} else {
+			clause.values = []string{unquoteFilterValue(rest)}
+		}
+		filter = append(filter, clause)
+	}
+	return filter, nil
+}
+
+func (f fakeFilter) matches(doc map[string]any) bool {
+	for _, clause := range f {
+		values := docValues(doc, clause.field)
+		matched := false
+		for _, want := range clause.values {
+			for _, have := range values {
+				if compareFilterValue(have, clause.op, want) {
+					matched = true
+				}
+			}
+		}
+		if clause.op == "!=" {
+			// Negation holds only if no value equals any excluded one
+			matched = true
+			for _, want := range clause.values {
+				for _, have := range values {
+					if fmt.Sprint(have) == want {
+						matched = false
+					}
+				}
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func compareFilterValue(have any, op, want string) bool {
+	switch op {
+	case ">", ">=", "<", "<=":
+		w, err := strconv.ParseFloat(want, 64)
+		if err != nil {
+			return false
+		}
+		h := docNumber(have)
+		switch op {
+		case ">":
+			return h > w
+		case ">=":
+			return h >= w
+		case "<":
+			return h < w
+		default:
+			return h <= w
+		}
+	case "=", "!=":
+		return fmt.Sprint(have) == want || (isNumber(have) && numberEquals(have, want))
+	default:
+		// A plain match is case-insensitive on strings
+		return strings.EqualFold(fmt.Sprint(have), want) || (isNumber(have) && numberEquals(have, want))
+	}
+}
+
+type fakeVectorQuery struct {
+	field  string
+	vector []float64
+	id     string
+	k      int
+}
+
+// parseFakeVectorQuery parses "field:([v1, v2], id: x, k: n, alpha: a)".
+func parseFakeVectorQuery(s string) (*fakeVectorQuery, error) {
+	field, rest, ok := strings.Cut(s, ":")
+	if !ok || !strings.HasPrefix(strings.TrimSpace(rest), "(") || !strings.HasSuffix(rest, ")") {
+		return nil, fmt.Errorf("fake typesense: malformed vector query %q", s)
+	}
+	rest = strings.TrimSpace(rest)
+	rest = rest[1 : len(rest)-1]
+	open, closing := strings.Index(rest, "["), strings.Index(rest, "]")
+	if open != 0 || closing < 0 {
+		return nil, fmt.Errorf("fake typesense: malformed vector query %q", s)
+	}
+	vq := &fakeVectorQuery{field: strings.TrimSpace(field), k: 10}
+	for _, v := range strings.Split(rest[1:closing], ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("fake typesense: malformed vector value %q", v)
+		}
+		vq.vector = append(vq.vector, f)
+	}
+	for _, param := range strings.Split(rest[closing+1:], ",") {
+		key, value, ok := strings.Cut(param, ":")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "id":
+			vq.id = strings.TrimSpace(value)
+		case "k":
+			n, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return nil, fmt.Errorf("fake typesense: malformed k %q", value)
+			}
+			vq.k = n
+		}
+	}
+	if len(vq.vector) == 0 && vq.id == "" {
+		return nil, fmt.Errorf("fake typesense: vector query needs a vector or an id")
+	}
+	return vq, nil
+}
+
+// docValues resolves a possibly dotted field path to the scalar values it
+// holds, flattening arrays on the way.
+func docValues(doc map[string]any, path string) []any {
+	values := []any{doc}
+	for _, key := range strings.Split(path, ".") {
+		var next []any
+		for _, v := range values {
+			m, ok := v.(map[string]any)
+			if !ok {
+				continue
+			}
+			switch child := m[key].(type) {
+			case nil:
+			case []any:
+				next = append(next, child...)
+			default:
+				next = append(next, child)
+			}
+		}
+		values = next
+	}
+	return values
+}
+
+func matchesTerms(doc map[string]any, fields, terms []string) bool {
+	for _, field := range fields {
+		for _, v := range docValues(doc, strings.TrimSpace(field)) {
+			s, ok := v.(string)
+			if !ok {
+				continue
+			}
+			s = strings.ToLower(s)
+			for _, term := range terms {
+				if strings.Contains(s, term) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func docVector(v any) []float64 {
+	list, ok := v.([]any)
+	if !ok || len(list) == 0 {
+		return nil
+	}
+	vector := make([]float64, len(list))
+	for i, x := range list {
+		f, ok := x.(float64)
+		if !ok {
+			return nil
+		}
+		vector[i] = f
+	}
+	return vector
+}
+
+func cosineDistance(a, b []float64) float64 {
+	var dot, na, nb float64
+	for i := range a {
+		dot += a[i] * b[i]
+		na += a[i] * a[i]
+		nb += b[i] * b[i]
+	}
+	if na == 0 || nb == 0 {
+		return 1
+	}
+	return 1 - dot/(math.Sqrt(na)*math.Sqrt(nb))
+}
+
+func docNumber(v any) float64 {
+	if f, ok := v.(float64); ok {
+		return f
+	}
+	return 0
+}
+
+func isNumber(v any) bool {
+	_, ok := v.(float64)
+	return ok
+}
+
+func numberEquals(have any, want string) bool {
+	w, err := strconv.ParseFloat(want, 64)
+	return err == nil && docNumber(have) == w
+}
+
+func unquoteFilterValue(v string) string {
+	v = strings.TrimSpace(v)
+	if len(v) >= 2 && v[0] == '`' && v[len(v)-1] == '`' {
+		return v[1 : len(v)-1]
+	}
+	return v
+}
+
+// splitOutsideQuotes splits s at sep, except inside backtick-quoted values.
+func splitOutsideQuotes(s, sep string) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '`':
+			quoted = !quoted
+		case !quoted && strings.HasPrefix(s[i:], sep):
+			parts = append(parts, s[start:i])
+			start = i + len(sep)
+			i += len(sep) - 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func mapsKeys[V any](m map[string]V) func(yield func(string) bool) {
+	return func(yield func(string) bool) {
+		for k := range m {
+			if !yield(k) {
+				return
+			}
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
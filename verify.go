@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore/boltdb"
+	"fiatjaf.com/nostr/eventstore/typesense30142"
+)
+
+const (
+	// verifyPageSize is the number of documents fetched per Typesense query
+	// while walking the collection.
+	verifyPageSize = 250
+	// verifySampleSize limits how many IDs are reported per difference type.
+	verifySampleSize = 20
+)
+
+type VerifyStatus struct {
+	Running     bool     `json:"running"`
+	Repair      bool     `json:"repair"`
+	BoltEvents  int64    `json:"bolt_events"`
+	IndexedDocs int64    `json:"indexed_docs"`
+	Missing     int64    `json:"missing"`
+	Stale       int64    `json:"stale"`
+	Orphaned    int64    `json:"orphaned"`
+	Repaired    int64    `json:"repaired"`
+	Skipped     int64    `json:"skipped"`
+	Errors      int64    `json:"errors"`
+	Error       string   `json:"error,omitempty"`
+	MissingIDs  []string `json:"missing_ids,omitempty"`
+	StaleIDs    []string `json:"stale_ids,omitempty"`
+	OrphanedIDs []string `json:"orphaned_ids,omitempty"`
+}
+
+// IndexVerifier compares the kind 30142 events in BoltDB with the documents in
+// the Typesense collection and optionally repairs the differences in place.
+type IndexVerifier struct {
+	tsDB   *typesense30142.TSBackend
+	boltDB *boltdb.BoltBackend
+	mgmt   *ManagementStore
+	outbox *IndexOutbox
+
+	mu      sync.Mutex
+	status  VerifyStatus
+	running atomic.Bool
+}
+
+func NewIndexVerifier(tsDB *typesense30142.TSBackend, boltDB *boltdb.BoltBackend, mgmt *ManagementStore, outbox *IndexOutbox) *IndexVerifier {
+	return &IndexVerifier{
+		tsDB:   tsDB,
+		boltDB: boltDB,
+		mgmt:   mgmt,
+		outbox: outbox,
+	}
+}
+
+// Start begins a verification in the background. If repair is true, missing
+// and stale documents are re-upserted from BoltDB and orphans are deleted
+// through the outbox.
+func (v *IndexVerifier) Start(repair bool) error {
+	if !v.running.CompareAndSwap(false, true) {
+		return fmt.Errorf("index verification already in progress")
+	}
+	v.mu.Lock()
+	v.status = VerifyStatus{Running: true, Repair: repair}
+	v.mu.Unlock()
+
+	go v.run(repair)
+	return nil
+}
+
+func (v *IndexVerifier) run(repair bool) {
+	defer func() {
+		v.mu.Lock()
+		v.status.Running = false
+		v.mu.Unlock()
+		v.running.Store(false)
+	}()
+
+	// Expected state: the latest version of every address in BoltDB
+	expected := map[string]nostr.Event{}
+	for event := range v.boltDB.QueryEvents(nostr.Filter{Kinds: []nostr.Kind{30142}}, reindexMaxEvents) {
+		if v.mgmt.PubKeyPurgeMode(event.PubKey) == PurgeHide {
+			continue
+		}
+		addr := eventAddress(event)
+		if prev, ok := expected[addr]; !ok || event.CreatedAt > prev.CreatedAt {
+			expected[addr] = event
+		}
+	}
+	v.update(func(s *VerifyStatus) { s.BoltEvents = int64(len(expected)) })
+
+	// Actual state: walk the collection newest first
+	indexed := map[string][]nostr.Event{}
+	var count int64
+	pageEvents(v.tsDB.QueryEvents, nostr.Filter{Kinds: []nostr.Kind{30142}}, verifyPageSize, func(page []nostr.Event) bool {
+		for _, event := range page {
+			count++
+			addr := eventAddress(event)
+			indexed[addr] = append(indexed[addr], event)
+		}
+		return true
+	})
+	v.update(func(s *VerifyStatus) { s.IndexedDocs = count })
+
+	var repairs []verifyRepair
+	for addr, want := range expected {
+		docs, ok := indexed[addr]
+		if !ok {
+			v.update(func(s *VerifyStatus) {
+				s.Missing++
+				s.MissingIDs = appendSample(s.MissingIDs, want.ID.Hex())
+			})
+			repairs = append(repairs, verifyRepair{address: want, expected: &want, upsert: true})
+			continue
+		}
+		// Any other indexed version of the address is older than (or replaced by) the BoltDB one
+		repair := verifyRepair{address: want, expected: &want, upsert: true}
+		for _, doc := range docs {
+			if doc.ID == want.ID {
+				repair.upsert = false
+				continue
+			}
+			v.update(func(s *VerifyStatus) {
+				s.Stale++
+				s.StaleIDs = appendSample(s.StaleIDs, doc.ID.Hex())
+			})
+			repair.deletes = append(repair.deletes, doc.ID)
+		}
+		if repair.upsert || len(repair.deletes) > 0 {
+			repairs = append(repairs, repair)
+		}
+	}
+	for addr, docs := range indexed {
+		if _, ok := expected[addr]; ok {
+			continue
+		}
+		repair := verifyRepair{address: docs[0]}
+		for _, doc := range docs {
+			v.update(func(s *VerifyStatus) {
+				s.Orphaned++
+				s.OrphanedIDs = appendSample(s.OrphanedIDs, doc.ID.Hex())
+			})
+			repair.deletes = append(repair.deletes, doc.ID)
+		}
+		repairs = append(repairs, repair)
+	}
+
+	status := v.GetStatus()
+	slog.Info("verification completed", "component", "verifyindex", "bolt", status.BoltEvents, "indexed", status.IndexedDocs,
+		"missing", status.Missing, "stale", status.Stale, "orphaned", status.Orphaned)
+
+	if !repair {
+		return
+	}
+
+	for _, repair := range repairs {
+		v.repair(repair)
+	}
+
+	status = v.GetStatus()
+	slog.Info("repair completed", "component", "verifyindex", "repaired", status.Repaired, "skipped", status.Skipped, "errors", status.Errors)
+}
+
+// verifyRepair is what it takes to bring one address in line with BoltDB:
+// the stale or orphaned documents to delete and whether the expected version
+// (nil for orphans) has to be upserted.
+type verifyRepair struct {
+	address  nostr.Event
+	expected *nostr.Event
+	upsert   bool
+	deletes  []nostr.ID
+}
+
+// repair queues the operations of r through the outbox, ordered with live
+// writes. The snapshots are minutes old on a large relay, so the address is
+// skipped once an earlier operation on it is still queued or BoltDB no longer
+// holds the expected version; the write that changed it brings the index up
+// to date on its own.
+func (v *IndexVerifier) repair(r verifyRepair) {
+	unchanged := func() bool {
+		current, ok := v.latest(r.address)
+		if r.expected == nil {
+			return !ok
+		}
+		return ok && current.ID == r.expected.ID
+	}
+	queue := func(op string, event *nostr.Event, id nostr.ID) bool {
+		seq, err := v.outbox.QueueIf(op, event, id, unchanged)
+		switch {
+		case err != nil:
+			v.update(func(s *VerifyStatus) {
+				s.Errors++
+				s.Error = fmt.Sprintf("%s %s: %v", op, id.Hex(), err)
+			})
+		case seq == 0:
+			v.update(func(s *VerifyStatus) { s.Skipped++ })
+		default:
+			v.update(func(s *VerifyStatus) { s.Repaired++ })
+		}
+		return seq != 0
+	}
+
+	// Remove stale and orphaned documents first so the re-upserted version is the only one left
+	for _, id := range r.deletes {
+		if !queue(outboxOpDelete, nil, id) {
+			return
+		}
+	}
+	if r.upsert {
+		queue(outboxOpSave, r.expected, r.expected.ID)
+	}
+}
+
+// latest re-reads the version of the address of event that should be
+// indexed now, if any.
+func (v *IndexVerifier) latest(event nostr.Event) (nostr.Event, bool) {
+	return indexedVersion(v.boltDB, v.mgmt, event)
+}
+
+// indexedVersion returns the version of the address of event that belongs
+// in the index: the latest one in BoltDB, unless its pubkey is hidden.
+func indexedVersion(boltDB *boltdb.BoltBackend, mgmt *ManagementStore, event nostr.Event) (nostr.Event, bool) {
+	if mgmt.PubKeyPurgeMode(event.PubKey) == PurgeHide {
+		return nostr.Event{}, false
+	}
+	filter := nostr.Filter{
+		Kinds:   []nostr.Kind{event.Kind},
+		Authors: []nostr.PubKey{event.PubKey},
+		Tags:    nostr.TagMap{"d": {event.Tags.GetD()}},
+	}
+	var latest nostr.Event
+	found := false
+	for stored := range boltDB.QueryEvents(filter, reindexMaxEvents) {
+		if !found || stored.CreatedAt > latest.CreatedAt {
+			latest, found = stored, true
+		}
+	}
+	return latest, found
+}
+
+func (v *IndexVerifier) update(fn func(s *VerifyStatus)) {
+	v.mu.Lock()
+	fn(&v.status)
+	v.mu.Unlock()
+}
+
+// GetStatus returns the result of the current or last verification.
+func (v *IndexVerifier) GetStatus() VerifyStatus {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	status := v.status
+	status.MissingIDs = append([]string(nil), v.status.MissingIDs...)
+	status.StaleIDs = append([]string(nil), v.status.StaleIDs...)
+	status.OrphanedIDs = append([]string(nil), v.status.OrphanedIDs...)
+	return status
+}
+
+// eventAddress returns the kind:pubkey:d address of an addressable event.
+func eventAddress(event nostr.Event) string {
+	return fmt.Sprintf("%d:%s:%s", event.Kind, event.PubKey.Hex(), event.Tags.GetD())
+}
+
+func appendSample(ids []string, id string) []string {
+	if len(ids) >= verifySampleSize {
+		return ids
+	}
+	return append(ids, id)
+}